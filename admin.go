@@ -2,23 +2,24 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
+	"log"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+// dummyPasswordHash is checked against when there's no such user, so that
+// unknown usernames take as long to turn away as wrong passwords.
+var dummyPasswordHash = []byte("$2a$10$U.EN.Vjax4eSKFepI4./eeyyAQUFCUk4DkWORulzAO62hnJqGMHs.")
+
 func (app *App) handleLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		data := map[string]any{
-			"CSRFToken": app.csrfToken,
-		}
-		err := app.templates["login.html"].ExecuteTemplate(w, "base", data)
-		if err != nil {
-			app.httpError(w, err, http.StatusInternalServerError)
-			return
-		}
+		app.renderLogin(w, r, http.StatusOK, "")
 		return
 	}
 
@@ -30,72 +31,168 @@ func (app *App) handleLogin(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 
+	// Check the lockout before bcrypt so a locked out client can't keep the
+	// CPU busy either
+	lockout, err := app.loginLockout(username, clientIP(r))
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if lockout > 0 {
+		if err := app.logLoginAttempt(r, username, false, "locked out"); err != nil {
+			log.Printf("ERROR: Failed to log login attempt: %v", err)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(lockout.Seconds())+1))
+		app.renderLogin(w, r, http.StatusTooManyRequests, "Too many failed attempts. Try again in "+formatLockout(lockout)+".")
+		return
+	}
+
 	var user User
-	err := app.db.QueryRow("SELECT id, username, password FROM users WHERE username = ?", username).
-		Scan(&user.ID, &user.Username, &user.Password)
+	err = app.db.QueryRow("SELECT id, username, password, totp_enabled, disabled FROM users WHERE username = ?", username).
+		Scan(&user.ID, &user.Username, &user.Password, &user.TOTPEnabled, &user.Disabled)
 
-	if err != nil || bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
-		data := map[string]any{
-			"Error":     "Invalid username or password",
-			"CSRFToken": app.csrfToken,
-		}
+	hash := []byte(user.Password)
+	if err != nil {
+		hash = dummyPasswordHash
+	}
+	wrongPassword := bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil
 
-		err = app.templates["login.html"].ExecuteTemplate(w, "base", data)
+	if err != nil || wrongPassword || user.Disabled {
+		reason := "bad password"
 		if err != nil {
-			app.httpError(w, err, http.StatusInternalServerError)
-			return
+			reason = "unknown user"
+		} else if user.Disabled {
+			reason = "disabled"
+		}
+		if err := app.recordLoginFailure(r, username, reason); err != nil {
+			log.Printf("ERROR: Failed to record login failure: %v", err)
 		}
+
+		app.renderLogin(w, r, http.StatusUnauthorized, "Invalid username or password")
 		return
 	}
 
-	token := generateToken()
-	http.SetCookie(w, &http.Cookie{
-		Name:     "auth_token",
-		Value:    token,
-		Path:     "/",
-		HttpOnly: true,
-		MaxAge:   86400 * 7,
-		SameSite: http.SameSiteStrictMode,
-	})
+	if user.TOTPEnabled {
+		app.startPendingLogin(w, r, user.ID)
+		return
+	}
+
+	if err := app.recordLoginSuccess(r, user.Username, "password"); err != nil {
+		log.Printf("ERROR: Failed to record login: %v", err)
+	}
+
+	if err := app.createSession(w, r, user.ID); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
 
 	http.Redirect(w, r, "/admin", http.StatusSeeOther)
 }
 
+func (app *App) renderLogin(w http.ResponseWriter, r *http.Request, status int, errMsg string) {
+	data := map[string]any{
+		"Error":     errMsg,
+		"CSRFToken": app.csrfToken(w, r),
+	}
+
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+
+	err := app.templates["login.html"].ExecuteTemplate(w, "base", data)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+}
+
 // TODO: Change to POST request to follow spec
 func (app *App) handleLogout(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:   "auth_token",
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
-	})
+	if err := app.deleteSession(r); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	clearSessionCookie(w)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func (app *App) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	app.renderAdmin(w, r, nil)
+}
+
+// renderAdmin shows the dashboard, merging in any one-off values like a
+// message after an action.
+func (app *App) renderAdmin(w http.ResponseWriter, r *http.Request, extra map[string]any) {
 	var postCount, pageCount int
 	app.db.QueryRow("SELECT COUNT(*) FROM posts").Scan(&postCount)
 	app.db.QueryRow("SELECT COUNT(*) FROM pages").Scan(&pageCount)
 
+	// The login audit log covers every account, so only owners see it
+	var loginAttempts []LoginAttempt
+	var err error
+	session := app.currentSession(r)
+	if hasRole(session.Role, roleOwner) {
+		loginAttempts, err = app.recentLoginAttempts(20)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
 	data := map[string]any{
-		"PostCount": postCount,
-		"PageCount": pageCount,
-		"CSRFToken": app.csrfToken,
+		"PostCount":     postCount,
+		"PageCount":     pageCount,
+		"LoginAttempts": loginAttempts,
+		"IsOwner":       hasRole(session.Role, roleOwner),
+		"CSRFToken":     app.csrfToken(w, r),
+	}
+	for k, v := range extra {
+		data[k] = v
 	}
 
-	err := app.templates["admin.html"].ExecuteTemplate(w, "admin_base", data)
+	err = app.templates["admin.html"].ExecuteTemplate(w, "admin_base", data)
 	if err != nil {
 		app.httpError(w, err, http.StatusInternalServerError)
 		return
 	}
 }
 
+// handleRebuildHTML re-renders every post and page, for when the Markdown
+// renderer's configuration has changed.
+func (app *App) handleRebuildHTML(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	changed, err := app.renderContentHTML(true)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.renderAdmin(w, r, map[string]any{
+		"Message": fmt.Sprintf("Rebuilt rendered HTML, %d changed.", changed),
+	})
+}
+
 func (app *App) handleAdminPosts(w http.ResponseWriter, r *http.Request) {
+	session := app.currentSession(r)
+
+	// Authors only see their own posts
+	authorFilter := 0
+	if !hasRole(session.Role, roleEditor) {
+		authorFilter = session.UserID
+	}
+
 	rows, err := app.db.Query(`
-		SELECT id, title, slug, post_type, published, created_at, updated_at
-		FROM posts
-		ORDER BY created_at DESC
-	`)
+		SELECT p.id, p.title, p.slug, p.post_type, p.published, p.publish_at, p.created_at, p.updated_at, COALESCE(u.username, '')
+		FROM posts p
+		LEFT JOIN users u ON u.id = p.author_id
+		WHERE ? = 0 OR p.author_id = ?
+		ORDER BY p.created_at DESC
+	`, authorFilter, authorFilter)
 	if err != nil {
 		app.httpError(w, err, http.StatusInternalServerError)
 		return
@@ -105,7 +202,7 @@ func (app *App) handleAdminPosts(w http.ResponseWriter, r *http.Request) {
 	var posts []Post
 	for rows.Next() {
 		var p Post
-		if err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.PostType, &p.Published, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		if err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.PostType, &p.Published, &p.PublishAt, &p.CreatedAt, &p.UpdatedAt, &p.Author); err != nil {
 			continue
 		}
 		p.Tags = app.getPostTags(p.ID)
@@ -113,8 +210,9 @@ func (app *App) handleAdminPosts(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := map[string]any{
-		"Posts":     posts,
-		"CSRFToken": app.csrfToken,
+		"Posts":         posts,
+		"CanSeeDeleted": hasRole(session.Role, roleEditor),
+		"CSRFToken":     app.csrfToken(w, r),
 	}
 
 	err = app.templates["admin_posts.html"].ExecuteTemplate(w, "admin_base", data)
@@ -126,41 +224,70 @@ func (app *App) handleAdminPosts(w http.ResponseWriter, r *http.Request) {
 
 func (app *App) handleNewPost(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		data := map[string]any{
-			"CSRFToken": app.csrfToken,
-		}
+		app.renderPostForm(w, r, nil)
+		return
+	}
 
-		err := app.templates["admin_post_form.html"].ExecuteTemplate(w, "admin_base", data)
-		if err != nil {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	post, tags, problem := postFromForm(r)
+	if problem == "" {
+		var err error
+		if problem, err = app.postProblem(post); err != nil {
 			app.httpError(w, err, http.StatusInternalServerError)
 			return
 		}
+	}
+	if problem != "" {
+		app.renderPostForm(w, r, map[string]any{
+			"Post":      post,
+			"Tags":      tags,
+			"PublishAt": r.FormValue("publish_at"),
+			"Error":     problem,
+		})
 		return
 	}
 
-	if !app.validateCSRF(r) {
-		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+	// The signed in user is the new post's author
+	rawHTML := hasRole(app.currentSession(r).Role, roleEditor)
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	title := r.FormValue("title")
-	slug := r.FormValue("slug")
-	content := r.FormValue("content")
-	postType := r.FormValue("post_type")
-	published := r.FormValue("published") == "on"
-	tags := r.FormValue("tags")
-
-	result, err := app.db.Exec(`
-		INSERT INTO posts (title, slug, content, post_type, published)
-		VALUES (?, ?, ?, ?, ?)
-	`, title, slug, content, postType, published)
+	result, err := tx.Exec(`
+		INSERT INTO posts (title, slug, content, content_html, summary, summary_html, post_type, published, publish_at, author_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, post.Title, post.Slug, post.Content, string(app.markdownToHTML(post.Content, rawHTML)), post.Summary, app.summaryHTML(post.Summary, post.Content, rawHTML),
+		post.PostType, post.Published, publishAtValue(post.PublishAt), app.currentSession(r).UserID)
 	if err != nil {
 		app.httpError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	postID, _ := result.LastInsertId()
-	app.updatePostTags(int(postID), tags)
+	postID, err := result.LastInsertId()
+	if err == nil {
+		err = updatePostTags(tx, int(postID), tags)
+	}
+	if err == nil {
+		err = updateMediaUsage(tx, "post", int(postID), post.Content+"\n"+post.Summary)
+	}
+	if err == nil {
+		err = saveRevision(tx, "post", int(postID), app.currentSession(r).UserID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
 
 	http.Redirect(w, r, "/admin/posts", http.StatusSeeOther)
 }
@@ -169,63 +296,192 @@ func (app *App) handleEditPost(w http.ResponseWriter, r *http.Request) {
 	idStr := r.PathValue("id")
 	id, _ := strconv.Atoi(idStr)
 
+	allowed, err := app.canEditPost(app.currentSession(r), id)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
 	if r.Method == "GET" {
 		var post Post
-		var tagsStr string
 		err := app.db.QueryRow(`
-			SELECT id, title, slug, content, post_type, published
+			SELECT id, title, slug, content, summary, post_type, published, publish_at
 			FROM posts
 			WHERE id = ?
-		`, id).Scan(&post.ID, &post.Title, &post.Slug, &post.Content, &post.PostType, &post.Published)
+		`, id).Scan(&post.ID, &post.Title, &post.Slug, &post.Content, &post.Summary, &post.PostType, &post.Published, &post.PublishAt)
 		if err != nil {
 			app.httpError(w, err, http.StatusNotFound)
 			return
 		}
 
-		tags := app.getPostTags(post.ID)
-		tagsStr = strings.Join(tags, ", ")
-
-		data := map[string]any{
+		app.renderPostForm(w, r, map[string]any{
 			"Post":      post,
-			"Tags":      tagsStr,
-			"CSRFToken": app.csrfToken,
-		}
+			"Tags":      strings.Join(tagNames(app.getPostTags(post.ID)), ", "),
+			"PublishAt": formatPublishAt(post.PublishAt),
+		})
+		return
+	}
 
-		err = app.templates["admin_post_form.html"].ExecuteTemplate(w, "admin_base", data)
-		if err != nil {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	post, tags, problem := postFromForm(r)
+	post.ID = id
+	if problem == "" {
+		if problem, err = app.postProblem(post); err != nil {
 			app.httpError(w, err, http.StatusInternalServerError)
 			return
 		}
+	}
+	if problem != "" {
+		app.renderPostForm(w, r, map[string]any{
+			"Post":      post,
+			"Tags":      tags,
+			"PublishAt": r.FormValue("publish_at"),
+			"Error":     problem,
+		})
 		return
 	}
 
-	if !app.validateCSRF(r) {
-		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+	// Raw HTML depends on who wrote the post, not who's editing it
+	rawHTML, err := app.postRawHTMLAllowed(id)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	title := r.FormValue("title")
-	slug := r.FormValue("slug")
-	content := r.FormValue("content")
-	postType := r.FormValue("post_type")
-	published := r.FormValue("published") == "on"
-	tags := r.FormValue("tags")
-
-	_, err := app.db.Exec(`
-		UPDATE posts
-		SET title = ?, slug = ?, content = ?, post_type = ?, published = ?, updated_at = CURRENT_TIMESTAMP
-		WHERE id = ?
-	`, title, slug, content, postType, published, id)
+	tx, err := app.db.Begin()
 	if err != nil {
 		app.httpError(w, err, http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	app.updatePostTags(id, tags)
+	oldPath, err := publishedPath(tx, "post", id)
+	if err == nil {
+		_, err = tx.Exec(`
+			UPDATE posts
+			SET title = ?, slug = ?, content = ?, content_html = ?, summary = ?, summary_html = ?, post_type = ?, published = ?, publish_at = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ?
+		`, post.Title, post.Slug, post.Content, string(app.markdownToHTML(post.Content, rawHTML)), post.Summary, app.summaryHTML(post.Summary, post.Content, rawHTML),
+			post.PostType, post.Published, publishAtValue(post.PublishAt), id)
+	}
+	if err == nil {
+		err = updatePostTags(tx, id, tags)
+	}
+	if err == nil {
+		err = updateMediaUsage(tx, "post", id, post.Content+"\n"+post.Summary)
+	}
+	if err == nil {
+		err = saveRevision(tx, "post", id, app.currentSession(r).UserID)
+	}
+	if err == nil {
+		err = redirectMoved(tx, "post", id, oldPath)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
 
 	http.Redirect(w, r, "/admin/posts", http.StatusSeeOther)
 }
 
+// postFromForm reads the post editor. It returns the post, its tags as typed,
+// and a problem to show if the publish time couldn't be read or has passed.
+func postFromForm(r *http.Request) (Post, string, string) {
+	post := Post{
+		Title:     r.FormValue("title"),
+		Slug:      strings.TrimSpace(r.FormValue("slug")),
+		Content:   r.FormValue("content"),
+		Summary:   r.FormValue("summary"),
+		PostType:  r.FormValue("post_type"),
+		Published: r.FormValue("published") == "on",
+	}
+
+	publishAt, err := parsePublishAt(r.FormValue("publish_at"))
+	if err != nil {
+		return post, r.FormValue("tags"), "The publish time isn't a valid date and time"
+	}
+	post.PublishAt = publishAt
+	if problem := publishAtProblem(post.Published, publishAt); problem != "" {
+		return post, r.FormValue("tags"), problem
+	}
+	// A future publish time holds the post back until the scheduler runs
+	if publishAt.Valid && publishAt.Time.After(time.Now()) {
+		post.Published = false
+	}
+	return post, r.FormValue("tags"), ""
+}
+
+// publishAtProblem refuses to schedule a draft for a time that has passed,
+// which the scheduler would publish straight away. The current minute still
+// counts, since that's as precise as the field gets.
+func publishAtProblem(published bool, publishAt sql.NullTime) string {
+	if !published && publishAt.Valid && publishAt.Time.Before(time.Now().Truncate(time.Minute)) {
+		return "That publish time has passed. Pick a later one, or tick Published to publish now"
+	}
+	return ""
+}
+
+// postProblem explains why a post from the editor can't be saved, or returns
+// "".
+func (app *App) postProblem(post Post) (string, error) {
+	if problem := slugProblem(post.Slug); problem != "" {
+		return problem, nil
+	}
+	if !slices.Contains(postTypes, post.PostType) {
+		return "Choose a post type", nil
+	}
+
+	var taken bool
+	err := app.db.QueryRow("SELECT EXISTS(SELECT 1 FROM posts WHERE slug = ? AND id != ?)", post.Slug, post.ID).Scan(&taken)
+	if err != nil || !taken {
+		return "", err
+	}
+	return "Another post already uses the slug " + post.Slug, nil
+}
+
+// slugProblem explains what's wrong with a post or page slug, or returns "".
+// Slugs are a single segment of the URL.
+func slugProblem(slug string) string {
+	switch {
+	case slug == "":
+		return "The slug can't be empty"
+	case strings.ContainsAny(slug, "/\\?# \t"):
+		return "The slug can't contain slashes, spaces, ? or #"
+	case slug == "." || slug == "..":
+		return "The slug can't be . or .."
+	}
+	return ""
+}
+
+// renderPostForm shows the post editor, merging in the post being edited, its
+// tags and publish time, and any error from saving it.
+func (app *App) renderPostForm(w http.ResponseWriter, r *http.Request, extra map[string]any) {
+	data := map[string]any{
+		"Post":      Post{},
+		"CSRFToken": app.csrfToken(w, r),
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	err := app.templates["admin_post_form.html"].ExecuteTemplate(w, "admin_base", data)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+}
+
 func (app *App) handleDeletePost(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -240,18 +496,27 @@ func (app *App) handleDeletePost(w http.ResponseWriter, r *http.Request) {
 	idStr := r.FormValue("id")
 	id, _ := strconv.Atoi(idStr)
 
-	_, err := app.db.Exec("DELETE FROM posts WHERE id = ?", id)
+	allowed, err := app.canEditPost(app.currentSession(r), id)
 	if err != nil {
 		app.httpError(w, err, http.StatusInternalServerError)
 		return
 	}
+	if !allowed {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if err := app.deleteContent("post", id); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
 
 	http.Redirect(w, r, "/admin/posts", http.StatusSeeOther)
 }
 
 func (app *App) handleAdminPages(w http.ResponseWriter, r *http.Request) {
 	rows, err := app.db.Query(`
-		SELECT id, title, slug, published, created_at, updated_at
+		SELECT id, title, slug, published, publish_at, created_at, updated_at
 		FROM pages
 		ORDER BY created_at DESC
 	`)
@@ -264,7 +529,7 @@ func (app *App) handleAdminPages(w http.ResponseWriter, r *http.Request) {
 	var pages []Page
 	for rows.Next() {
 		var p Page
-		if err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.Published, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		if err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.Published, &p.PublishAt, &p.CreatedAt, &p.UpdatedAt); err != nil {
 			continue
 		}
 		pages = append(pages, p)
@@ -272,7 +537,7 @@ func (app *App) handleAdminPages(w http.ResponseWriter, r *http.Request) {
 
 	data := map[string]any{
 		"Pages":     pages,
-		"CSRFToken": app.csrfToken,
+		"CSRFToken": app.csrfToken(w, r),
 	}
 
 	err = app.templates["admin_pages.html"].ExecuteTemplate(w, "admin_base", data)
@@ -284,32 +549,58 @@ func (app *App) handleAdminPages(w http.ResponseWriter, r *http.Request) {
 
 func (app *App) handleNewPage(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		data := map[string]any{
-			"CSRFToken": app.csrfToken,
-		}
+		app.renderPageForm(w, r, nil)
+		return
+	}
 
-		err := app.templates["admin_page_form.html"].ExecuteTemplate(w, "admin_base", data)
-		if err != nil {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	page, problem := pageFromForm(r)
+	if problem == "" {
+		var err error
+		if problem, err = app.pageProblem(page); err != nil {
 			app.httpError(w, err, http.StatusInternalServerError)
 			return
 		}
+	}
+	if problem != "" {
+		app.renderPageForm(w, r, map[string]any{
+			"Page":      page,
+			"PublishAt": r.FormValue("publish_at"),
+			"Error":     problem,
+		})
 		return
 	}
 
-	if !app.validateCSRF(r) {
-		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+	tx, err := app.db.Begin()
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	title := r.FormValue("title")
-	slug := r.FormValue("slug")
-	content := r.FormValue("content")
-	published := r.FormValue("published") == "on"
+	result, err := tx.Exec(`
+		INSERT INTO pages (title, slug, content, content_html, published, publish_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, page.Title, page.Slug, page.Content, string(app.markdownToHTML(page.Content, true)), page.Published, publishAtValue(page.PublishAt))
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
 
-	_, err := app.db.Exec(`
-		INSERT INTO pages (title, slug, content, published)
-		VALUES (?, ?, ?, ?)
-	`, title, slug, content, published)
+	pageID, err := result.LastInsertId()
+	if err == nil {
+		err = updateMediaUsage(tx, "page", int(pageID), page.Content)
+	}
+	if err == nil {
+		err = saveRevision(tx, "page", int(pageID), app.currentSession(r).UserID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		app.httpError(w, err, http.StatusInternalServerError)
 		return
@@ -325,43 +616,72 @@ func (app *App) handleEditPage(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		var page Page
 		err := app.db.QueryRow(`
-			SELECT id, title, slug, content, published
+			SELECT id, title, slug, content, published, publish_at
 			FROM pages
 			WHERE id = ?
-		`, id).Scan(&page.ID, &page.Title, &page.Slug, &page.Content, &page.Published)
+		`, id).Scan(&page.ID, &page.Title, &page.Slug, &page.Content, &page.Published, &page.PublishAt)
 		if err != nil {
 			app.httpError(w, err, http.StatusNotFound)
 			return
 		}
 
-		data := map[string]any{
+		app.renderPageForm(w, r, map[string]any{
 			"Page":      page,
-			"CSRFToken": app.csrfToken,
-		}
+			"PublishAt": formatPublishAt(page.PublishAt),
+		})
+		return
+	}
 
-		err = app.templates["admin_page_form.html"].ExecuteTemplate(w, "admin_base", data)
-		if err != nil {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	page, problem := pageFromForm(r)
+	page.ID = id
+	if problem == "" {
+		var err error
+		if problem, err = app.pageProblem(page); err != nil {
 			app.httpError(w, err, http.StatusInternalServerError)
 			return
 		}
+	}
+	if problem != "" {
+		app.renderPageForm(w, r, map[string]any{
+			"Page":      page,
+			"PublishAt": r.FormValue("publish_at"),
+			"Error":     problem,
+		})
 		return
 	}
 
-	if !app.validateCSRF(r) {
-		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+	tx, err := app.db.Begin()
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	title := r.FormValue("title")
-	slug := r.FormValue("slug")
-	content := r.FormValue("content")
-	published := r.FormValue("published") == "on"
-
-	_, err := app.db.Exec(`
-		UPDATE pages
-		SET title = ?, slug = ?, content = ?, published = ?, updated_at = CURRENT_TIMESTAMP
-		WHERE id = ?
-	`, title, slug, content, published, id)
+	oldPath, err := publishedPath(tx, "page", id)
+	if err == nil {
+		_, err = tx.Exec(`
+			UPDATE pages
+			SET title = ?, slug = ?, content = ?, content_html = ?, published = ?, publish_at = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ?
+		`, page.Title, page.Slug, page.Content, string(app.markdownToHTML(page.Content, true)), page.Published, publishAtValue(page.PublishAt), id)
+	}
+	if err == nil {
+		err = updateMediaUsage(tx, "page", id, page.Content)
+	}
+	if err == nil {
+		err = saveRevision(tx, "page", id, app.currentSession(r).UserID)
+	}
+	if err == nil {
+		err = redirectMoved(tx, "page", id, oldPath)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		app.httpError(w, err, http.StatusInternalServerError)
 		return
@@ -370,6 +690,66 @@ func (app *App) handleEditPage(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/admin/pages", http.StatusSeeOther)
 }
 
+// pageFromForm reads the page editor. It returns the page and a problem to
+// show if the publish time couldn't be read or has passed.
+func pageFromForm(r *http.Request) (Page, string) {
+	page := Page{
+		Title:     strings.TrimSpace(r.FormValue("title")),
+		Slug:      strings.TrimSpace(r.FormValue("slug")),
+		Content:   r.FormValue("content"),
+		Published: r.FormValue("published") == "on",
+	}
+
+	publishAt, err := parsePublishAt(r.FormValue("publish_at"))
+	if err != nil {
+		return page, "The publish time isn't a valid date and time"
+	}
+	page.PublishAt = publishAt
+	if problem := publishAtProblem(page.Published, publishAt); problem != "" {
+		return page, problem
+	}
+	if publishAt.Valid && publishAt.Time.After(time.Now()) {
+		page.Published = false
+	}
+	return page, ""
+}
+
+// pageProblem explains why a page from the editor can't be saved, or returns
+// "".
+func (app *App) pageProblem(page Page) (string, error) {
+	if page.Title == "" {
+		return "Pages need a title", nil
+	}
+	if problem := slugProblem(page.Slug); problem != "" {
+		return problem, nil
+	}
+
+	var taken bool
+	err := app.db.QueryRow("SELECT EXISTS(SELECT 1 FROM pages WHERE slug = ? AND id != ?)", page.Slug, page.ID).Scan(&taken)
+	if err != nil || !taken {
+		return "", err
+	}
+	return "Another page already uses the slug " + page.Slug, nil
+}
+
+// renderPageForm shows the page editor, merging in the page being edited, its
+// publish time, and any error from saving it.
+func (app *App) renderPageForm(w http.ResponseWriter, r *http.Request, extra map[string]any) {
+	data := map[string]any{
+		"Page":      Page{},
+		"CSRFToken": app.csrfToken(w, r),
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	err := app.templates["admin_page_form.html"].ExecuteTemplate(w, "admin_base", data)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+}
+
 func (app *App) handleDeletePage(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -384,8 +764,7 @@ func (app *App) handleDeletePage(w http.ResponseWriter, r *http.Request) {
 	idStr := r.FormValue("id")
 	id, _ := strconv.Atoi(idStr)
 
-	_, err := app.db.Exec("DELETE FROM pages WHERE id = ?", id)
-	if err != nil {
+	if err := app.deleteContent("page", id); err != nil {
 		app.httpError(w, err, http.StatusInternalServerError)
 		return
 	}
@@ -393,28 +772,62 @@ func (app *App) handleDeletePage(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/admin/pages", http.StatusSeeOther)
 }
 
-func (app *App) updatePostTags(postID int, tagsStr string) {
-	app.db.Exec("DELETE FROM post_tags WHERE post_id = ?", postID)
+// deleteContent removes a post or page and the record of the media it used.
+// Tags go with posts through the foreign key. The revision history stays, so
+// it can be restored until it's purged.
+func (app *App) deleteContent(contentType string, id int) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	if tagsStr == "" {
-		return
+	if _, err := tx.Exec("DELETE FROM "+contentType+"s WHERE id = ?", id); err != nil {
+		return err
 	}
+	if err := updateMediaUsage(tx, contentType, id, ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	tags := strings.Split(tagsStr, ",")
-	for _, tag := range tags {
+// updatePostTags replaces a post's tags with those in the comma separated
+// tagsStr, creating any that don't exist yet.
+func updatePostTags(tx *sql.Tx, postID int, tagsStr string) error {
+	if _, err := tx.Exec("DELETE FROM post_tags WHERE post_id = ?", postID); err != nil {
+		return err
+	}
+
+	for _, tag := range strings.Split(tagsStr, ",") {
 		tag = strings.TrimSpace(tag)
-		if tag == "" {
+		if tagSlug(tag) == "" {
 			continue
 		}
 
-		var tagID int
-		err := app.db.QueryRow("SELECT id FROM tags WHERE name = ?", tag).Scan(&tagID)
-		if err == sql.ErrNoRows {
-			result, _ := app.db.Exec("INSERT INTO tags (name) VALUES (?)", tag)
-			id, _ := result.LastInsertId()
-			tagID = int(id)
+		// "Go" and "go" are the same tag, named however it was first written
+		existing, err := findTag(tx, tag, 0)
+		if err != nil {
+			return err
+		}
+		tagID := int64(existing.ID)
+		if tagID == 0 {
+			var slug string
+			var result sql.Result
+			slug, err = newTagSlug(tx, tag, 0)
+			if err == nil {
+				result, err = tx.Exec("INSERT INTO tags (name, slug) VALUES (?, ?)", tag, slug)
+			}
+			if err == nil {
+				tagID, err = result.LastInsertId()
+			}
+		}
+		if err != nil {
+			return err
 		}
 
-		app.db.Exec("INSERT INTO post_tags (post_id, tag_id) VALUES (?, ?)", postID, tagID)
+		if _, err := tx.Exec("INSERT OR IGNORE INTO post_tags (post_id, tag_id) VALUES (?, ?)", postID, tagID); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestSlugProblem(t *testing.T) {
+	tests := []struct {
+		slug string
+		ok   bool
+	}{
+		{"hello-world", true},
+		{"2024", true},
+		{"über_café.html", true},
+		{"...", true},
+		{"", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"a b", false},
+		{"a\tb", false},
+		{"what?", false},
+		{"#top", false},
+		{".", false},
+		{"..", false},
+	}
+	for _, test := range tests {
+		problem := slugProblem(test.slug)
+		if ok := problem == ""; ok != test.ok {
+			t.Errorf("slugProblem(%q) = %q, want ok = %t", test.slug, problem, test.ok)
+		}
+	}
+}
+
+func TestPublishAtProblem(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) sql.NullTime { return sql.NullTime{Time: now.Add(d), Valid: true} }
+
+	tests := []struct {
+		name      string
+		published bool
+		publishAt sql.NullTime
+		ok        bool
+	}{
+		{"draft", false, sql.NullTime{}, true},
+		{"scheduled", false, at(time.Hour), true},
+		{"draft this minute", false, sql.NullTime{Time: now.Truncate(time.Minute), Valid: true}, true},
+		{"draft in the past", false, at(-time.Hour), false},
+		{"published now", true, sql.NullTime{}, true},
+		{"published with a past time", true, at(-time.Hour), true},
+	}
+	for _, test := range tests {
+		problem := publishAtProblem(test.published, test.publishAt)
+		if ok := problem == ""; ok != test.ok {
+			t.Errorf("%s: got %q, want ok = %t", test.name, problem, test.ok)
+		}
+	}
+}
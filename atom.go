@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+type AtomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Updated  string      `xml:"updated"`
+	Links    []AtomLink  `xml:"link"`
+	Author   AtomPerson  `xml:"author"`
+	Entries  []AtomEntry `xml:"entry"`
+}
+
+type AtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type AtomPerson struct {
+	Name string `xml:"name"`
+}
+
+type AtomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Link       AtomLink       `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Categories []AtomCategory `xml:"category"`
+	Summary    *AtomContent   `xml:"summary,omitempty"`
+	Content    *AtomContent   `xml:"content,omitempty"`
+}
+
+type AtomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type AtomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+func (app *App) generateAtomFeed(postType, tag, baseURL, title, description string) (*AtomFeed, error) {
+	entries, err := app.feedEntries(postType, tag, baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	selfURL := baseURL + feedPath(postType, tag) + ".atom"
+	feed := &AtomFeed{
+		Title:    title,
+		Subtitle: description,
+		ID:       selfURL,
+		Links: []AtomLink{
+			{Href: selfURL, Rel: "self", Type: "application/atom+xml"},
+			{Href: baseURL, Rel: "alternate", Type: "text/html"},
+		},
+		Author: AtomPerson{Name: "Alec Stewart"},
+	}
+
+	var updated time.Time
+	for _, e := range entries {
+		if e.UpdatedAt.After(updated) {
+			updated = e.UpdatedAt
+		}
+
+		entry := AtomEntry{
+			Title:     e.Title,
+			ID:        e.URL,
+			Link:      AtomLink{Href: e.URL, Rel: "alternate", Type: "text/html"},
+			Published: e.CreatedAt.Format(time.RFC3339),
+			Updated:   e.UpdatedAt.Format(time.RFC3339),
+		}
+		if e.Partial {
+			entry.Summary = &AtomContent{Type: "html", Body: e.HTML}
+		} else {
+			entry.Content = &AtomContent{Type: "html", Body: e.HTML}
+		}
+		for _, tag := range e.Tags {
+			entry.Categories = append(entry.Categories, AtomCategory{Term: tag})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	feed.Updated = updated.Format(time.RFC3339)
+
+	return feed, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var redirectStub = template.Must(template.New("redirect").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta http-equiv="refresh" content="0; url={{.}}">
+    <link rel="canonical" href="{{.}}">
+    <title>Moved</title>
+</head>
+<body>
+    <p>This page has moved to <a href="{{.}}">{{.}}</a>.</p>
+</body>
+</html>
+`))
+
+func (app *App) runBuildCommand(args []string) error {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	out := flags.String("out", "dist", "directory to write the site to")
+	base := flags.String("base-url", "", "public URL of the site (default $BASE_URL)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.New(usage)
+	}
+
+	if *base != "" {
+		baseURL = strings.TrimSuffix(*base, "/")
+	}
+	return app.buildSite(*out)
+}
+
+// buildSite renders every published URL into dir by running it through the
+// same handlers the server uses, so the output can be served as plain files.
+func (app *App) buildSite(dir string) error {
+	site, err := url.Parse(baseURL)
+	if err != nil || site.Host == "" {
+		return errors.New("set BASE_URL or pass --base-url so feeds and the sitemap get absolute URLs")
+	}
+
+	paths, err := app.sitePaths()
+	if err != nil {
+		return err
+	}
+
+	handler := app.routes()
+	written := map[string]bool{}
+
+	for _, path := range paths {
+		req := httptest.NewRequest("GET", (&url.URL{Path: path}).EscapedPath(), nil)
+		req.Host = site.Host
+		if site.Scheme == "https" {
+			req.TLS = &tls.ConnectionState{}
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		switch rec.Code {
+		case http.StatusOK:
+		case http.StatusNotFound:
+			// e.g. /now before anything is tagged "now"
+			log.Printf("Skipping %s: not found", path)
+			continue
+		default:
+			return fmt.Errorf("rendering %s: %d %s", path, rec.Code, http.StatusText(rec.Code))
+		}
+
+		file, ok := outputFile(dir, path)
+		if !ok {
+			log.Printf("Skipping %s: not a safe file name", path)
+			continue
+		}
+		if err := writeBuildFile(file, rec.Body.Bytes()); err != nil {
+			return err
+		}
+		written[file] = true
+	}
+
+	if err := copyStatic(dir); err != nil {
+		return err
+	}
+	if local, ok := app.media.(*LocalStore); ok {
+		if err := copyMedia(dir, local); err != nil {
+			return err
+		}
+	}
+
+	stubs, err := app.writeRedirectStubs(dir, written)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Built %d pages and %d redirects into %s\n", len(written), stubs, dir)
+	return nil
+}
+
+// sitePaths lists every public URL that can be rendered ahead of time.
+// Search needs a query, so it's left out.
+func (app *App) sitePaths() ([]string, error) {
+	paths := []string{"/", "/tags", "/now", "/sitemap.xml", "/robots.txt"}
+	for _, postType := range append([]string{""}, postTypes...) {
+		for _, ext := range []string{".xml", ".atom", ".json"} {
+			paths = append(paths, feedPath(postType, "")+ext)
+		}
+	}
+
+	// Each row is a list or a single post or page, with how many posts it
+	// holds so every page of the list is included
+	queries := []string{
+		`SELECT '/' || post_type || 's', COUNT(*) FROM posts WHERE published = 1 GROUP BY post_type`,
+		`SELECT '/' || post_type || 's/' || slug, 1 FROM posts WHERE published = 1`,
+		`SELECT '/' || slug, 1 FROM pages WHERE published = 1`,
+		`SELECT '/tags/' || t.slug, COUNT(*)
+		 FROM tags t
+		 JOIN post_tags pt ON pt.tag_id = t.id
+		 JOIN posts p ON p.id = pt.post_id
+		 WHERE p.published = 1
+		 GROUP BY t.id`,
+	}
+	for _, query := range queries {
+		rows, err := app.db.Query(query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var path string
+			var count int
+			if err := rows.Scan(&path, &count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			paths = append(paths, path)
+			for n := 2; (n-1)*postsPerPage < count; n++ {
+				paths = append(paths, listPageURL(path, n))
+			}
+			if tag, ok := strings.CutPrefix(path, "/tags/"); ok {
+				for _, ext := range []string{".xml", ".atom", ".json"} {
+					paths = append(paths, feedPath("", tag)+ext)
+				}
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Empty lists still get a page
+	for _, postType := range postTypes {
+		if !slices.Contains(paths, "/"+postType+"s") {
+			paths = append(paths, "/"+postType+"s")
+		}
+	}
+
+	return paths, nil
+}
+
+// outputFile maps a URL path to a file: feeds, the sitemap and robots.txt
+// keep their names, everything else becomes a directory index so the URL is
+// unchanged. It reports false for paths that would land outside dir.
+func outputFile(dir, path string) (string, bool) {
+	rel := filepath.FromSlash(strings.TrimPrefix(path, "/"))
+	switch filepath.Ext(path) {
+	case ".xml", ".atom", ".json", ".txt":
+	default:
+		rel = filepath.Join(rel, "index.html")
+	}
+	if !filepath.IsLocal(rel) {
+		return "", false
+	}
+	return filepath.Join(dir, rel), true
+}
+
+func writeBuildFile(file string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+func copyStatic(dir string) error {
+	return fs.WalkDir(staticFS, "static", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := staticFS.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return writeBuildFile(filepath.Join(dir, filepath.FromSlash(path)), data)
+	})
+}
+
+// copyMedia copies uploads from the local media store, which the server
+// would otherwise serve under /media/.
+func copyMedia(dir string, local *LocalStore) error {
+	files, err := local.List()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(local.dir, filepath.FromSlash(file.Path)))
+		if err != nil {
+			return err
+		}
+		if err := writeBuildFile(filepath.Join(dir, "media", filepath.FromSlash(file.Path)), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRedirectStubs turns exact redirects into pages that forward with a
+// meta refresh, since a static host can't send a 301 on its own. Wildcards
+// and paths that now hold real content are skipped.
+func (app *App) writeRedirectStubs(dir string, written map[string]bool) (int, error) {
+	rows, err := app.db.Query("SELECT source, target FROM redirects WHERE source NOT LIKE '%*'")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var source, target string
+		if err := rows.Scan(&source, &target); err != nil {
+			return count, err
+		}
+
+		file, ok := outputFile(dir, source)
+		if !ok || written[file] {
+			continue
+		}
+
+		var b strings.Builder
+		if err := redirectStub.Execute(&b, target); err != nil {
+			return count, err
+		}
+		if err := writeBuildFile(file, []byte(b.String())); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
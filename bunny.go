@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+type BunnyFile struct {
+	Guid            string `json:"Guid"`
+	StorageZoneName string `json:"StorageZoneName"`
+	Path            string `json:"Path"`
+	ObjectName      string `json:"ObjectName"`
+	Length          int64  `json:"Length"`
+	LastChanged     string `json:"LastChanged"`
+	IsDirectory     bool   `json:"IsDirectory"`
+	ServerId        int    `json:"ServerId"`
+	UserId          string `json:"UserId"`
+	DateCreated     string `json:"DateCreated"`
+	StorageZoneId   int64  `json:"StorageZoneId"`
+}
+
+type BunnyConfig struct {
+	StorageZone   string
+	AccessKey     string
+	StorageRegion string
+	PullZoneURL   string
+}
+
+// BunnyClient is the MediaStore for a Bunny.net storage zone, with files
+// served from its pull zone.
+type BunnyClient struct {
+	config BunnyConfig
+	client *http.Client
+}
+
+// NewBunnyClient creates a new Bunny.net storage client
+func NewBunnyClient() *BunnyClient {
+	return &BunnyClient{
+		config: BunnyConfig{
+			StorageZone:   os.Getenv("STORAGE_ZONE"),
+			AccessKey:     os.Getenv("ACCESS_KEY"),
+			StorageRegion: os.Getenv("REGION"),
+			PullZoneURL:   os.Getenv("PULL_ZONE_URL"),
+		},
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// storageURL is the storage API endpoint for a path in the zone.
+// Format: https://{region}.storage.bunnycdn.com/{storageZoneName}/{path}
+func (bc *BunnyClient) storageURL(p string) string {
+	return fmt.Sprintf("https://%s.storage.bunnycdn.com/%s/%s", bc.config.StorageRegion, bc.config.StorageZone, p)
+}
+
+// Put uploads a file to the storage zone. Bunny stores whatever it's sent, so
+// the content type isn't passed on.
+func (bc *BunnyClient) Put(name, contentType string, file io.Reader) error {
+	// Read the data into a buffer so we can calculate checksum and upload
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, file); err != nil {
+		return fmt.Errorf("failed to read file data: %w", err)
+	}
+	data := buf.Bytes()
+
+	// Calculate SHA256 checksum for integrity verification
+	hash := sha256.Sum256(data)
+	checksum := hex.EncodeToString(hash[:])
+
+	req, err := http.NewRequest("PUT", bc.storageURL(name), bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Set required headers
+	req.Header.Set("AccessKey", bc.config.AccessKey)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Checksum", checksum)
+
+	resp, err := bc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload to BunnyCDN: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check for successful upload (201 Created)
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("upload failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// List returns every file in the storage zone.
+func (bc *BunnyClient) List() ([]MediaFile, error) {
+	all, err := bc.GetAllFilesRecursively("")
+	if err != nil {
+		return nil, err
+	}
+
+	// Paths come back as /{storageZoneName}/{dir}/
+	prefix := "/" + bc.config.StorageZone + "/"
+
+	var files []MediaFile
+	for _, file := range all {
+		if file.IsDirectory {
+			continue
+		}
+		modified, _ := time.Parse("2006-01-02T15:04:05.999", file.LastChanged)
+		files = append(files, MediaFile{
+			Path:     strings.TrimPrefix(file.Path, prefix) + file.ObjectName,
+			Size:     file.Length,
+			Modified: modified,
+		})
+	}
+	return files, nil
+}
+
+// ListFiles retrieves files from a specific path in the storage zone
+func (bc *BunnyClient) ListFiles(folderPath string) ([]BunnyFile, error) {
+	// Create the request
+	req, err := http.NewRequest("GET", bc.storageURL(folderPath), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Add the AccessKey header
+	req.Header.Add("AccessKey", bc.config.AccessKey)
+	req.Header.Add("Accept", "application/json")
+
+	// Execute the request
+	resp, err := bc.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response status
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	// Parse the response
+	var files []BunnyFile
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return files, nil
+}
+
+// GetAllFilesRecursively fetches all files recursively from the storage zone
+func (bc *BunnyClient) GetAllFilesRecursively(startPath string) ([]BunnyFile, error) {
+	var allFiles []BunnyFile
+
+	// Helper function for recursive traversal
+	var traverse func(currentPath string) error
+	traverse = func(currentPath string) error {
+		files, err := bc.ListFiles(currentPath)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			// Add the file to our collection
+			allFiles = append(allFiles, file)
+
+			// If it's a directory, recursively fetch its contents
+			if file.IsDirectory {
+				// Construct the subdirectory path
+				subPath := path.Join(currentPath, file.ObjectName) + "/"
+				if err := traverse(subPath); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	// Start the recursive traversal
+	if err := traverse(startPath); err != nil {
+		return nil, err
+	}
+
+	return allFiles, nil
+}
+
+// Delete removes a file from the storage zone
+func (bc *BunnyClient) Delete(name string) error {
+	// Create the request
+	req, err := http.NewRequest("DELETE", bc.storageURL(name), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Add the AccessKey header
+	req.Header.Add("AccessKey", bc.config.AccessKey)
+	req.Header.Add("Accept", "application/json")
+
+	// Execute the request
+	resp, err := bc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check response status
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+// URL is where the file is served from the pull zone.
+func (bc *BunnyClient) URL(name string) string {
+	return fmt.Sprintf("%s/%s", bc.config.PullZoneURL, name)
+}
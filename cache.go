@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// startedAt is part of every validator so a deploy with new templates
+// invalidates what clients have cached.
+var startedAt = time.Now().UTC().Truncate(time.Second)
+
+// contentVersion runs a query returning MAX(updated_at) and COUNT(*) for the
+// rows a response is built from. The count catches deletes, which leave the
+// newest updated_at alone.
+func (app *App) contentVersion(query string, args ...any) (time.Time, int, error) {
+	var latest sql.NullString
+	var count int
+	if err := app.db.QueryRow(query, args...).Scan(&latest, &count); err != nil {
+		return time.Time{}, 0, err
+	}
+	if !latest.Valid {
+		return time.Time{}, count, nil
+	}
+	modified, err := time.ParseInLocation(sqlTimeLayout, latest.String, time.UTC)
+	return modified, count, err
+}
+
+// publishedPostsVersion covers published posts, optionally only those of the
+// given types.
+func (app *App) publishedPostsVersion(types ...string) (time.Time, int, error) {
+	query := "SELECT MAX(updated_at), COUNT(*) FROM posts WHERE published = 1"
+	args := make([]any, len(types))
+	if len(types) > 0 {
+		query += " AND post_type IN (?" + strings.Repeat(", ?", len(types)-1) + ")"
+		for i, postType := range types {
+			args[i] = postType
+		}
+	}
+	return app.contentVersion(query, args...)
+}
+
+// notModified sets ETag and Last-Modified for a response built from content
+// last changed at modified, and answers with 304 Not Modified when the
+// request's validators still match. Handlers should return when it reports
+// true. Responses built from more than one table pass a count for each.
+// Signed in visitors see admin links, so they get their own ETag.
+func (app *App) notModified(w http.ResponseWriter, r *http.Request, modified time.Time, counts ...int) bool {
+	modified = modified.UTC().Truncate(time.Second)
+	if modified.Before(startedAt) {
+		modified = startedAt
+	}
+
+	sum := sha256.Sum256(fmt.Appendf(nil, "%d:%v:%d:%t", modified.Unix(), counts, startedAt.Unix(), app.isAuthenticated(r)))
+	etag := `W/"` + hex.EncodeToString(sum[:8]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	w.Header().Add("Vary", "Cookie")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	// If-None-Match wins when both are sent
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if !etagMatches(match, etag) {
+			return false
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err != nil || modified.After(since) {
+		return false
+	}
+
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches does the weak comparison If-None-Match calls for.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
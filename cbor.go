@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// cborDecoder reads the subset of CBOR (RFC 8949) that WebAuthn uses:
+// definite-length integers, byte and text strings, arrays, maps, tags and
+// simple values. Maps decode to map[any]any keyed by int64 or string.
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+// decodeCBOR decodes the first item in data and returns it along with the
+// number of bytes it took up.
+func decodeCBOR(data []byte) (any, int, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.decode(0)
+	return v, d.pos, err
+}
+
+func (d *cborDecoder) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, errCBORTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// argument reads the length/value that follows an initial byte.
+func (d *cborDecoder) argument(info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info == 24:
+		b, err := d.next(1)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(b[0]), nil
+	case info == 25:
+		b, err := d.next(2)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case info == 26:
+		b, err := d.next(4)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	case info == 27:
+		b, err := d.next(8)
+		if err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(b), nil
+	}
+	return 0, fmt.Errorf("cbor: unsupported additional info %d", info)
+}
+
+func (d *cborDecoder) decode(depth int) (any, error) {
+	if depth > 16 {
+		return nil, errors.New("cbor: nested too deeply")
+	}
+
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+
+	if major == 7 {
+		return d.decodeSimple(info)
+	}
+
+	arg, err := d.argument(info)
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("cbor: integer overflow")
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(arg), nil
+	case 2:
+		if arg > uint64(len(d.data)) {
+			return nil, errCBORTruncated
+		}
+		return d.next(int(arg))
+	case 3:
+		if arg > uint64(len(d.data)) {
+			return nil, errCBORTruncated
+		}
+		s, err := d.next(int(arg))
+		return string(s), err
+	case 4:
+		if arg > uint64(len(d.data)) {
+			return nil, errCBORTruncated
+		}
+		arr := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case 5:
+		if arg > uint64(len(d.data)) {
+			return nil, errCBORTruncated
+		}
+		m := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, errors.New("cbor: unsupported map key type")
+			}
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = v
+		}
+		return m, nil
+	case 6:
+		// Tags carry no meaning we need, so just return the tagged item
+		return d.decode(depth + 1)
+	}
+
+	return nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+func (d *cborDecoder) decodeSimple(info byte) (any, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 26:
+		b, err := d.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 27:
+		b, err := d.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	}
+	return nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+}
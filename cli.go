@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+const usage = `Usage: website [command]
+
+Commands:
+  serve                        Run the web server (default)
+  user add <username> [role]   Create a user; role is owner, editor or author (default owner)
+  user passwd <username>       Set a user's password and sign them out everywhere
+  user list                    List users
+  user delete <username>       Delete a user
+  user hash                    Print a bcrypt hash for ADMIN_PASSWORD_HASH
+  export <dir>                 Write posts and pages to <dir> as Markdown with front matter
+  import [--author name] <dir>
+                               Create or update posts and pages from Markdown files in <dir>;
+                               --author is who writes posts whose files don't say
+  build [--out dir] [--base-url url]
+                               Render the public site to static files (default dist)
+
+Passwords are prompted for on a terminal, otherwise read from the first line of stdin.
+`
+
+func (app *App) runCommand(args []string) error {
+	switch args[0] {
+	case "user":
+		return app.runUserCommand(args[1:])
+	case "export":
+		if len(args) != 2 {
+			return errors.New(usage)
+		}
+		return app.exportContent(args[1])
+	case "import":
+		return app.runImportCommand(args[1:])
+	case "build":
+		return app.runBuildCommand(args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q\n\n%s", args[0], usage)
+}
+
+func (app *App) runUserCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	switch {
+	case args[0] == "add" && (len(args) == 2 || len(args) == 3):
+		role := roleOwner
+		if len(args) == 3 {
+			role = args[2]
+		}
+		return app.cliAddUser(args[1], role)
+	case args[0] == "passwd" && len(args) == 2:
+		return app.cliSetPassword(args[1])
+	case args[0] == "list" && len(args) == 1:
+		return app.cliListUsers()
+	case args[0] == "delete" && len(args) == 2:
+		return app.cliDeleteUser(args[1])
+	case args[0] == "hash" && len(args) == 1:
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(hash))
+		return nil
+	}
+
+	return errors.New(usage)
+}
+
+func (app *App) insertUser(username, passwordHash, role string) error {
+	_, err := app.db.Exec("INSERT INTO users (username, password, role) VALUES (?, ?, ?)", username, passwordHash, role)
+	return err
+}
+
+func (app *App) cliAddUser(username, role string) error {
+	if !validRole(role) {
+		return fmt.Errorf("unknown role %q", role)
+	}
+
+	var exists bool
+	if err := app.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("user %s already exists", username)
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	if err := app.insertUser(username, string(hash), role); err != nil {
+		return err
+	}
+	fmt.Printf("User %s created (%s)\n", username, role)
+	return nil
+}
+
+func (app *App) cliSetPassword(username string) error {
+	var id int
+	err := app.db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&id)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no user named %s", username)
+	}
+	if err != nil {
+		return err
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	if _, err := app.db.Exec("UPDATE users SET password = ? WHERE id = ?", string(hash), id); err != nil {
+		return err
+	}
+	if _, err := app.db.Exec("DELETE FROM sessions WHERE user_id = ?", id); err != nil {
+		return err
+	}
+	fmt.Printf("Password for %s updated\n", username)
+	return nil
+}
+
+func (app *App) cliListUsers() error {
+	rows, err := app.db.Query("SELECT username, role, disabled, totp_enabled, created_at FROM users ORDER BY username")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "USERNAME\tROLE\tSTATUS\t2FA\tCREATED")
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.Username, &u.Role, &u.Disabled, &u.TOTPEnabled, &u.CreatedAt); err != nil {
+			return err
+		}
+		status := "active"
+		if u.Disabled {
+			status = "disabled"
+		}
+		twoFactor := "off"
+		if u.TOTPEnabled {
+			twoFactor = "on"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", u.Username, u.Role, status, twoFactor, u.CreatedAt.Format("2006-01-02"))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (app *App) cliDeleteUser(username string) error {
+	var id int
+	var role string
+	err := app.db.QueryRow("SELECT id, role FROM users WHERE username = ?", username).Scan(&id, &role)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no user named %s", username)
+	}
+	if err != nil {
+		return err
+	}
+
+	if role == roleOwner {
+		owners, err := app.activeOwnersExcept(id)
+		if err != nil {
+			return err
+		}
+		if owners == 0 {
+			return errors.New("the site needs at least one owner")
+		}
+	}
+
+	if _, err := app.db.Exec("DELETE FROM users WHERE id = ?", id); err != nil {
+		return err
+	}
+
+	// Their posts are left without an author, and so without raw HTML
+	if _, err := app.renderTableHTML("posts", "p.author_id IS NULL"); err != nil {
+		return err
+	}
+	fmt.Printf("User %s deleted\n", username)
+	return nil
+}
+
+// readPassword prompts twice on a terminal. Without one it reads a single
+// line from stdin so commands can be scripted.
+func readPassword() (string, error) {
+	var password, confirm string
+
+	if term.IsTerminal(int(syscall.Stdin)) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		b, err := term.ReadPassword(int(syscall.Stdin))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		password = string(b)
+
+		fmt.Fprint(os.Stderr, "Confirm password: ")
+		b, err = term.ReadPassword(int(syscall.Stdin))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		confirm = string(b)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("no password on stdin")
+		}
+		password = strings.TrimRight(line, "\r\n")
+		confirm = password
+	}
+
+	if err := validatePassword(password, confirm); err != nil {
+		return "", err
+	}
+	return password, nil
+}
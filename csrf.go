@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfFormField  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// csrfToken returns the token that forms rendered for this request must send
+// back. Signed-in users get the token stored with their session, so it
+// survives restarts and dies with the session. Anonymous visitors (i.e. the
+// login form) get a double-submit cookie instead, signed so that a cookie
+// planted from elsewhere (a sibling subdomain, say) isn't accepted.
+func (app *App) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if s := app.currentSession(r); s != nil {
+		return s.CSRFToken
+	}
+
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && app.validCSRFCookie(cookie.Value) {
+		return cookie.Value
+	}
+
+	token := app.signCSRFToken(generateToken())
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// validateCSRF checks the token from the csrf_token form field or the
+// X-CSRF-Token header against the one issued by csrfToken.
+func (app *App) validateCSRF(r *http.Request) bool {
+	var expected string
+	if s := app.currentSession(r); s != nil {
+		expected = s.CSRFToken
+	} else if cookie, err := r.Cookie(csrfCookieName); err == nil && app.validCSRFCookie(cookie.Value) {
+		expected = cookie.Value
+	}
+
+	// Parse the form either way, so handlers reading r.Form see it
+	r.ParseForm()
+	token := r.Header.Get(csrfHeaderName)
+	if token == "" {
+		token = r.FormValue(csrfFormField)
+	}
+
+	if expected == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+func (app *App) signCSRFToken(token string) string {
+	mac := hmac.New(sha256.New, app.csrfKey)
+	mac.Write([]byte(token))
+	return token + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRFCookie reports whether value was signed by signCSRFToken.
+func (app *App) validCSRFCookie(value string) bool {
+	token, _, ok := strings.Cut(value, ".")
+	return ok && hmac.Equal([]byte(value), []byte(app.signCSRFToken(token)))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateCSRF(t *testing.T) {
+	app := newTestApp(t)
+	app.csrfKey = []byte("test key")
+
+	// A visitor's first page sets the signed cookie its forms send back
+	rec := httptest.NewRecorder()
+	token := app.csrfToken(rec, httptest.NewRequest("GET", "/login", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != token {
+		t.Fatalf("csrfToken set %v, returned %q", cookies, token)
+	}
+
+	other := &App{csrfKey: []byte("other key")}
+	forged := other.signCSRFToken("planted")
+
+	tests := []struct {
+		name   string
+		cookie string
+		header string
+		field  string
+		ok     bool
+	}{
+		{"form field", token, "", token, true},
+		{"header", token, token, "", true},
+		{"no cookie", "", "", token, false},
+		{"no token", token, "", "", false},
+		{"wrong token", token, "", forged, false},
+		{"unsigned cookie", "planted", "", "planted", false},
+		{"signed with another key", forged, "", forged, false},
+	}
+	for _, tt := range tests {
+		form := url.Values{"tag": {"a", "b"}}
+		if tt.field != "" {
+			form.Set(csrfFormField, tt.field)
+		}
+		r := httptest.NewRequest("POST", "/admin/tags/merge", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: tt.cookie})
+		}
+		if tt.header != "" {
+			r.Header.Set(csrfHeaderName, tt.header)
+		}
+
+		if got := app.validateCSRF(r); got != tt.ok {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.ok)
+		}
+		// Handlers like tag merging read r.Form afterwards
+		if len(r.Form["tag"]) != 2 {
+			t.Errorf("%s: form not parsed, r.Form is %v", tt.name, r.Form)
+		}
+	}
+
+	// A forged cookie gets replaced rather than handed back
+	r := httptest.NewRequest("GET", "/login", nil)
+	r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: forged})
+	if got := app.csrfToken(httptest.NewRecorder(), r); got == forged || !app.validCSRFCookie(got) {
+		t.Errorf("csrfToken kept the forged cookie")
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
 	"embed"
 	"fmt"
 	"io/fs"
 	"log"
+	"os"
+	"sort"
 	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/term"
@@ -60,30 +64,64 @@ func (app *App) runMigrations() error {
 		return err
 	}
 
+	// Apply in numeric order; ReadDir sorts by name, which puts 10_ before 2_
+	type migration struct {
+		version int
+		name    string
+	}
+	var migrations []migration
 	for _, f := range files {
 		var version int
 		_, err = fmt.Sscanf(f.Name(), "%d_", &version)
 		if err != nil {
 			return err
 		}
+		migrations = append(migrations, migration{version, f.Name()})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
 
-		if version > latestVersion {
-			fileData, _ := fs.ReadFile(migrationFiles, "migrations/"+f.Name())
+	for _, m := range migrations {
+		if m.version > latestVersion {
+			fileData, _ := fs.ReadFile(migrationFiles, "migrations/"+m.name)
 			_, err := app.db.Exec(string(fileData))
 			if err != nil {
-				return fmt.Errorf("Failed to apply migration %s: %v", f.Name(), err)
+				return fmt.Errorf("Failed to apply migration %s: %v", m.name, err)
 			}
-			_, err = app.db.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, version)
+			_, err = app.db.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, m.version)
 			if err != nil {
-				return fmt.Errorf("Failed to record migration version %d: %v", version, err)
+				return fmt.Errorf("Failed to record migration version %d: %v", m.version, err)
 			}
-			log.Printf("Applied migration %s\n", f.Name())
+			log.Printf("Applied migration %s\n", m.name)
 		}
 	}
 
 	return nil
 }
 
+// serverSecret returns the random key stored under name, making it the first
+// time it's asked for.
+func (app *App) serverSecret(name string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := app.db.Exec("INSERT OR IGNORE INTO server_secrets (name, value) VALUES (?, ?)", name, key); err != nil {
+		return nil, err
+	}
+	err := app.db.QueryRow("SELECT value FROM server_secrets WHERE name = ?", name).Scan(&key)
+	return key, err
+}
+
+const sqlTimeLayout = "2006-01-02 15:04:05"
+
+// sqlTime formats t the same way SQLite's CURRENT_TIMESTAMP does so the two
+// can be compared directly in queries.
+func sqlTime(t time.Time) string {
+	return t.UTC().Format(sqlTimeLayout)
+}
+
 func (app *App) createInitialUser() error {
 	var count int
 	err := app.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
@@ -91,32 +129,52 @@ func (app *App) createInitialUser() error {
 		return err
 	}
 
-	if count == 0 {
-		var username string
-		log.Print("No users found. Prompting to create a user\n")
-
-		fmt.Print("Username: ")
-		fmt.Scanln(&username)
+	if count > 0 {
+		return nil
+	}
 
-		fmt.Print("Password: ")
-		passwordBytes, err := term.ReadPassword(int(syscall.Stdin))
-		if err != nil {
-			fmt.Printf("\nError reading password: %v\n", err)
-			return err
+	// Provision from the environment so a fresh deploy can start without a
+	// terminal, e.g. in a container or under systemd
+	username := os.Getenv("ADMIN_USER")
+	hash := os.Getenv("ADMIN_PASSWORD_HASH")
+	if username != "" && hash != "" {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("ADMIN_PASSWORD_HASH is not a bcrypt hash: %w", err)
 		}
-		fmt.Println()
-
-		hashedPassword, err := bcrypt.GenerateFromPassword(passwordBytes, bcrypt.DefaultCost)
-		if err != nil {
+		if err := app.insertUser(username, hash, roleOwner); err != nil {
 			return err
 		}
+		log.Printf("User %s created from ADMIN_USER", username)
+		return nil
+	}
 
-		_, err = app.db.Exec("INSERT INTO users (username, password) VALUES (?, ?)", username, string(hashedPassword))
-		if err != nil {
-			return err
-		}
-		log.Printf("User %s created", username)
+	if !term.IsTerminal(int(syscall.Stdin)) {
+		log.Print("No users found. Create one with `website user add <username>` or set ADMIN_USER and ADMIN_PASSWORD_HASH")
+		return nil
+	}
+
+	log.Print("No users found. Prompting to create a user\n")
+
+	fmt.Print("Username: ")
+	fmt.Scanln(&username)
+
+	fmt.Print("Password: ")
+	passwordBytes, err := term.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		fmt.Printf("\nError reading password: %v\n", err)
+		return err
+	}
+	fmt.Println()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword(passwordBytes, bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	if err := app.insertUser(username, string(hashedPassword), roleOwner); err != nil {
+		return err
 	}
+	log.Printf("User %s created", username)
 
 	return nil
 }
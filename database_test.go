@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// newTestApp is an App with an in-memory database and every migration
+// applied.
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:?_pragma=foreign_keys(ON)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: would get its own database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	app := &App{db: db}
+	_, err = db.Exec(`
+		CREATE TABLE schema_migrations (
+			version INTEGER PRIMARY KEY,
+			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.runMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+func TestRunMigrationsTwice(t *testing.T) {
+	app := newTestApp(t)
+	if err := app.runMigrations(); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+
+	var count int
+	if err := app.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	files, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(files) {
+		t.Errorf("%d migrations recorded, want %d", count, len(files))
+	}
+}
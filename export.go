@@ -0,0 +1,475 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// exportContent writes every post to <dir>/posts/<slug>.md and every page to
+// <dir>/pages/<slug>.md, drafts included. Existing files are overwritten.
+func (app *App) exportContent(dir string) error {
+	for _, sub := range []string{"posts", "pages"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+
+	rows, err := app.db.Query(`
+		SELECT p.id, p.title, p.slug, p.content, p.summary, p.post_type, p.published, p.publish_at, p.created_at, p.updated_at, COALESCE(u.username, '')
+		FROM posts p
+		LEFT JOIN users u ON u.id = p.author_id
+		ORDER BY p.id
+	`)
+	if err != nil {
+		return err
+	}
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		if err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.Content, &p.Summary, &p.PostType, &p.Published, &p.PublishAt, &p.CreatedAt, &p.UpdatedAt, &p.Author); err != nil {
+			rows.Close()
+			return err
+		}
+		posts = append(posts, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range posts {
+		fields := []frontMatterField{
+			{"title", p.Title},
+			{"slug", p.Slug},
+			{"post_type", p.PostType},
+			{"summary", p.Summary},
+			{"tags", tagNames(app.getPostTags(p.ID))},
+			{"published", p.Published},
+			{"publish_at", p.PublishAt.Time},
+			{"author", p.Author},
+			{"created_at", p.CreatedAt},
+			{"updated_at", p.UpdatedAt},
+		}
+		path, err := exportPath(dir, "posts", p.Slug)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, formatFrontMatter(fields, p.Content), 0644); err != nil {
+			return err
+		}
+	}
+
+	rows, err = app.db.Query(`
+		SELECT id, title, slug, content, published, publish_at, created_at, updated_at
+		FROM pages
+		ORDER BY id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	pageCount := 0
+	for rows.Next() {
+		var p Page
+		if err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.Content, &p.Published, &p.PublishAt, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			return err
+		}
+		fields := []frontMatterField{
+			{"title", p.Title},
+			{"slug", p.Slug},
+			{"published", p.Published},
+			{"publish_at", p.PublishAt.Time},
+			{"created_at", p.CreatedAt},
+			{"updated_at", p.UpdatedAt},
+		}
+		path, err := exportPath(dir, "pages", p.Slug)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, formatFrontMatter(fields, p.Content), 0644); err != nil {
+			return err
+		}
+		pageCount++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported %d posts and %d pages to %s\n", len(posts), pageCount, dir)
+	return nil
+}
+
+// exportPath is the file a post or page is exported to. Slugs the editor
+// wouldn't accept are refused, so nothing is written outside dir/sub.
+func exportPath(dir, sub, slug string) (string, error) {
+	name := slug + ".md"
+	if problem := slugProblem(slug); problem != "" || !filepath.IsLocal(name) || filepath.Base(name) != name {
+		return "", fmt.Errorf("can't export %s %q: it isn't a valid slug", strings.TrimSuffix(sub, "s"), slug)
+	}
+	return filepath.Join(dir, sub, name), nil
+}
+
+func (app *App) runImportCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	author := flags.String("author", "", "username to credit for new posts whose files name no author")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New(usage)
+	}
+	return app.importContent(flags.Arg(0), *author)
+}
+
+// importContent reads Markdown files from <dir>/posts and <dir>/pages (in
+// any subdirectory) and upserts them by slug. Files that match what's in the
+// database already are left alone, so running it twice changes nothing.
+// Posts whose files name no author keep the one they have, or get
+// defaultAuthor when they have none.
+func (app *App) importContent(dir, defaultAuthor string) error {
+	counts := map[string]int{}
+
+	for _, sub := range []string{"posts", "pages"} {
+		root := filepath.Join(dir, sub)
+		if _, err := os.Stat(root); os.IsNotExist(err) {
+			continue
+		}
+
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || filepath.Ext(path) != ".md" {
+				return err
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			fm, body, err := parseFrontMatter(data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+
+			slug := fm.string("slug")
+			if slug == "" {
+				slug = strings.TrimSuffix(d.Name(), ".md")
+			}
+			if problem := slugProblem(slug); problem != "" {
+				return fmt.Errorf("%s: %s (%q)", path, problem, slug)
+			}
+
+			var result string
+			if sub == "posts" {
+				result, err = app.importPost(fm, slug, body, defaultAuthor)
+			} else {
+				result, err = app.importPage(fm, slug, body)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			counts[result]++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Imported from %s: %d created, %d updated, %d unchanged\n", dir, counts["created"], counts["updated"], counts["unchanged"])
+	return nil
+}
+
+// importedTimes reads created_at and updated_at from an imported file. A
+// missing created_at keeps the database's value (or now, for new content); a
+// missing updated_at comes back zero so callers only touch it on a change.
+func importedTimes(fm frontMatter, existingCreatedAt time.Time) (time.Time, time.Time, error) {
+	created, err := fm.time("created_at")
+	if err != nil {
+		return created, created, err
+	}
+	updated, err := fm.time("updated_at")
+	if err != nil {
+		return created, updated, err
+	}
+
+	if created.IsZero() {
+		created = existingCreatedAt
+	}
+	if created.IsZero() {
+		created = time.Now()
+	}
+	return created, updated, nil
+}
+
+func importedPublishAt(fm frontMatter) (sql.NullTime, error) {
+	t, err := fm.time("publish_at")
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}, err
+}
+
+func sameTime(a, b sql.NullTime) bool {
+	if a.Valid != b.Valid {
+		return false
+	}
+	return !a.Valid || a.Time.Equal(b.Time)
+}
+
+// importAuthor looks up the user a post is credited to.
+func (app *App) importAuthor(username string) (sql.NullInt64, error) {
+	var id sql.NullInt64
+	err := app.db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&id)
+	if err == sql.ErrNoRows {
+		return id, fmt.Errorf("author %q isn't a user here; add them with \"website user add\" first", username)
+	}
+	return id, err
+}
+
+func (app *App) importPost(fm frontMatter, slug, content, defaultAuthor string) (string, error) {
+	title := fm.string("title")
+	summary := fm.string("summary")
+	postType := fm.string("post_type")
+	if !slices.Contains(postTypes, postType) {
+		return "", fmt.Errorf("post_type must be one of %s", strings.Join(postTypes, ", "))
+	}
+	published, err := fm.bool("published")
+	if err != nil {
+		return "", err
+	}
+	publishAt, err := importedPublishAt(fm)
+	if err != nil {
+		return "", err
+	}
+
+	// Tags are stored from a comma separated list, so a comma inside one tag
+	// splits it just like it would in the editor. Names that only differ in
+	// case are the same tag.
+	var tags []string
+	for _, tag := range strings.Split(strings.Join(fm.list("tags"), ","), ",") {
+		tag = strings.TrimSpace(tag)
+		if tagSlug(tag) != "" && !slices.ContainsFunc(tags, func(other string) bool { return strings.EqualFold(other, tag) }) {
+			tags = append(tags, tag)
+		}
+	}
+
+	var authorID sql.NullInt64
+	if author := fm.string("author"); author != "" {
+		if authorID, err = app.importAuthor(author); err != nil {
+			return "", err
+		}
+	}
+
+	var existing Post
+	var existingAuthor sql.NullInt64
+	err = app.db.QueryRow(`
+		SELECT id, title, content, summary, post_type, published, publish_at, created_at, updated_at, author_id
+		FROM posts
+		WHERE slug = ?
+	`, slug).Scan(&existing.ID, &existing.Title, &existing.Content, &existing.Summary, &existing.PostType, &existing.Published,
+		&existing.PublishAt, &existing.CreatedAt, &existing.UpdatedAt, &existingAuthor)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	createdAt, updatedAt, err := importedTimes(fm, existing.CreatedAt)
+	if err != nil {
+		return "", err
+	}
+
+	// A post always ends up with an author, since who wrote it decides
+	// whether its raw HTML is trusted
+	if !authorID.Valid {
+		authorID = existingAuthor
+	}
+	if !authorID.Valid && defaultAuthor != "" {
+		if authorID, err = app.importAuthor(defaultAuthor); err != nil {
+			return "", err
+		}
+	}
+	if !authorID.Valid {
+		return "", errors.New("no author: add one to the front matter or import with --author")
+	}
+
+	if existing.ID == 0 {
+		if updatedAt.IsZero() {
+			updatedAt = createdAt
+		}
+		rawHTML, err := app.rawHTMLAllowed(authorID)
+		if err != nil {
+			return "", err
+		}
+		tx, err := app.db.Begin()
+		if err != nil {
+			return "", err
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec(`
+			INSERT INTO posts (title, slug, content, content_html, summary, summary_html, post_type, published, publish_at, author_id, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, title, slug, content, string(app.markdownToHTML(content, rawHTML)), summary, app.summaryHTML(summary, content, rawHTML), postType, published, publishAtValue(publishAt), authorID, sqlTime(createdAt), sqlTime(updatedAt))
+		if err != nil {
+			return "", err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return "", err
+		}
+		if err := updatePostTags(tx, int(id), strings.Join(tags, ", ")); err != nil {
+			return "", err
+		}
+		if err := updateMediaUsage(tx, "post", int(id), content+"\n"+summary); err != nil {
+			return "", err
+		}
+		if err := saveRevision(tx, "post", int(id), 0); err != nil {
+			return "", err
+		}
+		return "created", tx.Commit()
+	}
+
+	unchanged := existing.Title == title && existing.Content == content && existing.Summary == summary && existing.PostType == postType &&
+		existing.Published == published && sameTime(existing.PublishAt, publishAt) &&
+		existing.CreatedAt.Equal(createdAt) && (updatedAt.IsZero() || existing.UpdatedAt.Equal(updatedAt)) &&
+		sameTagNames(tagNames(app.getPostTags(existing.ID)), tags) &&
+		authorID == existingAuthor
+	if unchanged {
+		return "unchanged", nil
+	}
+	if updatedAt.IsZero() {
+		updatedAt = time.Now()
+	}
+
+	rawHTML, err := app.rawHTMLAllowed(authorID)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	oldPath, err := publishedPath(tx, "post", existing.ID)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		UPDATE posts
+		SET title = ?, content = ?, content_html = ?, summary = ?, summary_html = ?, post_type = ?, published = ?, publish_at = ?, author_id = ?, created_at = ?, updated_at = ?
+		WHERE id = ?
+	`, title, content, string(app.markdownToHTML(content, rawHTML)), summary, app.summaryHTML(summary, content, rawHTML), postType, published, publishAtValue(publishAt), authorID, sqlTime(createdAt), sqlTime(updatedAt), existing.ID)
+	if err != nil {
+		return "", err
+	}
+	if err := updatePostTags(tx, existing.ID, strings.Join(tags, ", ")); err != nil {
+		return "", err
+	}
+	if err := updateMediaUsage(tx, "post", existing.ID, content+"\n"+summary); err != nil {
+		return "", err
+	}
+	if err := saveRevision(tx, "post", existing.ID, 0); err != nil {
+		return "", err
+	}
+	if err := redirectMoved(tx, "post", existing.ID, oldPath); err != nil {
+		return "", err
+	}
+	return "updated", tx.Commit()
+}
+
+func (app *App) importPage(fm frontMatter, slug, content string) (string, error) {
+	title := fm.string("title")
+	if title == "" {
+		return "", fmt.Errorf("pages need a title")
+	}
+	published, err := fm.bool("published")
+	if err != nil {
+		return "", err
+	}
+	publishAt, err := importedPublishAt(fm)
+	if err != nil {
+		return "", err
+	}
+
+	var existing Page
+	err = app.db.QueryRow(`
+		SELECT id, title, content, published, publish_at, created_at, updated_at
+		FROM pages
+		WHERE slug = ?
+	`, slug).Scan(&existing.ID, &existing.Title, &existing.Content, &existing.Published, &existing.PublishAt, &existing.CreatedAt, &existing.UpdatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	createdAt, updatedAt, err := importedTimes(fm, existing.CreatedAt)
+	if err != nil {
+		return "", err
+	}
+
+	if existing.ID == 0 {
+		if updatedAt.IsZero() {
+			updatedAt = createdAt
+		}
+		tx, err := app.db.Begin()
+		if err != nil {
+			return "", err
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec(`
+			INSERT INTO pages (title, slug, content, content_html, published, publish_at, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, title, slug, content, string(app.markdownToHTML(content, true)), published, publishAtValue(publishAt), sqlTime(createdAt), sqlTime(updatedAt))
+		if err != nil {
+			return "", err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return "", err
+		}
+		if err := updateMediaUsage(tx, "page", int(id), content); err != nil {
+			return "", err
+		}
+		if err := saveRevision(tx, "page", int(id), 0); err != nil {
+			return "", err
+		}
+		return "created", tx.Commit()
+	}
+
+	unchanged := existing.Title == title && existing.Content == content && existing.Published == published &&
+		sameTime(existing.PublishAt, publishAt) && existing.CreatedAt.Equal(createdAt) && (updatedAt.IsZero() || existing.UpdatedAt.Equal(updatedAt))
+	if unchanged {
+		return "unchanged", nil
+	}
+	if updatedAt.IsZero() {
+		updatedAt = time.Now()
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE pages
+		SET title = ?, content = ?, content_html = ?, published = ?, publish_at = ?, created_at = ?, updated_at = ?
+		WHERE id = ?
+	`, title, content, string(app.markdownToHTML(content, true)), published, publishAtValue(publishAt), sqlTime(createdAt), sqlTime(updatedAt), existing.ID)
+	if err != nil {
+		return "", err
+	}
+	if err := updateMediaUsage(tx, "page", existing.ID, content); err != nil {
+		return "", err
+	}
+	if err := saveRevision(tx, "page", existing.ID, 0); err != nil {
+		return "", err
+	}
+	return "updated", tx.Commit()
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// frontMatter holds the header of a Markdown file. Only the small subset of
+// YAML (between --- lines) and TOML (between +++ lines) needed for post
+// metadata is understood: one key per line with a string, boolean or
+// timestamp value, and lists of strings written as [a, b] or, in YAML, as
+// "- item" lines.
+type frontMatter map[string]any
+
+var bareYAMLString = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_./-]*$`)
+
+var frontMatterTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseFrontMatter splits a Markdown file into its front matter and body,
+// dropping the file's final newline. Files without front matter come back
+// with an empty map. The header can end its lines with \r\n, but the body is
+// kept as written.
+func parseFrontMatter(data []byte) (frontMatter, string, error) {
+	text := strings.TrimPrefix(string(data), "\ufeff")
+
+	var delim, sep string
+	switch {
+	case strings.HasPrefix(text, "---\n"), strings.HasPrefix(text, "---\r\n"):
+		delim, sep = "---", ":"
+	case strings.HasPrefix(text, "+++\n"), strings.HasPrefix(text, "+++\r\n"):
+		delim, sep = "+++", "="
+	default:
+		return frontMatter{}, trimLineEnding(text), nil
+	}
+
+	_, rest, _ := strings.Cut(text, "\n")
+	var lines []string
+	closed := false
+	for !closed && rest != "" {
+		var line string
+		line, rest, _ = strings.Cut(rest, "\n")
+		line = strings.TrimSuffix(line, "\r")
+		if strings.TrimRight(line, " \t") == delim {
+			closed = true
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	if !closed {
+		return nil, "", fmt.Errorf("front matter isn't closed with %s", delim)
+	}
+
+	fm, err := parseFrontMatterLines(lines, sep)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The blank line after the header is layout, not content
+	if body, ok := strings.CutPrefix(rest, "\r\n"); ok {
+		rest = body
+	} else {
+		rest = strings.TrimPrefix(rest, "\n")
+	}
+	return fm, trimLineEnding(rest), nil
+}
+
+// trimLineEnding drops one \n or \r\n from the end of s.
+func trimLineEnding(s string) string {
+	if s, ok := strings.CutSuffix(s, "\n"); ok {
+		return strings.TrimSuffix(s, "\r")
+	}
+	return s
+}
+
+func parseFrontMatterLines(lines []string, sep string) (frontMatter, error) {
+	fm := frontMatter{}
+
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(lines[i], sep)
+		if !ok {
+			return nil, fmt.Errorf("front matter line %d: expected key%svalue", i+1, sep)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		// A YAML key with nothing after it introduces a block list
+		if value == "" && sep == ":" {
+			list := []string{}
+			for i+1 < len(lines) {
+				item := strings.TrimSpace(lines[i+1])
+				if item != "-" && !strings.HasPrefix(item, "- ") {
+					break
+				}
+				i++
+				v, err := parseFrontMatterScalar(strings.TrimSpace(strings.TrimPrefix(item, "-")))
+				if err != nil {
+					return nil, fmt.Errorf("front matter line %d: %v", i+1, err)
+				}
+				list = append(list, fmt.Sprint(v))
+			}
+			fm[key] = list
+			continue
+		}
+
+		v, err := parseFrontMatterValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("front matter line %d: %v", i+1, err)
+		}
+		fm[key] = v
+	}
+
+	return fm, nil
+}
+
+func parseFrontMatterValue(value string) (any, error) {
+	if !strings.HasPrefix(value, "[") {
+		return parseFrontMatterScalar(value)
+	}
+
+	end := strings.LastIndex(value, "]")
+	if end < 0 {
+		return nil, fmt.Errorf("unclosed list %s", value)
+	}
+
+	// Split on commas that aren't inside quotes
+	list := []string{}
+	inner := value[1:end]
+	var quote rune
+	escaped := false
+	start := 0
+	for i, c := range inner + "," {
+		if quote != 0 {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\' && quote == '"':
+				escaped = true
+			case c == quote:
+				quote = 0
+			}
+			continue
+		}
+
+		switch c {
+		case '"', '\'':
+			quote = c
+		case ',':
+			item := strings.TrimSpace(inner[start:i])
+			start = i + 1
+			if item == "" {
+				continue
+			}
+			v, err := parseFrontMatterScalar(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, fmt.Sprint(v))
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unclosed quote in %s", value)
+	}
+	return list, nil
+}
+
+// parseFrontMatterScalar returns a string or, for unquoted true and false, a
+// bool. Timestamps are left as strings for frontMatter.time to parse.
+func parseFrontMatterScalar(value string) (any, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := strings.LastIndex(value, `"`)
+		if end == 0 {
+			return nil, fmt.Errorf("unclosed quote in %s", value)
+		}
+		return strconv.Unquote(value[:end+1])
+	case strings.HasPrefix(value, "'"):
+		end := strings.LastIndex(value, "'")
+		if end == 0 {
+			return nil, fmt.Errorf("unclosed quote in %s", value)
+		}
+		return strings.ReplaceAll(value[1:end], "''", "'"), nil
+	}
+
+	// Drop trailing comments from bare values
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+
+	switch value {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return value, nil
+}
+
+func (fm frontMatter) string(key string) string {
+	switch v := fm[key].(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (fm frontMatter) bool(key string) (bool, error) {
+	switch v := fm[key].(type) {
+	case bool:
+		return v, nil
+	case nil:
+		return false, nil
+	case string:
+		return strconv.ParseBool(v)
+	}
+	return false, fmt.Errorf("%s should be true or false", key)
+}
+
+// list accepts a proper list or a comma separated string.
+func (fm frontMatter) list(key string) []string {
+	switch v := fm[key].(type) {
+	case []string:
+		return v
+	case string:
+		var list []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// time returns the zero time when key is missing. Timestamps without a zone
+// are taken to be UTC, like everything in the database.
+func (fm frontMatter) time(key string) (time.Time, error) {
+	value := fm.string(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range frontMatterTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s: can't parse time %q", key, value)
+}
+
+// formatFrontMatter writes fields as a YAML header followed by body. Values
+// can be strings, bools, times or string lists; empty strings and zero
+// times are left out.
+func formatFrontMatter(fields []frontMatterField, body string) []byte {
+	var b strings.Builder
+	b.WriteString("---\n")
+	for _, f := range fields {
+		var value string
+		switch v := f.Value.(type) {
+		case string:
+			if v == "" {
+				continue
+			}
+			value = yamlString(v)
+		case bool:
+			value = strconv.FormatBool(v)
+		case time.Time:
+			if v.IsZero() {
+				continue
+			}
+			value = v.UTC().Format(time.RFC3339)
+		case []string:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = yamlString(item)
+			}
+			value = "[" + strings.Join(items, ", ") + "]"
+		}
+		b.WriteString(f.Key + ": " + value + "\n")
+	}
+	b.WriteString("---\n\n")
+	b.WriteString(body)
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+type frontMatterField struct {
+	Key   string
+	Value any
+}
+
+func yamlString(s string) string {
+	switch s {
+	case "true", "false", "yes", "no", "on", "off", "null":
+		return strconv.Quote(s)
+	}
+	if bareYAMLString.MatchString(s) {
+		return s
+	}
+	return strconv.Quote(s)
+}
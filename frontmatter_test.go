@@ -0,0 +1,154 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFrontMatter(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    frontMatter
+		body    string
+		wantErr bool
+	}{
+		{
+			name:  "no front matter",
+			input: "Just text\n",
+			want:  frontMatter{},
+			body:  "Just text",
+		},
+		{
+			name:  "yaml",
+			input: "---\ntitle: Hello: world\nslug: hello\npublished: true\ndraft: false\n---\n\nBody\n",
+			want:  frontMatter{"title": "Hello: world", "slug": "hello", "published": true, "draft": false},
+			body:  "Body",
+		},
+		{
+			name:  "toml",
+			input: "+++\ntitle = \"Hello\"\npublished = true\n+++\nBody",
+			want:  frontMatter{"title": "Hello", "published": true},
+			body:  "Body",
+		},
+		{
+			name:  "quoted strings",
+			input: "---\na: \"say \\\"hi\\\"\"\nb: 'it''s'\nc: \"true\"\nd: value # comment\ne: \"x # y\"\n---\n",
+			want:  frontMatter{"a": `say "hi"`, "b": "it's", "c": "true", "d": "value", "e": "x # y"},
+		},
+		{
+			name:  "inline list",
+			input: "---\ntags: [Go, \"a, b\", 'c']\nempty: []\n---\n",
+			want:  frontMatter{"tags": []string{"Go", "a, b", "c"}, "empty": []string{}},
+		},
+		{
+			name:  "block list",
+			input: "---\ntags:\n  - Go\n  - \"Web Dev\"\ntitle: After\n---\n",
+			want:  frontMatter{"tags": []string{"Go", "Web Dev"}, "title": "After"},
+		},
+		{
+			name:  "comments and blank lines",
+			input: "---\n# a comment\n\ntitle: Hi\n---\n",
+			want:  frontMatter{"title": "Hi"},
+		},
+		{
+			name:  "byte order mark and windows line endings",
+			input: "\ufeff---\r\ntitle: Hi\r\ntags:\r\n  - Go\r\n---\r\n\r\nLine one\r\nLine two\r\n",
+			want:  frontMatter{"title": "Hi", "tags": []string{"Go"}},
+			body:  "Line one\r\nLine two",
+		},
+		{
+			name:  "windows line endings without front matter",
+			input: "Line one\r\nLine two\r\n",
+			want:  frontMatter{},
+			body:  "Line one\r\nLine two",
+		},
+		{
+			name:  "mixed line endings",
+			input: "+++\r\ntitle = \"Hi\"\n+++\n\nLine one\r\nLine two\nLine three",
+			want:  frontMatter{"title": "Hi"},
+			body:  "Line one\r\nLine two\nLine three",
+		},
+		{
+			name:  "body keeps its own blank lines",
+			input: "---\ntitle: Hi\n---\n\n\nIndented\n\n",
+			want:  frontMatter{"title": "Hi"},
+			body:  "\nIndented\n",
+		},
+		{
+			name:    "not closed",
+			input:   "---\ntitle: Hi\nBody\n",
+			wantErr: true,
+		},
+		{
+			name:    "line without a key",
+			input:   "---\njust words\n---\n",
+			wantErr: true,
+		},
+		{
+			name:    "unclosed quote",
+			input:   "---\ntitle: \"Hi\n---\n",
+			wantErr: true,
+		},
+		{
+			name:    "unclosed list",
+			input:   "---\ntags: [a, b\n---\n",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		fm, body, err := parseFrontMatter([]byte(test.input))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: parseFrontMatter succeeded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseFrontMatter: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(fm, test.want) {
+			t.Errorf("%s: front matter = %#v, want %#v", test.name, fm, test.want)
+		}
+		if body != test.body {
+			t.Errorf("%s: body = %q, want %q", test.name, body, test.body)
+		}
+	}
+}
+
+func TestFrontMatterRoundTrip(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	fields := []frontMatterField{
+		{"title", `Quotes "and" colons: here`},
+		{"slug", "round-trip"},
+		{"published", true},
+		{"created_at", created},
+		{"tags", []string{"Go", "a, b", "true"}},
+		{"summary", ""},
+	}
+	fm, body, err := parseFrontMatter(formatFrontMatter(fields, "Body\n\nMore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fm.string("title"); got != `Quotes "and" colons: here` {
+		t.Errorf("title = %q", got)
+	}
+	if got, err := fm.bool("published"); err != nil || !got {
+		t.Errorf("published = %t, %v", got, err)
+	}
+	if got, err := fm.time("created_at"); err != nil || !got.Equal(created) {
+		t.Errorf("created_at = %v, %v", got, err)
+	}
+	if got := fm.list("tags"); !reflect.DeepEqual(got, []string{"Go", "a, b", "true"}) {
+		t.Errorf("tags = %q", got)
+	}
+	if _, ok := fm["summary"]; ok {
+		t.Error("empty summary was written")
+	}
+	if body != "Body\n\nMore" {
+		t.Errorf("body = %q", body)
+	}
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// Uploaded images get a copy at each of these widths, as long as the
+// original is wider, plus a square thumbnail for the admin.
+var imageWidths = []int{480, 960, 1920}
+
+const (
+	thumbnailSize = 240
+	jpegQuality   = 85
+
+	// maxImagePixels caps the JPEGs and PNGs that get decoded, at 4 bytes a
+	// pixel and then some while resizing
+	maxImagePixels = 50_000_000
+)
+
+var errTooManyPixels = fmt.Errorf("images can be at most %d megapixels", maxImagePixels/1_000_000)
+
+// imageSizes is the sizes attribute for images in a post: the full width of
+// the column, which is at most 800px wide.
+const imageSizes = "(max-width: 800px) 100vw, 800px"
+
+// imageVariant is a resized copy of an upload. Suffix goes between the file
+// name and its extension.
+type imageVariant struct {
+	Suffix    string
+	Width     int
+	Height    int
+	Thumbnail bool
+	Data      []byte
+}
+
+type processedImage struct {
+	Data     []byte
+	Width    int
+	Height   int
+	Variants []imageVariant
+}
+
+// processImage gets an uploaded JPEG or PNG ready to publish. The original
+// keeps its pixels exactly, but loses EXIF (including GPS locations) and
+// other metadata; a JPEG that isn't upright keeps just its orientation. The
+// smaller variants are decoded, turned upright and encoded anew. Width and
+// Height are as the image is shown. Other formats aren't touched, and come
+// back nil.
+func processImage(data []byte, mimeType string) (*processedImage, error) {
+	var config image.Config
+	var err error
+	switch mimeType {
+	case "image/jpeg":
+		config, err = jpeg.DecodeConfig(bytes.NewReader(data))
+	case "image/png":
+		config, err = png.DecodeConfig(bytes.NewReader(data))
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return nil, errTooManyPixels
+	}
+
+	var src image.Image
+	orientation := 1
+	result := &processedImage{}
+	if mimeType == "image/jpeg" {
+		orientation = jpegOrientation(data)
+		if src, err = jpeg.Decode(bytes.NewReader(data)); err == nil {
+			result.Data, err = stripJPEGMetadata(data, orientation)
+		}
+	} else {
+		if src, err = png.Decode(bytes.NewReader(data)); err == nil {
+			result.Data, err = stripPNGMetadata(data)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+	img = orient(img, orientation)
+
+	encode := func(m image.Image) ([]byte, error) {
+		var buf bytes.Buffer
+		var err error
+		if mimeType == "image/jpeg" {
+			err = jpeg.Encode(&buf, m, &jpeg.Options{Quality: jpegQuality})
+		} else {
+			err = png.Encode(&buf, m)
+		}
+		return buf.Bytes(), err
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	result.Width, result.Height = w, h
+
+	for _, width := range imageWidths {
+		if width >= w {
+			break
+		}
+		height := max(1, h*width/w)
+		variant := imageVariant{Suffix: "-" + strconv.Itoa(width) + "w", Width: width, Height: height}
+		if variant.Data, err = encode(resize(img, width, height)); err != nil {
+			return nil, err
+		}
+		result.Variants = append(result.Variants, variant)
+	}
+
+	// The thumbnail is the middle square, scaled down
+	side := min(w, h)
+	crop := img.SubImage(image.Rect((w-side)/2, (h-side)/2, (w-side)/2+side, (h-side)/2+side)).(*image.RGBA)
+	thumbSide := min(side, thumbnailSize)
+	thumb := imageVariant{Suffix: "-thumb", Width: thumbSide, Height: thumbSide, Thumbnail: true}
+	if thumb.Data, err = encode(resize(crop, thumbSide, thumbSide)); err != nil {
+		return nil, err
+	}
+	result.Variants = append(result.Variants, thumb)
+
+	return result, nil
+}
+
+// variantPath is where a variant of the file at name is stored.
+func variantPath(name, suffix string) string {
+	dot := strings.LastIndex(name, ".")
+	if dot <= strings.LastIndex(name, "/") {
+		return name + suffix
+	}
+	return name[:dot] + suffix + name[dot:]
+}
+
+// resize scales src down to w×h. Each new pixel is the average of the source
+// pixels under it, weighted by how much of each it covers, which keeps
+// photos smooth even when shrinking them many times over.
+func resize(src *image.RGBA, w, h int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if sw == w && sh == h {
+		dst := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+		return dst
+	}
+
+	// Horizontally into tmp, a row of w pixels for every source row
+	xs := areaWeights(sw, w)
+	tmp := make([]float32, w*sh*4)
+	for y := 0; y < sh; y++ {
+		row := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):]
+		for x, c := range xs {
+			var r, g, bl, a float32
+			for i, weight := range c.weights {
+				p := row[(c.first+i)*4:]
+				r += float32(p[0]) * weight
+				g += float32(p[1]) * weight
+				bl += float32(p[2]) * weight
+				a += float32(p[3]) * weight
+			}
+			t := tmp[(y*w+x)*4:]
+			t[0], t[1], t[2], t[3] = r, g, bl, a
+		}
+	}
+
+	// Then vertically into the result
+	ys := areaWeights(sh, h)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y, c := range ys {
+		for x := 0; x < w; x++ {
+			var r, g, bl, a float32
+			for i, weight := range c.weights {
+				t := tmp[((c.first+i)*w+x)*4:]
+				r += t[0] * weight
+				g += t[1] * weight
+				bl += t[2] * weight
+				a += t[3] * weight
+			}
+			d := dst.Pix[dst.PixOffset(x, y):]
+			d[0], d[1], d[2], d[3] = clampByte(r), clampByte(g), clampByte(bl), clampByte(a)
+		}
+	}
+	return dst
+}
+
+type areaWeight struct {
+	first   int
+	weights []float32
+}
+
+// areaWeights works out, for each of n output pixels along an axis of size
+// source pixels, which source pixels it covers and the share of each.
+func areaWeights(size, n int) []areaWeight {
+	scale := float64(size) / float64(n)
+	out := make([]areaWeight, n)
+	for i := range out {
+		start, end := float64(i)*scale, float64(i+1)*scale
+		first := int(start)
+		var weights []float32
+		for j := first; j < size && float64(j) < end; j++ {
+			covered := min(end, float64(j+1)) - max(start, float64(j))
+			weights = append(weights, float32(covered/scale))
+		}
+		out[i] = areaWeight{first: first, weights: weights}
+	}
+	return out
+}
+
+func clampByte(v float32) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// orient turns a decoded JPEG upright using its EXIF orientation (1-8), for
+// the variants, which have no EXIF to say which way up they go.
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored and upside down
+				dx, dy = x, h-1-y
+			case 5: // mirrored and on its side
+				dx, dy = y, x
+			case 6: // needs turning clockwise
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8: // needs turning anticlockwise
+				dx, dy = y, w-1-x
+			}
+			s := src.PixOffset(b.Min.X+x, b.Min.Y+y)
+			d := dst.PixOffset(dx, dy)
+			copy(dst.Pix[d:d+4], src.Pix[s:s+4])
+		}
+	}
+	return dst
+}
+
+// jpegSegments splits a JPEG into its marker segments, markers included, up
+// to the start of the image data, which rest begins with. It reports false
+// when the file isn't laid out like a JPEG.
+func jpegSegments(data []byte) (segments [][]byte, rest []byte, ok bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, nil, false
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil, nil, false
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF: // padding
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8):
+			segments = append(segments, data[i:i+2])
+			i += 2
+			continue
+		case marker == 0xDA: // image data starts, no more metadata
+			return segments, data[i:], true
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, nil, false
+		}
+		segments = append(segments, data[i:i+2+length])
+		i += 2 + length
+	}
+	return nil, nil, false
+}
+
+// jpegOrientation finds the EXIF orientation of a JPEG, or 1 (upright) when
+// it has none.
+func jpegOrientation(data []byte) int {
+	segments, _, _ := jpegSegments(data)
+	for _, segment := range segments {
+		if segment[1] == 0xE1 && bytes.HasPrefix(segment[4:], []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[10:])
+		}
+	}
+	return 1
+}
+
+// jpegKeptSegments are the application segments stripJPEGMetadata keeps,
+// by marker and the identifier they start with: JFIF, the colour profile and
+// Adobe's colour transform, since they change how the image looks.
+var jpegKeptSegments = map[byte]string{
+	0xE0: "JFIF\x00",
+	0xE2: "ICC_PROFILE\x00",
+	0xEE: "Adobe",
+}
+
+// stripJPEGMetadata drops the comments and application segments of a JPEG,
+// which hold EXIF, XMP, IPTC and the like, without touching the image data.
+// Anything after the image ends goes too: MPF gain maps and the other
+// trailers some cameras and phones add. An orientation other than 1 is
+// written back as the only EXIF.
+func stripJPEGMetadata(data []byte, orientation int) ([]byte, error) {
+	segments, rest, ok := jpegSegments(data)
+	if ok {
+		rest, ok = jpegScans(rest)
+	}
+	if !ok {
+		return nil, errors.New("the JPEG's metadata couldn't be read")
+	}
+
+	exif := orientationEXIF(orientation)
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+	for _, segment := range segments {
+		marker := segment[1]
+		if marker == 0xFE || marker >= 0xE0 && marker <= 0xEF {
+			id, kept := jpegKeptSegments[marker]
+			if !kept || !bytes.HasPrefix(segment[4:], []byte(id)) {
+				continue
+			}
+		}
+
+		// EXIF goes straight after JFIF, or first when there's none
+		if exif != nil && marker != 0xE0 {
+			out = append(out, exif...)
+			exif = nil
+		}
+		out = append(out, segment...)
+	}
+	out = append(out, exif...)
+	return append(out, rest...), nil
+}
+
+// jpegScans copies the image data of a JPEG, from its first scan up to and
+// including the end of image marker, leaving out any comments and
+// application segments between scans. It reports false when the image never
+// ends.
+func jpegScans(data []byte) ([]byte, bool) {
+	out := make([]byte, 0, len(data))
+	for i := 0; i+1 < len(data); {
+		if data[i] != 0xFF {
+			return nil, false
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF: // padding
+			i++
+			continue
+		case marker == 0xD9:
+			return append(out, 0xFF, 0xD9), true
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			out = append(out, data[i:i+2]...)
+			i += 2
+			continue
+		}
+
+		if i+4 > len(data) {
+			return nil, false
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end < i+4 || end > len(data) {
+			return nil, false
+		}
+		if marker != 0xFE && (marker < 0xE0 || marker > 0xEF) {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+
+		if marker == 0xDA {
+			// The coded data runs until a marker other than a stuffed zero
+			// byte or a restart
+			start := i
+			for ; i+1 < len(data); i++ {
+				if data[i] == 0xFF && data[i+1] != 0x00 && (data[i+1] < 0xD0 || data[i+1] > 0xD7) {
+					break
+				}
+			}
+			out = append(out, data[start:i]...)
+		}
+	}
+	return nil, false
+}
+
+// orientationEXIF is an APP1 segment holding only the EXIF orientation tag,
+// or nothing for orientation 1.
+func orientationEXIF(orientation int) []byte {
+	if orientation < 2 || orientation > 8 {
+		return nil
+	}
+	exif := []byte("Exif\x00\x00" +
+		"MM\x00\x2A\x00\x00\x00\x08" + // big endian TIFF header, first IFD at 8
+		"\x00\x01" + // one entry
+		"\x01\x12\x00\x03\x00\x00\x00\x01" + // orientation, one SHORT
+		string([]byte{0, byte(orientation), 0, 0}) +
+		"\x00\x00\x00\x00") // no next IFD
+	return append([]byte{0xFF, 0xE1, 0, byte(len(exif) + 2)}, exif...)
+}
+
+// pngMetadataChunks are the PNG chunks stripPNGMetadata drops.
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+// stripPNGMetadata drops the text, EXIF and timestamp chunks of a PNG and
+// keeps everything else as it was.
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errors.New("the PNG's metadata couldn't be read")
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, signature...)
+	for i := len(signature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, errors.New("the PNG's metadata couldn't be read")
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end < i+12 || end > len(data) {
+			return nil, errors.New("the PNG's metadata couldn't be read")
+		}
+		if !pngMetadataChunks[string(data[i+4:i+8])] {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+// exifOrientation reads the orientation tag from the first IFD of EXIF data.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// stripWebPMetadata drops the EXIF and XMP chunks of a WebP image, and the
+// flags in its VP8X chunk that announce them.
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("the WebP's metadata couldn't be read")
+	}
+
+	out := make([]byte, 12, len(data))
+	copy(out, data[:12])
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errors.New("the WebP's metadata couldn't be read")
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2 // chunks are padded to an even length
+		if end < i+8 || end > len(data) {
+			return nil, errors.New("the WebP's metadata couldn't be read")
+		}
+		switch string(data[i : i+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[i:end]...)
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+// mediaImages gives Markdown images of files in the media library a srcset
+// of their resized copies and their dimensions, and the library's alt text
+// when the Markdown leaves it out.
+type mediaImages struct {
+	app *App
+}
+
+func (t mediaImages) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if img, ok := n.(*ast.Image); ok && entering {
+			t.app.describeImage(img)
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+func (app *App) describeImage(img *ast.Image) {
+	if app.media == nil {
+		return
+	}
+	name, ok := strings.CutPrefix(string(img.Destination), app.media.URL(""))
+	if !ok {
+		return
+	}
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		name = unescaped
+	}
+
+	var id, width, height int
+	var altText string
+	err := app.db.QueryRow("SELECT id, width, height, alt_text FROM media WHERE path = ?", name).Scan(&id, &width, &height, &altText)
+	if err != nil {
+		return
+	}
+
+	if width > 0 && height > 0 {
+		img.SetAttributeString("width", strconv.Itoa(width))
+		img.SetAttributeString("height", strconv.Itoa(height))
+	}
+	if altText != "" && img.FirstChild() == nil {
+		img.AppendChild(img, ast.NewString([]byte(altText)))
+	}
+
+	rows, err := app.db.Query("SELECT path, width FROM media_variants WHERE media_id = ? AND NOT thumbnail ORDER BY width", id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var srcset []string
+	for rows.Next() {
+		var path string
+		var w int
+		if err := rows.Scan(&path, &w); err != nil {
+			return
+		}
+		srcset = append(srcset, app.media.URL(path)+" "+strconv.Itoa(w)+"w")
+	}
+	if rows.Err() != nil || len(srcset) == 0 {
+		return
+	}
+	srcset = append(srcset, app.media.URL(name)+" "+strconv.Itoa(width)+"w")
+
+	img.SetAttributeString("srcset", strings.Join(srcset, ", "))
+	img.SetAttributeString("sizes", imageSizes)
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"reflect"
+	"testing"
+)
+
+// secret stands in for the private details metadata can give away. It goes
+// into every kind of metadata the tests build, and must never come out.
+const secret = "secret place"
+
+// testTIFF is EXIF data with a description, a GPS location and, unless it's
+// 0, an orientation.
+func testTIFF(order binary.AppendByteOrder, orientation int) []byte {
+	b := []byte("MM\x00\x2A")
+	if order == binary.LittleEndian {
+		b = []byte("II\x2A\x00")
+	}
+	b = order.AppendUint32(b, 8)
+
+	n := 2
+	if orientation != 0 {
+		n++
+	}
+	descOffset := 8 + 2 + n*12 + 4
+	gpsOffset := descOffset + len(secret) + 2 // NUL, then padded to even
+
+	b = order.AppendUint16(b, uint16(n))
+	b = order.AppendUint16(b, 0x010E) // image description
+	b = order.AppendUint16(b, 2)
+	b = order.AppendUint32(b, uint32(len(secret)+1))
+	b = order.AppendUint32(b, uint32(descOffset))
+	if orientation != 0 {
+		b = order.AppendUint16(b, 0x0112)
+		b = order.AppendUint16(b, 3)
+		b = order.AppendUint32(b, 1)
+		b = order.AppendUint16(b, uint16(orientation))
+		b = append(b, 0, 0)
+	}
+	b = order.AppendUint16(b, 0x8825) // GPS IFD
+	b = order.AppendUint16(b, 4)
+	b = order.AppendUint32(b, 1)
+	b = order.AppendUint32(b, uint32(gpsOffset))
+	b = order.AppendUint32(b, 0)
+
+	b = append(b, secret+"\x00\x00"...)
+
+	b = order.AppendUint16(b, 1)
+	b = order.AppendUint16(b, 0x0001) // latitude reference
+	b = order.AppendUint16(b, 2)
+	b = order.AppendUint32(b, 2)
+	b = append(b, 'N', 0, 0, 0)
+	return order.AppendUint32(b, 0)
+}
+
+func jpegSegment(marker byte, payload string) []byte {
+	b := []byte{0xFF, marker}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)+2))
+	return append(b, payload...)
+}
+
+// testPicture is red on the left half and blue on the right.
+func testPicture(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= w/2 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// testJPEG is a w×h JPEG with EXIF holding orientation, and all the other
+// metadata a phone or an editor might add, before and after the image.
+func testJPEG(t *testing.T, w, h, orientation int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testPicture(w, h), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	var gainMap bytes.Buffer
+	if err := jpeg.Encode(&gainMap, testPicture(8, 8), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b := []byte{0xFF, 0xD8}
+	for _, segment := range [][]byte{
+		jpegSegment(0xE0, "JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"),
+		jpegSegment(0xE1, "Exif\x00\x00"+string(testTIFF(binary.BigEndian, orientation))),
+		jpegSegment(0xE1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>"+secret+"</x:xmpmeta>"),
+		jpegSegment(0xE2, "ICC_PROFILE\x00\x01\x01profile"),
+		jpegSegment(0xE2, "MPF\x00MM\x00\x2A"+secret),
+		jpegSegment(0xE0, "JFXX\x00\x10"+secret),
+		jpegSegment(0xED, "Photoshop 3.0\x00"+secret),
+		jpegSegment(0xFE, secret),
+	} {
+		b = append(b, segment...)
+	}
+	b = append(b, encoded[2:]...)
+	return append(b, gainMap.Bytes()...)
+}
+
+func pngChunk(kind, data string) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	b = append(b, kind+data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE([]byte(kind+data)))
+}
+
+// testPNG is a w×h PNG with text, EXIF and a timestamp.
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testPicture(w, h)); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	// Straight after the signature and IHDR
+	b := append([]byte{}, encoded[:33]...)
+	for _, chunk := range [][]byte{
+		pngChunk("sRGB", "\x00"),
+		pngChunk("eXIf", string(testTIFF(binary.BigEndian, 6))),
+		pngChunk("tEXt", "Comment\x00"+secret),
+		pngChunk("zTXt", "Comment\x00\x00"+secret),
+		pngChunk("iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta>"+secret+"</x:xmpmeta>"),
+		pngChunk("tIME", "\x07\xE8\x01\x02\x03\x04\x05"),
+	} {
+		b = append(b, chunk...)
+	}
+	return append(b, encoded[33:]...)
+}
+
+func webpChunk(kind, data string) []byte {
+	b := append([]byte(kind), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// testWebP is a WebP with EXIF and XMP. The image itself is made up, since
+// only the chunks around it matter.
+func testWebP() []byte {
+	// ICC, alpha, EXIF and XMP flags, then a 16×16 canvas
+	vp8x := "\x3C\x00\x00\x00\x0F\x00\x00\x0F\x00\x00"
+	body := []byte("WEBP")
+	for _, chunk := range [][]byte{
+		webpChunk("VP8X", vp8x),
+		webpChunk("ICCP", "profile"),
+		webpChunk("VP8L", "\x2F\x0F\xC0\x03\x00"),
+		webpChunk("EXIF", string(testTIFF(binary.LittleEndian, 6))+"x"),
+		webpChunk("XMP ", "<x:xmpmeta>"+secret+"</x:xmpmeta>"),
+	} {
+		body = append(body, chunk...)
+	}
+	b := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	return append(b, body...)
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	for _, orientation := range []int{1, 3, 6, 8} {
+		data := testJPEG(t, 64, 32, orientation)
+		if got := jpegOrientation(data); got != orientation {
+			t.Fatalf("test image has orientation %d, want %d", got, orientation)
+		}
+
+		out, err := stripJPEGMetadata(data, orientation)
+		if err != nil {
+			t.Fatalf("orientation %d: %v", orientation, err)
+		}
+
+		for _, s := range []string{secret, "http://ns.adobe.com", "MPF\x00", "JFXX", "Photoshop"} {
+			if bytes.Contains(out, []byte(s)) {
+				t.Errorf("orientation %d: %q left in", orientation, s)
+			}
+		}
+		for _, s := range []string{"JFIF\x00", "ICC_PROFILE\x00"} {
+			if !bytes.Contains(out, []byte(s)) {
+				t.Errorf("orientation %d: %q taken out", orientation, s)
+			}
+		}
+
+		segments, _, ok := jpegSegments(out)
+		if !ok {
+			t.Fatalf("orientation %d: output isn't a JPEG", orientation)
+		}
+		var exif [][]byte
+		for _, segment := range segments {
+			if segment[1] == 0xE1 {
+				exif = append(exif, segment)
+			}
+		}
+		switch {
+		case orientation == 1 && len(exif) != 0:
+			t.Errorf("orientation 1: EXIF left in")
+		case orientation != 1 && (len(exif) != 1 || !bytes.Equal(exif[0], orientationEXIF(orientation))):
+			t.Errorf("orientation %d: EXIF is %q", orientation, exif)
+		}
+		if got := jpegOrientation(out); got != orientation {
+			t.Errorf("orientation %d: came out as %d", orientation, got)
+		}
+
+		// The gain map after the image is gone, and the pixels are as they were
+		if n := bytes.Count(out, []byte{0xFF, 0xD9}); n != 1 || !bytes.HasSuffix(out, []byte{0xFF, 0xD9}) {
+			t.Errorf("orientation %d: doesn't end at the image's end", orientation)
+		}
+		want, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := jpeg.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("orientation %d: output doesn't decode: %v", orientation, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("orientation %d: pixels changed", orientation)
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		"not a JPEG": []byte("GIF89a"),
+		"never ends": testJPEG(t, 16, 16, 1)[:200],
+	} {
+		if _, err := stripJPEGMetadata(data, 1); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestJPEGScans(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		ok    bool
+	}{
+		{
+			"stuffed bytes and restarts",
+			"\xFF\xDA\x00\x03\x00\x12\xFF\x00\x34\xFF\xD0\x56\xFF\xD9",
+			"\xFF\xDA\x00\x03\x00\x12\xFF\x00\x34\xFF\xD0\x56\xFF\xD9",
+			true,
+		},
+		{
+			"progressive, with a comment between scans",
+			"\xFF\xDA\x00\x03\x00\x12\xFF\xC4\x00\x03\x00\xFF\xFE\x00\x04hi\xFF\xDA\x00\x03\x00\x78\xFF\xFF\xD9",
+			"\xFF\xDA\x00\x03\x00\x12\xFF\xC4\x00\x03\x00\xFF\xDA\x00\x03\x00\x78\xFF\xD9",
+			true,
+		},
+		{
+			"trailer",
+			"\xFF\xDA\x00\x03\x00\x12\xFF\xD9\xFF\xD8\xFF\xE1\x00\x04ab\xFF\xD9",
+			"\xFF\xDA\x00\x03\x00\x12\xFF\xD9",
+			true,
+		},
+		{"no end", "\xFF\xDA\x00\x03\x00\x12\x34", "", false},
+		{"bad length", "\xFF\xDA\x00\x01\x00\xFF\xD9", "", false},
+		{"segment past the end", "\xFF\xDA\x00\x30\x00\xFF\xD9", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := jpegScans([]byte(tt.input))
+		if ok != tt.ok || string(got) != tt.want {
+			t.Errorf("%s: got %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	data := testPNG(t, 32, 16)
+	out, err := stripPNGMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{secret, "eXIf", "tEXt", "zTXt", "iTXt", "tIME"} {
+		if bytes.Contains(out, []byte(s)) {
+			t.Errorf("%q left in", s)
+		}
+	}
+	if !bytes.Contains(out, []byte("sRGB")) {
+		t.Errorf("sRGB chunk taken out")
+	}
+
+	want, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("output doesn't decode: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pixels changed")
+	}
+
+	for name, data := range map[string][]byte{
+		"not a PNG": []byte("GIF89a"),
+		"truncated": data[:len(data)-4],
+	} {
+		if _, err := stripPNGMetadata(data); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestStripWebPMetadata(t *testing.T) {
+	data := testWebP()
+	out, err := stripWebPMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{secret, "EXIF", "XMP "} {
+		if bytes.Contains(out, []byte(s)) {
+			t.Errorf("%q left in", s)
+		}
+	}
+	for _, s := range []string{"ICCP", "VP8L\x05\x00\x00\x00\x2F\x0F\xC0\x03\x00\x00"} {
+		if !bytes.Contains(out, []byte(s)) {
+			t.Errorf("%q taken out", s)
+		}
+	}
+	if size := binary.LittleEndian.Uint32(out[4:]); int(size) != len(out)-8 {
+		t.Errorf("RIFF size is %d, want %d", size, len(out)-8)
+	}
+	if flags := out[20]; flags != 0x30 {
+		t.Errorf("VP8X flags are %#x, want ICC and alpha only (0x30)", flags)
+	}
+
+	// Stripping it again finds well-formed chunks and nothing to take out
+	again, err := stripWebPMetadata(out)
+	if err != nil || !bytes.Equal(again, out) {
+		t.Errorf("stripping again gave %q, %v", again, err)
+	}
+
+	for name, data := range map[string][]byte{
+		"not a WebP": []byte("RIFF\x04\x00\x00\x00WAVE"),
+		"truncated":  data[:len(data)-4],
+	} {
+		if _, err := stripWebPMetadata(data); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	be := testTIFF(binary.BigEndian, 6)
+	tests := []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{"big endian", be, 6},
+		{"little endian", testTIFF(binary.LittleEndian, 8), 8},
+		{"no orientation", testTIFF(binary.BigEndian, 0), 1},
+		{"out of range", testTIFF(binary.BigEndian, 9), 1},
+		{"unknown byte order", append([]byte("XX"), be[2:]...), 1},
+		{"too short", be[:6], 1},
+		{"IFD past the end", append(be[:4:4], 0, 0, 0xFF, 0), 1},
+		{"entries cut off", be[:20], 1},
+	}
+	for _, tt := range tests {
+		if got := exifOrientation(tt.tiff); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 3×2, and each pixel's red is its index
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i := range 6 {
+		src.SetRGBA(i%3, i/3, color.RGBA{uint8(i), 0, 0, 255})
+	}
+
+	// Where the top left and top right pixels end up
+	tests := []struct {
+		orientation int
+		w, h        int
+		left, right image.Point
+		description string
+	}{
+		{1, 3, 2, image.Pt(0, 0), image.Pt(2, 0), "upright"},
+		{2, 3, 2, image.Pt(2, 0), image.Pt(0, 0), "mirrored"},
+		{3, 3, 2, image.Pt(2, 1), image.Pt(0, 1), "upside down"},
+		{4, 3, 2, image.Pt(0, 1), image.Pt(2, 1), "mirrored and upside down"},
+		{5, 2, 3, image.Pt(0, 0), image.Pt(0, 2), "transposed"},
+		{6, 2, 3, image.Pt(1, 0), image.Pt(1, 2), "turned clockwise"},
+		{7, 2, 3, image.Pt(1, 2), image.Pt(1, 0), "transversed"},
+		{8, 2, 3, image.Pt(0, 2), image.Pt(0, 0), "turned anticlockwise"},
+		{9, 3, 2, image.Pt(0, 0), image.Pt(2, 0), "invalid"},
+	}
+	for _, tt := range tests {
+		got := orient(src, tt.orientation)
+		if got.Bounds().Dx() != tt.w || got.Bounds().Dy() != tt.h {
+			t.Errorf("%s: %v, want %d×%d", tt.description, got.Bounds(), tt.w, tt.h)
+			continue
+		}
+		if r := got.RGBAAt(tt.left.X, tt.left.Y).R; r != 0 {
+			t.Errorf("%s: top left is pixel %d", tt.description, r)
+		}
+		if r := got.RGBAAt(tt.right.X, tt.right.Y).R; r != 2 {
+			t.Errorf("%s: top right is pixel %d", tt.description, r)
+		}
+	}
+}
+
+func TestVariantPath(t *testing.T) {
+	tests := []struct{ name, suffix, want string }{
+		{"2024/photo.jpg", "-480w", "2024/photo-480w.jpg"},
+		{"photo.jpg", "-thumb", "photo-thumb.jpg"},
+		{"archive.tar.gz", "-480w", "archive.tar-480w.gz"},
+		{"photo", "-480w", "photo-480w"},
+		{"v1.2/photo", "-480w", "v1.2/photo-480w"},
+	}
+	for _, tt := range tests {
+		if got := variantPath(tt.name, tt.suffix); got != tt.want {
+			t.Errorf("variantPath(%q, %q) = %q, want %q", tt.name, tt.suffix, got, tt.want)
+		}
+	}
+}
+
+func TestProcessImage(t *testing.T) {
+	type size struct {
+		suffix string
+		w, h   int
+	}
+	tests := []struct {
+		name     string
+		data     []byte
+		mimeType string
+		w, h     int
+		variants []size
+	}{
+		{
+			"JPEG on its side", testJPEG(t, 1000, 500, 6), "image/jpeg", 500, 1000,
+			[]size{{"-480w", 480, 960}, {"-thumb", 240, 240}},
+		},
+		{
+			"upright JPEG", testJPEG(t, 2000, 1000, 1), "image/jpeg", 2000, 1000,
+			[]size{{"-480w", 480, 240}, {"-960w", 960, 480}, {"-1920w", 1920, 960}, {"-thumb", 240, 240}},
+		},
+		{
+			"PNG", testPNG(t, 600, 300), "image/png", 600, 300,
+			[]size{{"-480w", 480, 240}, {"-thumb", 240, 240}},
+		},
+		{
+			"small PNG", testPNG(t, 100, 50), "image/png", 100, 50,
+			[]size{{"-thumb", 50, 50}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := processImage(tt.data, tt.mimeType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Width != tt.w || result.Height != tt.h {
+				t.Errorf("shown at %d×%d, want %d×%d", result.Width, result.Height, tt.w, tt.h)
+			}
+			if bytes.Contains(result.Data, []byte(secret)) {
+				t.Errorf("metadata left in the original")
+			}
+
+			decode := jpeg.Decode
+			if tt.mimeType == "image/png" {
+				decode = png.Decode
+			}
+			if _, err := decode(bytes.NewReader(result.Data)); err != nil {
+				t.Errorf("original doesn't decode: %v", err)
+			}
+
+			if len(result.Variants) != len(tt.variants) {
+				t.Fatalf("%d variants, want %d", len(result.Variants), len(tt.variants))
+			}
+			for i, v := range result.Variants {
+				want := tt.variants[i]
+				if v.Suffix != want.suffix || v.Width != want.w || v.Height != want.h {
+					t.Errorf("variant %s is %d×%d, want %s at %d×%d", v.Suffix, v.Width, v.Height, want.suffix, want.w, want.h)
+				}
+				if v.Thumbnail != (v.Suffix == "-thumb") {
+					t.Errorf("variant %s: thumbnail is %v", v.Suffix, v.Thumbnail)
+				}
+				img, err := decode(bytes.NewReader(v.Data))
+				if err != nil {
+					t.Errorf("variant %s doesn't decode: %v", v.Suffix, err)
+					continue
+				}
+				if b := img.Bounds(); b.Dx() != v.Width || b.Dy() != v.Height {
+					t.Errorf("variant %s decodes at %v", v.Suffix, b)
+				}
+				if bytes.Contains(v.Data, []byte(secret)) || bytes.Contains(v.Data, []byte("Exif")) {
+					t.Errorf("variant %s has metadata", v.Suffix)
+				}
+
+				// Red started on the left, so upright it's on top when the
+				// photo was on its side
+				if v.Thumbnail || tt.name != "JPEG on its side" {
+					continue
+				}
+				top := color.RGBAModel.Convert(img.At(v.Width/2, 2)).(color.RGBA)
+				bottom := color.RGBAModel.Convert(img.At(v.Width/2, v.Height-3)).(color.RGBA)
+				if top.R < 200 || top.B > 50 || bottom.B < 200 || bottom.R > 50 {
+					t.Errorf("variant %s isn't upright: top %v, bottom %v", v.Suffix, top, bottom)
+				}
+			}
+		})
+	}
+
+	// An IHDR claiming 10000×10000 is turned away before anything's decoded
+	ihdr := binary.BigEndian.AppendUint32(nil, 10000)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, 10000)
+	huge := append([]byte("\x89PNG\r\n\x1a\n"), pngChunk("IHDR", string(ihdr)+"\x08\x06\x00\x00\x00")...)
+	if _, err := processImage(huge, "image/png"); err != errTooManyPixels {
+		t.Errorf("huge PNG: got %v, want %v", err, errTooManyPixels)
+	}
+
+	if result, err := processImage([]byte("GIF89a"), "image/gif"); result != nil || err != nil {
+		t.Errorf("GIF: got %v, %v, want it left alone", result, err)
+	}
+	if _, err := processImage([]byte("\xFF\xD8\xFF\xDB"), "image/jpeg"); err == nil {
+		t.Errorf("broken JPEG: no error")
+	}
+}
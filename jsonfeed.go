@@ -0,0 +1,62 @@
+package main
+
+import "time"
+
+// JSONFeed follows https://jsonfeed.org/version/1.1
+type JSONFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Description string           `json:"description,omitempty"`
+	Language    string           `json:"language,omitempty"`
+	Authors     []JSONFeedAuthor `json:"authors,omitempty"`
+	Items       []JSONFeedItem   `json:"items"`
+}
+
+type JSONFeedAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+}
+
+type JSONFeedItem struct {
+	ID            string   `json:"id"`
+	URL           string   `json:"url"`
+	Title         string   `json:"title,omitempty"`
+	ContentHTML   string   `json:"content_html"`
+	DatePublished string   `json:"date_published"`
+	DateModified  string   `json:"date_modified"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+func (app *App) generateJSONFeed(postType, tag, baseURL, title, description string) (*JSONFeed, error) {
+	entries, err := app.feedEntries(postType, tag, baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	feed := &JSONFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       title,
+		HomePageURL: baseURL,
+		FeedURL:     baseURL + feedPath(postType, tag) + ".json",
+		Description: description,
+		Language:    "en-US",
+		Authors:     []JSONFeedAuthor{{Name: "Alec Stewart", URL: baseURL}},
+		Items:       []JSONFeedItem{},
+	}
+
+	for _, e := range entries {
+		feed.Items = append(feed.Items, JSONFeedItem{
+			ID:            e.URL,
+			URL:           e.URL,
+			Title:         e.Title,
+			ContentHTML:   e.HTML,
+			DatePublished: e.CreatedAt.Format(time.RFC3339),
+			DateModified:  e.UpdatedAt.Format(time.RFC3339),
+			Tags:          e.Tags,
+		})
+	}
+
+	return feed, nil
+}
@@ -6,6 +6,8 @@ import (
 	"database/sql"
 	"embed"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"html/template"
 	"io"
 	"log"
@@ -17,7 +19,9 @@ import (
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark/extension"
 	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
 	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/util"
 	_ "modernc.org/sqlite"
 )
 
@@ -29,11 +33,15 @@ var staticFS embed.FS
 
 var baseURL = os.Getenv("BASE_URL")
 
+var postTypes = []string{"essay", "note", "link", "photo"}
+
 type App struct {
 	db        *sql.DB
 	templates map[string]*template.Template
-	csrfToken string
 	markdown  goldmark.Markdown
+	escaped   goldmark.Markdown
+	media     MediaStore
+	csrfKey   []byte
 }
 
 type Post struct {
@@ -42,11 +50,17 @@ type Post struct {
 	Slug        string
 	Content     string
 	HTMLContent template.HTML
+	Summary     string
+	SummaryHTML template.HTML
+	HasMore     bool
 	PostType    string
 	Published   bool
+	PublishAt   sql.NullTime
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
-	Tags        []string
+	Tags        []Tag
+	AuthorID    int
+	Author      string
 }
 
 type Page struct {
@@ -56,27 +70,39 @@ type Page struct {
 	Content     string
 	HTMLContent template.HTML
 	Published   bool
+	PublishAt   sql.NullTime
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
 }
 
 type User struct {
-	ID       int
-	Username string
-	Password string
+	ID           int
+	Username     string
+	Password     string
+	Role         string
+	Disabled     bool
+	CreatedAt    time.Time
+	TOTPSecret   string
+	TOTPEnabled  bool
+	TOTPLastStep int64
 }
 
 type Tag struct {
-	Name  string
-	Count int
+	ID          int
+	Name        string
+	Slug        string
+	Description string
+	Count       int
+	UpdatedAt   time.Time
 }
 
 func main() {
 	app := &App{}
 
-	if err := app.loadEnv(".env"); err != nil {
+	if err := app.loadEnv(".env"); err != nil && !os.IsNotExist(err) {
 		log.Fatal("Failed to load .env file:", err)
 	}
+	baseURL = os.Getenv("BASE_URL")
 
 	if err := app.initDB(); err != nil {
 		log.Fatal("Failed to initialize database:", err)
@@ -87,80 +113,168 @@ func main() {
 		log.Fatal("Failed to run migrations:", err)
 	}
 
+	csrfKey, err := app.serverSecret("csrf")
+	if err != nil {
+		log.Fatal("Failed to load the CSRF key:", err)
+	}
+	app.csrfKey = csrfKey
+
 	if err := app.loadTemplates(); err != nil {
 		log.Fatal("Failed to load templates:", err)
 	}
 
+	app.initMarkdown()
+
+	media, err := newMediaStore()
+	if err != nil {
+		log.Fatal("Failed to set up media storage:", err)
+	}
+	app.media = media
+
+	if _, err := app.renderContentHTML(false); err != nil {
+		log.Fatal("Failed to render content:", err)
+	}
+
+	if err := app.backfillTagSlugs(); err != nil {
+		log.Fatal("Failed to set tag slugs:", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		if err := app.runCommand(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			app.db.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := app.createInitialUser(); err != nil {
 		log.Fatal("Failed to create default user:", err)
 	}
 
-	app.csrfToken = generateToken()
-	app.initMarkdown()
+	go app.runScheduler()
+
+	srv := &http.Server{
+		Addr:         ":8080",
+		Handler:      app.routes(),
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
 
+	log.Printf("Server starting on http://localhost%s\n", srv.Addr)
+	log.Fatal(srv.ListenAndServe())
+}
+
+func (app *App) routes() http.Handler {
 	mux := http.NewServeMux()
 
 	// Static files
 	mux.Handle("GET /static/", http.FileServer(http.FS(staticFS)))
+	if local, ok := app.media.(*LocalStore); ok {
+		mux.Handle("GET /media/", local)
+	}
 
 	// Public routes
 	mux.HandleFunc("GET /", logHandler(app.handleHome))
 	mux.HandleFunc("GET /essays", logHandler(app.handlePostsList("essay")))
+	mux.HandleFunc("GET /essays/page/{page}", logHandler(app.handlePostsList("essay")))
 	mux.HandleFunc("GET /essays/{slug}", logHandler(app.handlePosts("essay")))
 	mux.HandleFunc("GET /notes", logHandler(app.handlePostsList("note")))
+	mux.HandleFunc("GET /notes/page/{page}", logHandler(app.handlePostsList("note")))
 	mux.HandleFunc("GET /notes/{slug}", logHandler(app.handlePosts("note")))
 	mux.HandleFunc("GET /links", logHandler(app.handlePostsList("link")))
+	mux.HandleFunc("GET /links/page/{page}", logHandler(app.handlePostsList("link")))
 	mux.HandleFunc("GET /links/{slug}", logHandler(app.handlePosts("link")))
 	mux.HandleFunc("GET /photos", logHandler(app.handlePostsList("photo")))
+	mux.HandleFunc("GET /photos/page/{page}", logHandler(app.handlePostsList("photo")))
 	mux.HandleFunc("GET /photos/{slug}", logHandler(app.handlePosts("photo")))
 	mux.HandleFunc("GET /tags", logHandler(app.handleTags))
 	mux.HandleFunc("GET /tags/{slug}", logHandler(app.handleTagPosts))
+	mux.HandleFunc("GET /tags/{slug}/page/{page}", logHandler(app.handleTagPosts))
 	mux.HandleFunc("GET /now", logHandler(app.handleNow))
 
-	// RSS feeds
-	mux.HandleFunc("GET /feed.xml", logHandler(app.handleRSSFeed))
-	mux.HandleFunc("GET /essays/feed.xml", logHandler(app.handlePostTypeRSS("essay")))
-	mux.HandleFunc("GET /notes/feed.xml", logHandler(app.handlePostTypeRSS("note")))
-	mux.HandleFunc("GET /links/feed.xml", logHandler(app.handlePostTypeRSS("link")))
-	mux.HandleFunc("GET /photos/feed.xml", logHandler(app.handlePostTypeRSS("photo")))
+	// Feeds
+	for _, postType := range append([]string{""}, postTypes...) {
+		path := feedPath(postType, "")
+		mux.HandleFunc("GET "+path+".xml", logHandler(app.handleFeed(postType, "rss")))
+		mux.HandleFunc("GET "+path+".atom", logHandler(app.handleFeed(postType, "atom")))
+		mux.HandleFunc("GET "+path+".json", logHandler(app.handleFeed(postType, "json")))
+	}
+	mux.HandleFunc("GET /tags/{slug}/feed.xml", logHandler(app.handleFeed("", "rss")))
+	mux.HandleFunc("GET /tags/{slug}/feed.atom", logHandler(app.handleFeed("", "atom")))
+	mux.HandleFunc("GET /tags/{slug}/feed.json", logHandler(app.handleFeed("", "json")))
 
 	// Admin routes
 	mux.HandleFunc("GET /login", logHandler(app.handleLogin))
 	mux.HandleFunc("POST /login", logHandler(app.handleLogin))
+	mux.HandleFunc("GET /login/totp", logHandler(app.handleLoginTOTP))
+	mux.HandleFunc("POST /login/totp", logHandler(app.handleLoginTOTP))
+	mux.HandleFunc("POST /login/passkey/begin", logHandler(app.handlePasskeyLoginBegin))
+	mux.HandleFunc("POST /login/passkey/finish", logHandler(app.handlePasskeyLoginFinish))
 	mux.HandleFunc("GET /logout", logHandler(app.handleLogout))
-	mux.HandleFunc("GET /admin", logHandler(app.requireAuth(app.handleAdmin)))
-	mux.HandleFunc("GET /admin/media", logHandler(app.requireAuth(app.handleAdminMedia)))
-	mux.HandleFunc("GET /admin/media/new", logHandler(app.requireAuth(app.handleNewMedia)))
-	mux.HandleFunc("POST /admin/media/new", logHandler(app.requireAuth(app.handleNewMedia)))
-	mux.HandleFunc("POST /admin/media/delete", logHandler(app.requireAuth(app.handleDeleteMedia)))
-	mux.HandleFunc("GET /admin/posts", logHandler(app.requireAuth(app.handleAdminPosts)))
-	mux.HandleFunc("GET /admin/posts/new", logHandler(app.requireAuth(app.handleNewPost)))
-	mux.HandleFunc("POST /admin/posts/new", logHandler(app.requireAuth(app.handleNewPost)))
-	mux.HandleFunc("GET /admin/posts/edit/{id}", logHandler(app.requireAuth(app.handleEditPost)))
-	mux.HandleFunc("POST /admin/posts/edit/{id}", logHandler(app.requireAuth(app.handleEditPost)))
-	mux.HandleFunc("POST /admin/posts/delete", logHandler(app.requireAuth(app.handleDeletePost)))
-	mux.HandleFunc("GET /admin/pages", logHandler(app.requireAuth(app.handleAdminPages)))
-	mux.HandleFunc("GET /admin/pages/new", logHandler(app.requireAuth(app.handleNewPage)))
-	mux.HandleFunc("POST /admin/pages/new", logHandler(app.requireAuth(app.handleNewPage)))
-	mux.HandleFunc("GET /admin/pages/edit/{id}", logHandler(app.requireAuth(app.handleEditPage)))
-	mux.HandleFunc("POST /admin/pages/edit/{id}", logHandler(app.requireAuth(app.handleEditPage)))
-	mux.HandleFunc("POST /admin/pages/delete", logHandler(app.requireAuth(app.handleDeletePage)))
+	mux.HandleFunc("GET /admin", logHandler(app.requireAuth(roleAuthor, app.handleAdmin)))
+	mux.HandleFunc("POST /admin/rebuild-html", logHandler(app.requireAuth(roleOwner, app.handleRebuildHTML)))
+	mux.HandleFunc("GET /admin/security", logHandler(app.requireAuth(roleAuthor, app.handleAdminSecurity)))
+	mux.HandleFunc("POST /admin/security/totp/setup", logHandler(app.requireAuth(roleAuthor, app.handleTOTPSetup)))
+	mux.HandleFunc("POST /admin/security/totp/enable", logHandler(app.requireAuth(roleAuthor, app.handleTOTPEnable)))
+	mux.HandleFunc("POST /admin/security/totp/disable", logHandler(app.requireAuth(roleAuthor, app.handleTOTPDisable)))
+	mux.HandleFunc("POST /admin/security/recovery-codes", logHandler(app.requireAuth(roleAuthor, app.handleRecoveryCodes)))
+	mux.HandleFunc("POST /admin/security/passkeys/begin", logHandler(app.requireAuth(roleAuthor, app.handlePasskeyRegisterBegin)))
+	mux.HandleFunc("POST /admin/security/passkeys/finish", logHandler(app.requireAuth(roleAuthor, app.handlePasskeyRegisterFinish)))
+	mux.HandleFunc("POST /admin/security/passkeys/delete", logHandler(app.requireAuth(roleAuthor, app.handleDeletePasskey)))
+	mux.HandleFunc("GET /admin/media", logHandler(app.requireAuth(roleAuthor, app.handleAdminMedia)))
+	mux.HandleFunc("GET /admin/media/new", logHandler(app.requireAuth(roleAuthor, app.handleNewMedia)))
+	mux.HandleFunc("POST /admin/media/new", logHandler(app.requireAuth(roleAuthor, app.handleNewMedia)))
+	mux.HandleFunc("GET /admin/media/edit/{id}", logHandler(app.requireAuth(roleAuthor, app.handleEditMedia)))
+	mux.HandleFunc("POST /admin/media/edit/{id}", logHandler(app.requireAuth(roleAuthor, app.handleEditMedia)))
+	mux.HandleFunc("POST /admin/media/delete", logHandler(app.requireAuth(roleEditor, app.handleDeleteMedia)))
+	mux.HandleFunc("POST /admin/media/sync", logHandler(app.requireAuth(roleEditor, app.handleSyncMedia)))
+	mux.HandleFunc("GET /admin/posts", logHandler(app.requireAuth(roleAuthor, app.handleAdminPosts)))
+	mux.HandleFunc("GET /admin/posts/new", logHandler(app.requireAuth(roleAuthor, app.handleNewPost)))
+	mux.HandleFunc("POST /admin/posts/new", logHandler(app.requireAuth(roleAuthor, app.handleNewPost)))
+	mux.HandleFunc("GET /admin/posts/edit/{id}", logHandler(app.requireAuth(roleAuthor, app.handleEditPost)))
+	mux.HandleFunc("POST /admin/posts/edit/{id}", logHandler(app.requireAuth(roleAuthor, app.handleEditPost)))
+	mux.HandleFunc("POST /admin/posts/delete", logHandler(app.requireAuth(roleAuthor, app.handleDeletePost)))
+	mux.HandleFunc("GET /admin/posts/revisions/{id}", logHandler(app.requireAuth(roleAuthor, app.handleRevisions("post"))))
+	mux.HandleFunc("GET /admin/posts/revisions/{id}/diff", logHandler(app.requireAuth(roleAuthor, app.handleRevisionDiff("post"))))
+	mux.HandleFunc("POST /admin/posts/revisions/{id}/restore", logHandler(app.requireAuth(roleAuthor, app.handleRestoreRevision("post"))))
+	mux.HandleFunc("GET /admin/pages", logHandler(app.requireAuth(roleEditor, app.handleAdminPages)))
+	mux.HandleFunc("GET /admin/pages/new", logHandler(app.requireAuth(roleEditor, app.handleNewPage)))
+	mux.HandleFunc("POST /admin/pages/new", logHandler(app.requireAuth(roleEditor, app.handleNewPage)))
+	mux.HandleFunc("GET /admin/pages/edit/{id}", logHandler(app.requireAuth(roleEditor, app.handleEditPage)))
+	mux.HandleFunc("POST /admin/pages/edit/{id}", logHandler(app.requireAuth(roleEditor, app.handleEditPage)))
+	mux.HandleFunc("POST /admin/pages/delete", logHandler(app.requireAuth(roleEditor, app.handleDeletePage)))
+	mux.HandleFunc("GET /admin/pages/revisions/{id}", logHandler(app.requireAuth(roleEditor, app.handleRevisions("page"))))
+	mux.HandleFunc("GET /admin/pages/revisions/{id}/diff", logHandler(app.requireAuth(roleEditor, app.handleRevisionDiff("page"))))
+	mux.HandleFunc("POST /admin/pages/revisions/{id}/restore", logHandler(app.requireAuth(roleEditor, app.handleRestoreRevision("page"))))
+	mux.HandleFunc("GET /admin/deleted", logHandler(app.requireAuth(roleEditor, app.handleDeletedContent)))
+	mux.HandleFunc("POST /admin/deleted/purge", logHandler(app.requireAuth(roleOwner, app.handlePurgeDeleted)))
+	mux.HandleFunc("GET /admin/redirects", logHandler(app.requireAuth(roleEditor, app.handleAdminRedirects)))
+	mux.HandleFunc("POST /admin/redirects/new", logHandler(app.requireAuth(roleEditor, app.handleNewRedirect)))
+	mux.HandleFunc("POST /admin/redirects/delete", logHandler(app.requireAuth(roleEditor, app.handleDeleteRedirect)))
+	mux.HandleFunc("GET /admin/tags", logHandler(app.requireAuth(roleEditor, app.handleAdminTags)))
+	mux.HandleFunc("GET /admin/tags/edit/{id}", logHandler(app.requireAuth(roleEditor, app.handleEditTag)))
+	mux.HandleFunc("POST /admin/tags/edit/{id}", logHandler(app.requireAuth(roleEditor, app.handleEditTag)))
+	mux.HandleFunc("POST /admin/tags/merge", logHandler(app.requireAuth(roleEditor, app.handleMergeTags)))
+	mux.HandleFunc("POST /admin/tags/delete-orphans", logHandler(app.requireAuth(roleEditor, app.handleDeleteOrphanTags)))
+	mux.HandleFunc("GET /admin/users", logHandler(app.requireAuth(roleOwner, app.handleAdminUsers)))
+	mux.HandleFunc("POST /admin/users/invite", logHandler(app.requireAuth(roleOwner, app.handleInviteUser)))
+	mux.HandleFunc("POST /admin/users/role", logHandler(app.requireAuth(roleOwner, app.handleUserRole)))
+	mux.HandleFunc("POST /admin/users/disable", logHandler(app.requireAuth(roleOwner, app.handleDisableUser)))
+	mux.HandleFunc("POST /admin/users/enable", logHandler(app.requireAuth(roleOwner, app.handleEnableUser)))
+	mux.HandleFunc("POST /admin/users/reset", logHandler(app.requireAuth(roleOwner, app.handleResetUserPassword)))
+	mux.HandleFunc("GET /invite/{token}", logHandler(app.handleAcceptInvite))
+	mux.HandleFunc("POST /invite/{token}", logHandler(app.handleAcceptInvite))
+	mux.HandleFunc("GET /reset/{token}", logHandler(app.handlePasswordReset))
+	mux.HandleFunc("POST /reset/{token}", logHandler(app.handlePasswordReset))
 
 	// Other routes
 	mux.HandleFunc("GET /sitemap.xml", logHandler(app.handleSitemap))
 	mux.HandleFunc("GET /robots.txt", logHandler(app.handleRobotsTxt))
 	mux.HandleFunc("GET /search", logHandler(app.handleSearch))
 
-	srv := &http.Server{
-		Addr:         ":8080",
-		Handler:      mux,
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-	}
-
-	log.Printf("Server starting on http://localhost%s\n", srv.Addr)
-	log.Fatal(srv.ListenAndServe())
+	return mux
 }
 
 func (app *App) loadTemplates() error {
@@ -192,39 +306,149 @@ func (app *App) loadTemplates() error {
 	return err
 }
 
+// initMarkdown sets up two renderers that differ only in raw HTML: markdown
+// passes it through, escaped drops it along with javascript: links.
 func (app *App) initMarkdown() {
-	app.markdown = goldmark.New(
-		goldmark.WithExtensions(
-			extension.GFM,
-			extension.Typographer,
-		),
-		goldmark.WithParserOptions(
-			parser.WithAutoHeadingID(),
-		),
-		goldmark.WithRendererOptions(
-			html.WithHardWraps(),
-			html.WithXHTML(),
-			html.WithUnsafe(),
-		),
-	)
+	newMarkdown := func(rendererOptions ...renderer.Option) goldmark.Markdown {
+		return goldmark.New(
+			goldmark.WithExtensions(
+				extension.GFM,
+				extension.Typographer,
+			),
+			goldmark.WithParserOptions(
+				parser.WithAutoHeadingID(),
+				parser.WithASTTransformers(util.Prioritized(mediaImages{app}, 500)),
+			),
+			goldmark.WithRendererOptions(append([]renderer.Option{
+				html.WithHardWraps(),
+				html.WithXHTML(),
+			}, rendererOptions...)...),
+		)
+	}
+	app.markdown = newMarkdown(html.WithUnsafe())
+	app.escaped = newMarkdown()
 }
 
-func (app *App) markdownToHTML(md string) template.HTML {
+// markdownToHTML renders Markdown, keeping any raw HTML in it only when
+// rawHTML is set. See rawHTMLAllowed for who gets to do that.
+func (app *App) markdownToHTML(md string, rawHTML bool) template.HTML {
+	converter := app.escaped
+	if rawHTML {
+		converter = app.markdown
+	}
 	var buf strings.Builder
-	if err := app.markdown.Convert([]byte(md), &buf); err != nil {
+	if err := converter.Convert([]byte(md), &buf); err != nil {
 		return template.HTML("")
 	}
 	return template.HTML(buf.String())
 }
 
-func (app *App) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+// renderContentHTML refreshes the stored HTML of posts and pages, and the
+// summaries of posts, returning how many rows changed. Unless all is set,
+// only rows that have never been rendered are looked at.
+func (app *App) renderContentHTML(all bool) (int, error) {
+	where := ""
+	if !all {
+		where = "p.content_html = '' AND p.content != ''"
+	}
+
+	changed := 0
+	for _, table := range []string{"posts", "pages"} {
+		n, err := app.renderTableHTML(table, where)
+		changed += n
+		if err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+// renderTableHTML re-renders the posts or pages (aliased p) matching where,
+// or all of them when it's empty, and returns how many changed.
+func (app *App) renderTableHTML(table, where string, args ...any) (int, error) {
+	// Pages have no summary, so theirs always comes back empty. Only editors
+	// can write pages, so their HTML is always kept
+	query := "SELECT p.id, p.content, p.content_html, '', '', '' FROM pages p"
+	if table == "posts" {
+		query = `SELECT p.id, p.content, p.content_html, p.summary, p.summary_html, COALESCE(u.role, '')
+		         FROM posts p LEFT JOIN users u ON u.id = p.author_id`
+	}
+	if where != "" {
+		query += " WHERE " + where
+	}
+	rows, err := app.db.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	type renderedHTML struct{ content, summary string }
+	rendered := map[int]renderedHTML{}
+	for rows.Next() {
+		var id int
+		var content, storedHTML, summary, storedSummary, authorRole string
+		if err := rows.Scan(&id, &content, &storedHTML, &summary, &storedSummary, &authorRole); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		rawHTML := table == "pages" || hasRole(authorRole, roleEditor)
+		html := renderedHTML{content: string(app.markdownToHTML(content, rawHTML))}
+		if table == "posts" {
+			html.summary = app.summaryHTML(summary, content, rawHTML)
+		}
+		if html.content != storedHTML || html.summary != storedSummary {
+			rendered[id] = html
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for id, html := range rendered {
+		query := "UPDATE pages SET content_html = ? WHERE id = ?"
+		args := []any{html.content, id}
+		if table == "posts" {
+			query = "UPDATE posts SET content_html = ?, summary_html = ? WHERE id = ?"
+			args = []any{html.content, html.summary, id}
+		}
+		if _, err := tx.Exec(query, args...); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(rendered), nil
+}
+
+// requireAuth only lets signed in users with at least the given role through.
+func (app *App) requireAuth(role string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("auth_token")
-		if err != nil || cookie.Value == "" {
+		session, token, err := app.lookupSession(r)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if session == nil {
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
 		}
-		next(w, r)
+		if !hasRole(session.Role, role) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		if err := app.touchSession(w, session, token); err != nil {
+			log.Printf("ERROR: Failed to refresh session %d: %v", session.ID, err)
+		}
+
+		next(w, withSession(r, session))
 	}
 }
 
@@ -248,9 +472,12 @@ func (app *App) httpError(w http.ResponseWriter, err error, code int) {
 	http.Error(w, http.StatusText(code), code)
 }
 
-func (app *App) validateCSRF(r *http.Request) bool {
-	token := r.FormValue("csrf_token")
-	return token == app.csrfToken
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
 }
 
 func generateToken() string {
@@ -260,27 +487,26 @@ func generateToken() string {
 }
 
 func (app *App) isAuthenticated(r *http.Request) bool {
-	cookie, err := r.Cookie("auth_token")
-	return err == nil && cookie.Value != ""
+	return app.currentSession(r) != nil
 }
 
-func (app *App) getPostTags(postID int) []string {
+func (app *App) getPostTags(postID int) []Tag {
 	rows, err := app.db.Query(`
-		SELECT t.name
+		SELECT t.id, t.name, t.slug
 		FROM tags t
 		JOIN post_tags pt ON t.id = pt.tag_id
 		WHERE pt.post_id = ?
 		ORDER BY t.name asc
 	`, postID)
 	if err != nil {
-		return []string{}
+		return []Tag{}
 	}
 	defer rows.Close()
 
-	var tags []string
+	var tags []Tag
 	for rows.Next() {
-		var tag string
-		if err := rows.Scan(&tag); err != nil {
+		var tag Tag
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Slug); err != nil {
 			continue
 		}
 		tags = append(tags, tag)
@@ -288,6 +514,14 @@ func (app *App) getPostTags(postID int) []string {
 	return tags
 }
 
+func tagNames(tags []Tag) []string {
+	names := make([]string, len(tags))
+	for i, tag := range tags {
+		names[i] = tag.Name
+	}
+	return names
+}
+
 func titleCase(str string) string {
 	if str == "" {
 		return ""
@@ -3,325 +3,702 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
-	"os"
 	"path"
 	"path/filepath"
-	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
-const MAX_UPLOAD_SIZE = 10 << 20 // 10 MB
-
-type BunnyFile struct {
-	Guid            string `json:"Guid"`
-	StorageZoneName string `json:"StorageZoneName"`
-	Path            string `json:"Path"`
-	ObjectName      string `json:"ObjectName"`
-	Length          int64  `json:"Length"`
-	LastChanged     string `json:"LastChanged"`
-	IsDirectory     bool   `json:"IsDirectory"`
-	ServerId        int    `json:"ServerId"`
-	UserId          string `json:"UserId"`
-	DateCreated     string `json:"DateCreated"`
-	StorageZoneId   int64  `json:"StorageZoneId"`
+const (
+	MAX_UPLOAD_SIZE  = 10 << 20 // 10 MB
+	MAX_UPLOAD_FILES = 10
+
+	// uploadTimeout replaces the server's timeouts for an upload, which has
+	// up to 100 MB to receive and images to resize
+	uploadTimeout = 10 * time.Minute
+)
+
+// Media is a file in the media library.
+type Media struct {
+	ID             int
+	Path           string
+	URL            string
+	ThumbnailURL   string
+	Checksum       string
+	UploadChecksum string
+	MimeType       string
+	Size           int64
+	Width          int
+	Height         int
+	AltText        string
+	Caption        string
+	Uploader       string
+	Uses           int
+	CreatedAt      time.Time
+}
+
+func (m Media) FormattedSize() string {
+	return formatBytes(m.Size)
+}
+
+func (m Media) IsImage() bool {
+	return strings.HasPrefix(m.MimeType, "image/")
+}
+
+var markdownText = strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`)
+
+// Markdown is ready to paste into a post: the image itself, or a link to any
+// other kind of file.
+func (m Media) Markdown() string {
+	if m.IsImage() {
+		return "![" + markdownText.Replace(m.AltText) + "](" + m.URL + ")"
+	}
+	return "[" + markdownText.Replace(path.Base(m.Path)) + "](" + m.URL + ")"
 }
 
-type BunnyConfig struct {
-	StorageZone   string
-	AccessKey     string
-	StorageRegion string
-	PullZoneURL   string
+// MediaUse is a post or page that mentions a media file.
+type MediaUse struct {
+	ContentType string
+	ContentID   int
+	Title       string
 }
 
-// BunnyClient handles API requests to Bunny.net
-type BunnyClient struct {
-	config BunnyConfig
-	client *http.Client
+func (u MediaUse) EditURL() string {
+	return "/admin/" + u.ContentType + "s/edit/" + strconv.Itoa(u.ContentID)
 }
 
-// NewBunnyClient creates a new Bunny.net storage client
-func NewBunnyClient() *BunnyClient {
-	return &BunnyClient{
-		config: BunnyConfig{
-			StorageZone:   os.Getenv("STORAGE_ZONE"),
-			AccessKey:     os.Getenv("ACCESS_KEY"),
-			StorageRegion: os.Getenv("REGION"),
-			PullZoneURL:   os.Getenv("PULL_ZONE_URL"),
-		},
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+const mediaColumns = `
+	m.id, m.path, m.checksum, m.upload_checksum, m.mime_type, m.size, m.width, m.height, m.alt_text, m.caption,
+	COALESCE(u.username, ''), (SELECT COUNT(*) FROM media_usage mu WHERE mu.media_id = m.id), m.created_at,
+	COALESCE((SELECT v.path FROM media_variants v WHERE v.media_id = m.id AND v.thumbnail), '')
+`
+
+func (app *App) scanMedia(row interface{ Scan(...any) error }) (Media, error) {
+	var m Media
+	var thumbnail string
+	err := row.Scan(&m.ID, &m.Path, &m.Checksum, &m.UploadChecksum, &m.MimeType, &m.Size, &m.Width, &m.Height, &m.AltText, &m.Caption, &m.Uploader, &m.Uses, &m.CreatedAt, &thumbnail)
+	m.URL = app.media.URL(m.Path)
+	m.ThumbnailURL = m.URL
+	if thumbnail != "" {
+		m.ThumbnailURL = app.media.URL(thumbnail)
 	}
+	return m, err
+}
+
+// MediaVariant is a resized copy of an image in the library.
+type MediaVariant struct {
+	Path      string
+	URL       string
+	Width     int
+	Height    int
+	Thumbnail bool
+}
+
+func (app *App) mediaVariants(mediaID int) ([]MediaVariant, error) {
+	rows, err := app.db.Query("SELECT path, width, height, thumbnail FROM media_variants WHERE media_id = ? ORDER BY thumbnail, width", mediaID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variants []MediaVariant
+	for rows.Next() {
+		var v MediaVariant
+		if err := rows.Scan(&v.Path, &v.Width, &v.Height, &v.Thumbnail); err != nil {
+			return nil, err
+		}
+		v.URL = app.media.URL(v.Path)
+		variants = append(variants, v)
+	}
+	return variants, rows.Err()
+}
+
+func (app *App) getMedia(id int) (Media, error) {
+	return app.scanMedia(app.db.QueryRow(`
+		SELECT `+mediaColumns+`
+		FROM media m
+		LEFT JOIN users u ON u.id = m.user_id
+		WHERE m.id = ?
+	`, id))
+}
+
+// mediaUses lists the posts and pages that mention a file.
+func (app *App) mediaUses(mediaID int) ([]MediaUse, error) {
+	rows, err := app.db.Query(`
+		SELECT mu.content_type, mu.content_id, COALESCE(NULLIF(p.title, ''), p.slug)
+		FROM media_usage mu
+		JOIN posts p ON p.id = mu.content_id
+		WHERE mu.media_id = ? AND mu.content_type = 'post'
+		UNION ALL
+		SELECT mu.content_type, mu.content_id, pg.title
+		FROM media_usage mu
+		JOIN pages pg ON pg.id = mu.content_id
+		WHERE mu.media_id = ? AND mu.content_type = 'page'
+		ORDER BY 1, 3
+	`, mediaID, mediaID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uses []MediaUse
+	for rows.Next() {
+		var u MediaUse
+		if err := rows.Scan(&u.ContentType, &u.ContentID, &u.Title); err != nil {
+			return nil, err
+		}
+		uses = append(uses, u)
+	}
+	return uses, rows.Err()
+}
+
+// updateMediaUsage records which files a post or page mentions, replacing
+// what was recorded for it before. text is everything the content shows.
+func updateMediaUsage(tx *sql.Tx, contentType string, id int, text string) error {
+	if _, err := tx.Exec("DELETE FROM media_usage WHERE content_type = ? AND content_id = ?", contentType, id); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO media_usage (media_id, content_type, content_id)
+		SELECT id, ?, ? FROM media WHERE instr(?, path) > 0
+	`, contentType, id, text)
+	return err
+}
+
+// scanMediaUsage rebuilds the usage of every file from every post and page.
+// Saves keep it up to date, so this is only needed after a sync.
+func scanMediaUsage(tx *sql.Tx) error {
+	if _, err := tx.Exec("DELETE FROM media_usage"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO media_usage (media_id, content_type, content_id)
+		SELECT m.id, 'post', p.id FROM media m JOIN posts p ON instr(p.content || char(10) || p.summary, m.path) > 0
+		UNION ALL
+		SELECT m.id, 'page', pg.id FROM media m JOIN pages pg ON instr(pg.content, m.path) > 0
+	`)
+	return err
 }
 
 func (app *App) handleAdminMedia(w http.ResponseWriter, r *http.Request) {
-	client := NewBunnyClient()
-	files, err := client.GetAllFilesRecursively("")
+	app.renderMedia(w, r, http.StatusOK, nil)
+}
+
+// renderMedia shows the media library, merging in any one-off values like
+// an error from a delete.
+func (app *App) renderMedia(w http.ResponseWriter, r *http.Request, status int, extra map[string]any) {
+	rows, err := app.db.Query(`
+		SELECT ` + mediaColumns + `
+		FROM media m
+		LEFT JOIN users u ON u.id = m.user_id
+		ORDER BY m.created_at DESC, m.id DESC
+	`)
 	if err != nil {
 		app.httpError(w, err, http.StatusInternalServerError)
 		return
 	}
+	defer rows.Close()
 
-	type FileDisplay struct {
-		BunnyFile
-		FormattedSize string
+	var files []Media
+	var totalSize int64
+	for rows.Next() {
+		m, err := app.scanMedia(rows)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		totalSize += m.Size
+		files = append(files, m)
+	}
+	if err := rows.Err(); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
 	}
 
-	var displayFiles []FileDisplay
-	var totalSize int64
-	var totalDirs, totalFiles int
+	data := map[string]any{
+		"Files":      files,
+		"TotalFiles": len(files),
+		"TotalSize":  formatBytes(totalSize),
+		"CanDelete":  hasRole(app.currentSession(r).Role, roleEditor),
+		"CSRFToken":  app.csrfToken(w, r),
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
 
-	for _, file := range files {
-		if file.IsDirectory {
-			totalDirs++
-		} else {
-			totalFiles++
-			totalSize += file.Length
-		}
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
 
-		displayFiles = append(displayFiles, FileDisplay{
-			BunnyFile:     file,
-			FormattedSize: formatBytes(file.Length),
-		})
+	err = app.templates["admin_media.html"].ExecuteTemplate(w, "admin_base", data)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
 	}
+}
 
-	// Sort by created date (newest first)
-	sort.Slice(displayFiles, func(i, j int) bool {
-		return displayFiles[i].DateCreated > displayFiles[j].DateCreated
-	})
+// mediaTypes are the kinds of file the library accepts, by the type
+// http.DetectContentType sniffs from their contents, and the extension each
+// is stored under. SVG is left out because it can carry scripts.
+var mediaTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+	"video/mp4":       ".mp4",
+	"video/webm":      ".webm",
+	"audio/mpeg":      ".mp3",
+}
+
+const mediaTypesHelp = "You can upload JPEG, PNG, GIF and WebP images, PDFs, MP4 and WebM videos, and MP3s."
 
+// renderMediaForm shows the upload form, with any error and the values
+// already filled in merged in from extra.
+func (app *App) renderMediaForm(w http.ResponseWriter, r *http.Request, status int, extra map[string]any) {
 	data := map[string]any{
-		"Files":            displayFiles,
-		"TotalItems":       len(files),
-		"TotalDirectories": totalDirs,
-		"TotalFiles":       totalFiles,
-		"TotalSize":        formatBytes(totalSize),
-		"CSRFToken":        app.csrfToken,
+		"CSRFToken": app.csrfToken(w, r),
+		"MaxSize":   formatBytes(MAX_UPLOAD_SIZE),
+		"MaxFiles":  MAX_UPLOAD_FILES,
+		"TypesHelp": mediaTypesHelp,
+	}
+	for k, v := range extra {
+		data[k] = v
 	}
 
-	err = app.templates["admin_media.html"].ExecuteTemplate(w, "admin_base", data)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+
+	err := app.templates["admin_media_form.html"].ExecuteTemplate(w, "admin_base", data)
 	if err != nil {
 		app.httpError(w, err, http.StatusInternalServerError)
 		return
 	}
 }
 
+// mediaUpload is how one uploaded file turned out, for the JSON response.
+type mediaUpload struct {
+	Name      string `json:"name"`
+	ID        int    `json:"id,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Markdown  string `json:"markdown,omitempty"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleNewMedia takes one or more files in the image field. Browsers posting
+// the form get the library or the form back. Scripts that ask for JSON get
+// the URL and a Markdown snippet for each file, which is how the editors
+// upload inline.
 func (app *App) handleNewMedia(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		data := map[string]any{
-			"CSRFToken": app.csrfToken,
-		}
+		app.renderMediaForm(w, r, http.StatusOK, nil)
+		return
+	}
 
-		err := app.templates["admin_media_form.html"].ExecuteTemplate(w, "admin_base", data)
-		if err != nil {
-			app.httpError(w, err, http.StatusInternalServerError)
+	wantsJSON := strings.Contains(r.Header.Get("Accept"), "application/json")
+	fail := func(status int, problem string) {
+		if wantsJSON {
+			writeJSON(w, status, map[string]any{"error": problem})
 			return
 		}
-		return
+		app.renderMediaForm(w, r, status, map[string]any{
+			"Error":   problem,
+			"AltText": r.FormValue("alt_text"),
+			"Caption": r.FormValue("caption"),
+		})
 	}
 
-	bunnyClient := NewBunnyClient()
+	deadline := time.Now().Add(uploadTimeout)
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(deadline); err != nil {
+		log.Printf("ERROR: Failed to extend the upload's read deadline: %v", err)
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		log.Printf("ERROR: Failed to extend the upload's write deadline: %v", err)
+	}
 
-	// Limit upload size
-	r.Body = http.MaxBytesReader(w, r.Body, MAX_UPLOAD_SIZE)
+	// Limit upload size. Each file is checked against MAX_UPLOAD_SIZE below
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_UPLOAD_SIZE*MAX_UPLOAD_FILES)
 
 	// Parse multipart form
 	err := r.ParseMultipartForm(MAX_UPLOAD_SIZE)
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		fail(http.StatusRequestEntityTooLarge, "That's too much to upload at once. Uploads can be at most "+formatBytes(MAX_UPLOAD_SIZE*MAX_UPLOAD_FILES)+" altogether.")
+		return
+	}
 	if err != nil {
-		app.httpError(w, err, http.StatusInternalServerError)
+		fail(http.StatusBadRequest, "Invalid upload")
 		return
 	}
+	defer r.MultipartForm.RemoveAll()
 
-	// Get the file from the form
-	file, header, err := r.FormFile("image")
-	if err != nil {
-		app.httpError(w, err, http.StatusInternalServerError)
+	if !app.validateCSRF(r) {
+		fail(http.StatusForbidden, "Invalid CSRF token")
+		return
+	}
+
+	headers := r.MultipartForm.File["image"]
+	switch {
+	case len(headers) == 0:
+		fail(http.StatusBadRequest, "Choose a file to upload.")
+		return
+	case len(headers) > MAX_UPLOAD_FILES:
+		fail(http.StatusBadRequest, fmt.Sprintf("You can upload up to %d files at once.", MAX_UPLOAD_FILES))
 		return
 	}
-	defer file.Close()
 
-	// Generate unique filename
-	uniqueFilename := generateUniqueFilename(header.Filename)
+	altText := strings.TrimSpace(r.FormValue("alt_text"))
+	caption := strings.TrimSpace(r.FormValue("caption"))
+	userID := app.currentSession(r).UserID
+
+	var results []mediaUpload
+	var uploaded, duplicates []Media
+	var problems []string
+	for _, header := range headers {
+		result := mediaUpload{Name: header.Filename}
+
+		var m Media
+		var duplicate bool
+		var problem string
+		if header.Size > MAX_UPLOAD_SIZE {
+			problem = header.Filename + " is too big. Files can be at most " + formatBytes(MAX_UPLOAD_SIZE) + "."
+		} else {
+			m, duplicate, problem, err = app.saveUpload(header, altText, caption, userID)
+			if err != nil {
+				log.Printf("ERROR: Failed to upload %s: %v", header.Filename, err)
+				problem = header.Filename + " couldn't be saved. Try again."
+			}
+		}
 
-	// Upload to Bunny.net
-	_, err = uploadToBunny(bunnyClient, uniqueFilename, file)
-	if err != nil {
-		app.httpError(w, err, http.StatusInternalServerError)
+		switch {
+		case problem != "":
+			result.Error = problem
+			problems = append(problems, problem)
+		case duplicate:
+			duplicates = append(duplicates, m)
+		default:
+			uploaded = append(uploaded, m)
+		}
+		if problem == "" {
+			result.ID, result.URL, result.Markdown, result.Duplicate = m.ID, m.URL, m.Markdown(), duplicate
+		}
+		results = append(results, result)
+	}
+
+	if wantsJSON {
+		status := http.StatusOK
+		if len(problems) == len(headers) {
+			status = http.StatusBadRequest
+		}
+		writeJSON(w, status, map[string]any{"files": results})
 		return
 	}
 
-	// Success response
-	fileSize := fmt.Sprintf("%.2f KB", float64(header.Size)/1024)
-	log.Printf("Successfully uploaded: %s (%s)", uniqueFilename, fileSize)
+	if len(problems) == 0 && len(duplicates) == 0 {
+		http.Redirect(w, r, "/admin/media", http.StatusSeeOther)
+		return
+	}
 
-	http.Redirect(w, r, "/admin/media", http.StatusSeeOther)
+	status := http.StatusOK
+	if len(problems) == len(headers) {
+		status = http.StatusBadRequest
+	}
+	app.renderMediaForm(w, r, status, map[string]any{
+		"Problems":   problems,
+		"Uploaded":   uploaded,
+		"Duplicates": duplicates,
+		"AltText":    altText,
+		"Caption":    caption,
+	})
 }
 
-// uploadImageToBunny uploads an image to BunnyCDN storage and returns the public CDN URL
-func uploadToBunny(bc *BunnyClient, filename string, file io.Reader) (string, error) {
-
-	// Read the data into a buffer so we can calculate checksum and upload
-	buf := new(bytes.Buffer)
-	if _, err := io.Copy(buf, file); err != nil {
-		return "", fmt.Errorf("failed to read image data: %w", err)
+// saveUpload checks an uploaded file and adds it to the store and the
+// library. A file that's already in the library isn't stored twice: the
+// existing one comes back with duplicate set. Anything wrong with the file
+// itself is returned as a problem for the uploader to fix.
+func (app *App) saveUpload(header *multipart.FileHeader, altText, caption string, userID int) (m Media, duplicate bool, problem string, err error) {
+	file, err := header.Open()
+	if err != nil {
+		return Media{}, false, "", err
 	}
-	imageData := buf.Bytes()
+	defer file.Close()
 
-	// Calculate SHA256 checksum for integrity verification
-	hash := sha256.Sum256(imageData)
-	checksum := hex.EncodeToString(hash[:])
-
-	// Generate a unique path for the image
-	now := time.Now()
-	remotePath := fmt.Sprintf("%d/%s", now.Year(), filename)
-
-	// Construct the storage API endpoint
-	// Format: https://{region}.storage.bunnycdn.com/{storageZoneName}/{path}
-	apiURL := fmt.Sprintf("https://%s.storage.bunnycdn.com/%s/%s",
-		bc.config.StorageRegion,
-		bc.config.StorageZone,
-		remotePath,
-	)
-
-	// Create the PUT request
-	req, err := http.NewRequest("PUT", apiURL, bytes.NewReader(imageData))
+	data, err := io.ReadAll(file)
 	if err != nil {
-		return "", fmt.Errorf("Failed to create request: %w", err)
+		return Media{}, false, "", err
+	}
+	if len(data) == 0 {
+		return Media{}, false, header.Filename + " is empty.", nil
 	}
 
-	// Set required headers
-	req.Header.Set("AccessKey", bc.config.AccessKey)
-	req.Header.Set("Content-Type", "application/octet-stream")
-	req.Header.Set("Checksum", checksum)
+	// The type comes from the contents, never the name or the browser
+	mimeType := http.DetectContentType(data)
+	ext, ok := mediaTypes[mimeType]
+	if !ok {
+		return Media{}, false, header.Filename + " doesn't look like a file the library takes (it reads as " + mimeType + "). " + mediaTypesHelp, nil
+	}
 
-	resp, err := bc.client.Do(req)
+	// Duplicates are spotted by the file as uploaded, before any of the
+	// work below
+	sum := sha256.Sum256(data)
+	uploadChecksum := hex.EncodeToString(sum[:])
+
+	existing, err := app.findUpload(uploadChecksum)
+	if err == nil {
+		return existing, true, "", nil
+	}
+	if err != sql.ErrNoRows {
+		return Media{}, false, "", err
+	}
+
+	// JPEGs and PNGs lose their metadata and get resized copies, and WebP
+	// images lose their metadata. Other formats are stored as they are, with
+	// dimensions if the image package can read them
+	var width, height int
+	var variants []imageVariant
+	processed, err := processImage(data, mimeType)
+	if errors.Is(err, errTooManyPixels) {
+		return Media{}, false, header.Filename + " has too many pixels: " + err.Error() + ".", nil
+	}
+	if err == nil && mimeType == "image/webp" {
+		data, err = stripWebPMetadata(data)
+	}
 	if err != nil {
-		return "", fmt.Errorf("Failed to upload to BunnyCDN: %w", err)
+		return Media{}, false, header.Filename + " couldn't be read as an image: " + err.Error(), nil
+	}
+	if processed != nil {
+		data, width, height, variants = processed.Data, processed.Width, processed.Height, processed.Variants
+	} else if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		width, height = config.Width, config.Height
 	}
-	defer resp.Body.Close()
 
-	// Check for successful upload (201 Created)
-	if resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("Upload failed with status %d: %s", resp.StatusCode, string(body))
+	// Calculate SHA256 checksum for integrity verification
+	sum = sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+
+	// Files are grouped by year under a unique name. Several uploads with the
+	// same name in the same second, like pasted screenshots, get numbered
+	name := fmt.Sprintf("%d/%s", time.Now().Year(), generateUniqueFilename(header.Filename, ext))
+	for n, base := 2, name; ; n++ {
+		var taken bool
+		err := app.db.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM media WHERE path = ?)
+			    OR EXISTS (SELECT 1 FROM media_variants WHERE path = ?)
+		`, name, name).Scan(&taken)
+		if err != nil {
+			return Media{}, false, "", err
+		}
+		if !taken {
+			break
+		}
+		name = variantPath(base, "-"+strconv.Itoa(n))
 	}
 
-	// Construct and return the public CDN URL
-	cdnURL := fmt.Sprintf("%s/%s", bc.config.PullZoneURL, remotePath)
+	// Anything stored before a failure is removed again
+	var stored []string
+	cleanUp := func() {
+		for _, p := range stored {
+			if err := app.media.Delete(p); err != nil {
+				log.Printf("ERROR: Failed to remove %s after a failed upload: %v", p, err)
+			}
+		}
+	}
 
-	return cdnURL, nil
-}
+	if err := app.media.Put(name, mimeType, bytes.NewReader(data)); err != nil {
+		return Media{}, false, "", err
+	}
+	stored = append(stored, name)
 
-func generateUniqueFilename(originalFilename string) string {
-	ext := filepath.Ext(originalFilename)
-	nameWithoutExt := strings.TrimSuffix(originalFilename, ext)
+	for _, v := range variants {
+		p := variantPath(name, v.Suffix)
+		if err := app.media.Put(p, mimeType, bytes.NewReader(v.Data)); err != nil {
+			cleanUp()
+			return Media{}, false, "", err
+		}
+		stored = append(stored, p)
+	}
 
-	// Clean the filename (remove special characters)
-	nameWithoutExt = strings.Map(func(r rune) rune {
-		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
-			return r
+	m = Media{
+		Path:           name,
+		URL:            app.media.URL(name),
+		Checksum:       checksum,
+		UploadChecksum: uploadChecksum,
+		MimeType:       mimeType,
+		Size:           int64(len(data)),
+		Width:          width,
+		Height:         height,
+		AltText:        altText,
+		Caption:        caption,
+	}
+	if m.ID, err = app.recordMedia(m, variants, userID); err != nil {
+		// Don't leave files behind that the library doesn't know about
+		cleanUp()
+		if !errors.Is(err, errDuplicateUpload) {
+			return Media{}, false, "", err
 		}
-		return '_'
-	}, nameWithoutExt)
+		// The same file was uploaded again while this one was processed
+		existing, err := app.findUpload(uploadChecksum)
+		return existing, err == nil, "", err
+	}
 
-	// Add timestamp to make it unique
-	timestamp := time.Now().Unix()
-	return fmt.Sprintf("%s_%d%s", nameWithoutExt, timestamp, ext)
+	log.Printf("Successfully uploaded: %s (%s)", name, formatBytes(m.Size))
+	return m, false, "", nil
 }
 
-// formatBytes converts bytes to human-readable format
-func formatBytes(bytes int64) string {
-	const unit = 1024
-	if bytes < unit {
-		return fmt.Sprintf("%d B", bytes)
-	}
-	div, exp := int64(unit), 0
-	for n := bytes / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
-	}
-	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+// findUpload looks for a file in the library that was uploaded, or stored,
+// with the given SHA-256 checksum.
+func (app *App) findUpload(checksum string) (Media, error) {
+	return app.scanMedia(app.db.QueryRow(`
+		SELECT `+mediaColumns+`
+		FROM media m
+		LEFT JOIN users u ON u.id = m.user_id
+		WHERE m.upload_checksum = ? OR m.checksum = ?
+		ORDER BY m.id LIMIT 1
+	`, checksum, checksum))
 }
 
-// ListFiles retrieves files from a specific path in the storage zone
-func (bc *BunnyClient) ListFiles(folderPath string) ([]BunnyFile, error) {
-	// Construct the URL
-	url := fmt.Sprintf("https://%s.storage.bunnycdn.com/%s/%s", bc.config.StorageRegion, bc.config.StorageZone, folderPath)
+var errDuplicateUpload = errors.New("the file is already in the library")
 
-	// Create the request
-	req, err := http.NewRequest("GET", url, nil)
+// recordMedia adds an uploaded file and its variants to the library, along
+// with any posts and pages that already mention it, and returns its ID. It
+// returns errDuplicateUpload if a file with the same upload checksum got
+// there first.
+func (app *App) recordMedia(m Media, variants []imageVariant, userID int) (int, error) {
+	tx, err := app.db.Begin()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return 0, err
 	}
+	defer tx.Rollback()
 
-	// Add the AccessKey header
-	req.Header.Add("AccessKey", bc.config.AccessKey)
-	req.Header.Add("Accept", "application/json")
+	var uid any
+	if userID != 0 {
+		uid = userID
+	}
 
-	// Execute the request
-	resp, err := bc.client.Do(req)
+	result, err := tx.Exec(`
+		INSERT INTO media (path, checksum, upload_checksum, mime_type, size, width, height, alt_text, caption, user_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(upload_checksum) WHERE upload_checksum != '' DO NOTHING
+	`, m.Path, m.Checksum, m.UploadChecksum, m.MimeType, m.Size, m.Width, m.Height, m.AltText, m.Caption, uid)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %w", err)
+		return 0, err
+	}
+	if n == 0 {
+		return 0, errDuplicateUpload
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
 	}
-	defer resp.Body.Close()
 
-	// Check response status
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+	for _, v := range variants {
+		_, err := tx.Exec(`
+			INSERT INTO media_variants (media_id, path, width, height, thumbnail)
+			VALUES (?, ?, ?, ?, ?)
+		`, id, variantPath(m.Path, v.Suffix), v.Width, v.Height, v.Thumbnail)
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	// Parse the response
-	var files []BunnyFile
-	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	_, err = tx.Exec(`
+		INSERT INTO media_usage (media_id, content_type, content_id)
+		SELECT ?, 'post', id FROM posts WHERE instr(content || char(10) || summary, ?) > 0
+		UNION ALL
+		SELECT ?, 'page', id FROM pages WHERE instr(content, ?) > 0
+	`, id, m.Path, id, m.Path)
+	if err != nil {
+		return 0, err
 	}
 
-	return files, nil
+	return int(id), tx.Commit()
 }
 
-// GetAllFilesRecursively fetches all files recursively from the storage zone
-func (bc *BunnyClient) GetAllFilesRecursively(startPath string) ([]BunnyFile, error) {
-	var allFiles []BunnyFile
+func (app *App) handleEditMedia(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.PathValue("id"))
 
-	// Helper function for recursive traversal
-	var traverse func(currentPath string) error
-	traverse = func(currentPath string) error {
-		files, err := bc.ListFiles(currentPath)
-		if err != nil {
-			return err
+	m, err := app.getMedia(id)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	canEdit, err := app.canEditMedia(app.currentSession(r), id)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "POST" {
+		if !app.validateCSRF(r) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if !canEdit {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
 		}
 
-		for _, file := range files {
-			// Add the file to our collection
-			allFiles = append(allFiles, file)
-
-			// If it's a directory, recursively fetch its contents
-			if file.IsDirectory {
-				// Construct the subdirectory path
-				subPath := path.Join(currentPath, file.ObjectName) + "/"
-				if err := traverse(subPath); err != nil {
-					return err
-				}
-			}
+		altText := strings.TrimSpace(r.FormValue("alt_text"))
+		caption := strings.TrimSpace(r.FormValue("caption"))
+		if _, err := app.db.Exec("UPDATE media SET alt_text = ?, caption = ? WHERE id = ?", altText, caption, id); err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
 		}
 
-		return nil
+		http.Redirect(w, r, "/admin/media", http.StatusSeeOther)
+		return
 	}
 
-	// Start the recursive traversal
-	if err := traverse(startPath); err != nil {
-		return nil, err
+	uses, err := app.mediaUses(id)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	variants, err := app.mediaVariants(id)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
 	}
 
-	return allFiles, nil
+	data := map[string]any{
+		"Media":     m,
+		"Uses":      uses,
+		"Variants":  variants,
+		"CanEdit":   canEdit,
+		"CSRFToken": app.csrfToken(w, r),
+	}
+
+	err = app.templates["admin_media_edit.html"].ExecuteTemplate(w, "admin_base", data)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
 }
 
 func (app *App) handleDeleteMedia(w http.ResponseWriter, r *http.Request) {
@@ -335,51 +712,221 @@ func (app *App) handleDeleteMedia(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	bc := NewBunnyClient()
-
-	path := r.FormValue("path")
-	filename := r.FormValue("filename")
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	m, err := app.getMedia(id)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
 
-	if path == "" {
-		filename = filename + "/"
+	variants, err := app.mediaVariants(id)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
 	}
 
-	err := bc.DeleteFile(path, filename)
+	// The row goes first, so a file that can't be removed is left orphaned
+	// rather than listed but missing. Its variants' rows go with it.
+	tx, err := app.db.Begin()
 	if err != nil {
 		app.httpError(w, err, http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
+
+	// Deleting a file a post still shows would break it
+	var used bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM media_usage WHERE media_id = ?)", id).Scan(&used); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if used {
+		// Done with the transaction; listing the uses needs the database too
+		tx.Rollback()
+		uses, err := app.mediaUses(id)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		var titles []string
+		for _, u := range uses {
+			titles = append(titles, u.Title)
+		}
+		app.renderMedia(w, r, http.StatusConflict, map[string]any{
+			"Error": "Can't delete " + m.Path + ": it's still used by " + strings.Join(titles, ", ") + ".",
+		})
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM media WHERE id = ?", id); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	paths := []string{m.Path}
+	for _, v := range variants {
+		paths = append(paths, v.Path)
+	}
+	for _, path := range paths {
+		if err := app.media.Delete(path); err != nil {
+			log.Printf("Deleted media %d, but %s is left orphaned in the media store: %v", id, path, err)
+		}
+	}
 
 	http.Redirect(w, r, "/admin/media", http.StatusSeeOther)
 }
 
-// ListFiles retrieves files from a specific path in the storage zone
-func (bc *BunnyClient) DeleteFile(path string, filename string) error {
-	// Construct the URL
-	url := fmt.Sprintf("https://%s.storage.bunnycdn.com/%s/%s%s", bc.config.StorageRegion, bc.config.StorageZone, path, filename)
+// handleSyncMedia brings the library in line with what's actually in the
+// media store: files uploaded some other way are added, rows for files that
+// are gone are removed, and usage is rescanned. Variants are left to the
+// file they belong to.
+func (app *App) handleSyncMedia(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
 
-	// Create the request
-	req, err := http.NewRequest("DELETE", url, nil)
+	files, err := app.media.List()
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
 	}
 
-	// Add the AccessKey header
-	req.Header.Add("AccessKey", bc.config.AccessKey)
-	req.Header.Add("Accept", "application/json")
+	tx, err := app.db.Begin()
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 
-	// Execute the request
-	resp, err := bc.client.Do(req)
+	variants := map[string]bool{}
+	rows, err := tx.Query("SELECT path FROM media_variants")
 	if err != nil {
-		return fmt.Errorf("failed to execute request: %w", err)
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			rows.Close()
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		variants[p] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
 	}
-	defer resp.Body.Close()
 
-	// Check response status
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+	var added, removed int64
+	stored := map[string]bool{}
+	for _, file := range files {
+		stored[file.Path] = true
+		if variants[file.Path] {
+			continue
+		}
+
+		createdAt := file.Modified
+		if createdAt.IsZero() {
+			createdAt = time.Now()
+		}
+		result, err := tx.Exec(`
+			INSERT INTO media (path, mime_type, size, created_at)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT(path) DO NOTHING
+		`, file.Path, mime.TypeByExtension(path.Ext(file.Path)), file.Size, sqlTime(createdAt))
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		n, _ := result.RowsAffected()
+		added += n
 	}
 
-	return nil
+	rows, err = tx.Query("SELECT id, path FROM media")
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	var gone []int
+	for rows.Next() {
+		var id int
+		var p string
+		if err := rows.Scan(&id, &p); err != nil {
+			rows.Close()
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !stored[p] {
+			gone = append(gone, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	for _, id := range gone {
+		if _, err := tx.Exec("DELETE FROM media WHERE id = ?", id); err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		removed++
+	}
+
+	if err := scanMediaUsage(tx); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.renderMedia(w, r, http.StatusOK, map[string]any{
+		"Message": fmt.Sprintf("Synced with storage: %d added, %d removed.", added, removed),
+	})
+}
+
+// generateUniqueFilename makes a name for an upload from the name it came
+// with, under the extension that matches what it actually contains.
+func generateUniqueFilename(originalFilename, ext string) string {
+	nameWithoutExt := strings.TrimSuffix(originalFilename, filepath.Ext(originalFilename))
+
+	// Clean the filename (remove special characters)
+	nameWithoutExt = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, nameWithoutExt)
+
+	// Add timestamp to make it unique
+	timestamp := time.Now().Unix()
+	return fmt.Sprintf("%s_%d%s", nameWithoutExt, timestamp, ext)
+}
+
+// formatBytes converts bytes to human-readable format
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
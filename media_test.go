@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newUploadApp is an App with a media library in a temporary directory and
+// an author to upload as.
+func newUploadApp(t *testing.T) (*App, *Session) {
+	t.Helper()
+	app := newTestApp(t)
+	app.media = NewLocalStore(t.TempDir())
+	app.csrfKey = []byte("test key")
+	if err := app.loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	app.initMarkdown()
+
+	result, err := app.db.Exec("INSERT INTO users (username, password, role) VALUES ('alec', '', ?)", roleAuthor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app, &Session{UserID: int(id), Username: "alec", Role: roleAuthor, CSRFToken: "session token"}
+}
+
+// uploadRequest posts files to the upload form, each under the given name.
+func uploadRequest(t *testing.T, s *Session, names []string, files [][]byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField(csrfFormField, s.CSRFToken)
+	for i, name := range names {
+		part, err := mw.CreateFormFile("image", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(files[i])
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/admin/media/new", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return withSession(r, s)
+}
+
+func TestRecordMediaDuplicate(t *testing.T) {
+	app := newTestApp(t)
+	app.media = NewLocalStore(t.TempDir())
+
+	first, err := app.recordMedia(Media{Path: "2024/a.gif", UploadChecksum: "abc", MimeType: "image/gif"}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another upload of the same file that got past the check in saveUpload
+	_, err = app.recordMedia(Media{Path: "2024/a-2.gif", UploadChecksum: "abc", MimeType: "image/gif"}, nil, 0)
+	if !errors.Is(err, errDuplicateUpload) {
+		t.Fatalf("second copy: got %v, want errDuplicateUpload", err)
+	}
+	existing, err := app.findUpload("abc")
+	if err != nil || existing.ID != first {
+		t.Errorf("findUpload = %d, %v, want %d", existing.ID, err, first)
+	}
+
+	// Files found by a sync have no upload checksum, and there can be any
+	// number of those
+	for _, path := range []string{"2024/b.gif", "2024/c.gif"} {
+		if _, err := app.recordMedia(Media{Path: path, MimeType: "image/gif"}, nil, 0); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+}
+
+func TestNewMedia(t *testing.T) {
+	app, s := newUploadApp(t)
+	picture := testPNG(t, 20, 10)
+
+	rec := httptest.NewRecorder()
+	app.handleNewMedia(rec, uploadRequest(t, s, []string{"photo.png"}, [][]byte{picture}))
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("upload: got %d, want %d\n%s", rec.Code, http.StatusSeeOther, rec.Body)
+	}
+	var count int
+	app.db.QueryRow("SELECT COUNT(*) FROM media").Scan(&count)
+	if count != 1 {
+		t.Fatalf("%d files in the library after one upload", count)
+	}
+
+	// The same file again, under another name, is shown as already there
+	rec = httptest.NewRecorder()
+	app.handleNewMedia(rec, uploadRequest(t, s, []string{"copy.png"}, [][]byte{picture}))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Already in the library") {
+		t.Errorf("duplicate: got %d\n%s", rec.Code, rec.Body)
+	}
+	app.db.QueryRow("SELECT COUNT(*) FROM media").Scan(&count)
+	if count != 1 {
+		t.Errorf("%d files in the library after a duplicate upload", count)
+	}
+
+	// The type comes from the contents, not the name
+	rec = httptest.NewRecorder()
+	app.handleNewMedia(rec, uploadRequest(t, s, []string{"notes.png"}, [][]byte{[]byte("just some notes")}))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "notes.png doesn&#39;t look like a file the library takes (it reads as text/plain") {
+		t.Errorf("text file: got %d\n%s", rec.Code, rec.Body)
+	}
+
+	// Nothing is sent without a valid token
+	r := uploadRequest(t, s, []string{"other.png"}, [][]byte{testPNG(t, 10, 10)})
+	r = withSession(r, &Session{UserID: s.UserID, Role: s.Role, CSRFToken: "another token"})
+	rec = httptest.NewRecorder()
+	app.handleNewMedia(rec, r)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("bad token: got %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestNewMediaJSON(t *testing.T) {
+	app, s := newUploadApp(t)
+	first, second := testPNG(t, 20, 10), testPNG(t, 10, 20)
+
+	upload := func(names []string, files [][]byte) (int, []mediaUpload) {
+		t.Helper()
+		r := uploadRequest(t, s, names, files)
+		r.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		app.handleNewMedia(rec, r)
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("Content-Type %q\n%s", ct, rec.Body)
+		}
+		var resp struct {
+			Files []mediaUpload `json:"files"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, resp.Files
+	}
+
+	status, files := upload([]string{"first.png", "notes.txt", "second.png"}, [][]byte{first, []byte("just some notes"), second})
+	if status != http.StatusOK || len(files) != 3 {
+		t.Fatalf("got %d, %+v", status, files)
+	}
+	// Each file gets its own result, in the order it was sent
+	for i, name := range []string{"first.png", "notes.txt", "second.png"} {
+		if files[i].Name != name {
+			t.Errorf("file %d is %q, want %q", i, files[i].Name, name)
+		}
+	}
+	for _, f := range []mediaUpload{files[0], files[2]} {
+		if f.ID == 0 || f.URL == "" || f.Error != "" || f.Duplicate {
+			t.Errorf("%s: %+v", f.Name, f)
+		}
+		if !strings.Contains(f.Markdown, "("+f.URL+")") {
+			t.Errorf("%s: Markdown %q doesn't link to %s", f.Name, f.Markdown, f.URL)
+		}
+	}
+	if f := files[1]; f.ID != 0 || f.URL != "" || !strings.Contains(f.Error, "notes.txt doesn't look like") {
+		t.Errorf("notes.txt: %+v", f)
+	}
+
+	// Sending the first again points at the one already uploaded
+	want := files[0]
+	want.Name, want.Duplicate = "again.png", true
+	status, files = upload([]string{"again.png"}, [][]byte{first})
+	if status != http.StatusOK || len(files) != 1 || files[0] != want {
+		t.Errorf("duplicate: got %d, %+v, want %+v", status, files, want)
+	}
+
+	// When nothing could be uploaded the request failed as a whole
+	status, files = upload([]string{"a.txt", "b.txt"}, [][]byte{[]byte("a"), []byte("b")})
+	if status != http.StatusBadRequest || len(files) != 2 || files[0].Error == "" || files[1].Error == "" {
+		t.Errorf("all bad: got %d, %+v", status, files)
+	}
+}
+
+// zeros reads as an endless run of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestNewMediaTooLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sends over 100 MB")
+	}
+	app, s := newUploadApp(t)
+
+	// The body is cut off before the form ends, so only the size limit can
+	// stop it
+	head := "--b\r\nContent-Disposition: form-data; name=\"image\"; filename=\"huge.png\"\r\nContent-Type: image/png\r\n\r\n"
+	body := io.MultiReader(strings.NewReader(head), io.LimitReader(zeros{}, MAX_UPLOAD_SIZE*MAX_UPLOAD_FILES+1))
+	r := httptest.NewRequest("POST", "/admin/media/new", body)
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=b")
+	r = withSession(r, s)
+
+	rec := httptest.NewRecorder()
+	app.handleNewMedia(rec, r)
+	if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), "too much to upload at once") {
+		t.Errorf("got %d\n%s", rec.Code, rec.Body)
+	}
+}
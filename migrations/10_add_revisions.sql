@@ -0,0 +1,28 @@
+-- Snapshots of posts and pages, one per save. content_type is 'post' or 'page'
+CREATE TABLE IF NOT EXISTS revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    content_type TEXT NOT NULL,
+    content_id INTEGER NOT NULL,
+    title TEXT,
+    slug TEXT NOT NULL,
+    content TEXT NOT NULL,
+    post_type TEXT,
+    tags TEXT NOT NULL DEFAULT '',
+    published BOOLEAN NOT NULL DEFAULT 0,
+    user_id INTEGER,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_revisions_content ON revisions(content_type, content_id);
+
+-- Start every existing post and page off with its current state
+INSERT INTO revisions (content_type, content_id, title, slug, content, post_type, tags, published, user_id, created_at)
+SELECT 'post', p.id, p.title, p.slug, p.content, p.post_type,
+    COALESCE((SELECT GROUP_CONCAT(name, ', ') FROM (SELECT t.name FROM post_tags pt JOIN tags t ON t.id = pt.tag_id WHERE pt.post_id = p.id ORDER BY t.name)), ''),
+    p.published, p.author_id, p.updated_at
+FROM posts p;
+
+INSERT INTO revisions (content_type, content_id, title, slug, content, tags, published, created_at)
+SELECT 'page', id, title, slug, content, '', published, updated_at
+FROM pages;
@@ -0,0 +1,6 @@
+-- Drafts with a publish_at are published by the scheduler once it passes
+ALTER TABLE posts ADD COLUMN publish_at DATETIME;
+ALTER TABLE pages ADD COLUMN publish_at DATETIME;
+
+CREATE INDEX IF NOT EXISTS idx_posts_publish_at ON posts(publish_at) WHERE published = 0;
+CREATE INDEX IF NOT EXISTS idx_pages_publish_at ON pages(publish_at) WHERE published = 0;
@@ -0,0 +1,12 @@
+-- Old URLs and where they live now. A source ending in * matches every path
+-- under that prefix, and a * in the target is replaced with the rest of the
+-- path. automatic marks rows added when a post or page moved.
+CREATE TABLE IF NOT EXISTS redirects (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    source TEXT UNIQUE NOT NULL,
+    target TEXT NOT NULL,
+    automatic BOOLEAN NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_redirects_target ON redirects(target);
@@ -0,0 +1,23 @@
+-- Rendered Markdown is stored alongside the source so read paths don't run
+-- goldmark on every request. Existing rows are rendered at startup.
+ALTER TABLE posts ADD COLUMN content_html TEXT NOT NULL DEFAULT '';
+ALTER TABLE pages ADD COLUMN content_html TEXT NOT NULL DEFAULT '';
+
+-- Only reindex when searchable columns change, not when HTML is rebuilt
+DROP TRIGGER IF EXISTS posts_au;
+
+CREATE TRIGGER posts_au AFTER UPDATE OF title, content ON posts BEGIN
+    INSERT INTO posts_fts(posts_fts, rowid, title, content)
+    VALUES ('delete', old.id, old.title, old.content);
+    INSERT INTO posts_fts(rowid, title, content)
+    VALUES (new.id, new.title, new.content);
+END;
+
+DROP TRIGGER IF EXISTS pages_au;
+
+CREATE TRIGGER pages_au AFTER UPDATE OF title, content ON pages BEGIN
+    INSERT INTO pages_fts(pages_fts, rowid, title, content)
+    VALUES ('delete', old.id, old.title, old.content);
+    INSERT INTO pages_fts(rowid, title, content)
+    VALUES (new.id, new.title, new.content);
+END;
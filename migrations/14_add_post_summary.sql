@@ -0,0 +1,8 @@
+-- summary is written by hand and optional. summary_html is what lists and
+-- feeds show: the rendered summary, the part before <!--more--> or the first
+-- paragraph, and empty when that would be the whole post.
+ALTER TABLE posts ADD COLUMN summary TEXT NOT NULL DEFAULT '';
+ALTER TABLE posts ADD COLUMN summary_html TEXT NOT NULL DEFAULT '';
+
+-- Have startup render every post again so summaries get filled in
+UPDATE posts SET content_html = '';
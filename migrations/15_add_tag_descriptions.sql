@@ -0,0 +1 @@
+ALTER TABLE tags ADD COLUMN description TEXT NOT NULL DEFAULT '';
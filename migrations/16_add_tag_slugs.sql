@@ -0,0 +1,4 @@
+-- Tags are looked up and linked by slug. Existing tags get theirs at
+-- startup.
+ALTER TABLE tags ADD COLUMN slug TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_tags_slug ON tags(slug);
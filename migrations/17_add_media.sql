@@ -0,0 +1,28 @@
+-- Uploaded files, by their path in the media store. checksum is the hex
+-- SHA-256 of the file; it and the dimensions are empty for files found by a
+-- sync rather than uploaded through the admin
+CREATE TABLE IF NOT EXISTS media (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    path TEXT UNIQUE NOT NULL,
+    checksum TEXT NOT NULL DEFAULT '',
+    mime_type TEXT NOT NULL DEFAULT '',
+    size INTEGER NOT NULL DEFAULT 0,
+    width INTEGER NOT NULL DEFAULT 0,
+    height INTEGER NOT NULL DEFAULT 0,
+    alt_text TEXT NOT NULL DEFAULT '',
+    caption TEXT NOT NULL DEFAULT '',
+    user_id INTEGER,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Which posts and pages mention each file. content_type is 'post' or 'page'
+CREATE TABLE IF NOT EXISTS media_usage (
+    media_id INTEGER NOT NULL,
+    content_type TEXT NOT NULL,
+    content_id INTEGER NOT NULL,
+    PRIMARY KEY(media_id, content_type, content_id),
+    FOREIGN KEY(media_id) REFERENCES media(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_media_usage_content ON media_usage(content_type, content_id);
@@ -0,0 +1,13 @@
+-- Resized copies of uploaded images, used for srcset, and the square
+-- thumbnail shown in the admin
+CREATE TABLE IF NOT EXISTS media_variants (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    media_id INTEGER NOT NULL,
+    path TEXT UNIQUE NOT NULL,
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    thumbnail BOOLEAN NOT NULL DEFAULT 0,
+    FOREIGN KEY(media_id) REFERENCES media(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_media_variants_media ON media_variants(media_id);
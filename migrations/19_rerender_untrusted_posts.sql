@@ -0,0 +1,5 @@
+-- Posts by authors used to be rendered with their raw HTML intact. Clearing
+-- their HTML has it rendered again, without it, when the app starts.
+UPDATE posts SET content_html = ''
+WHERE author_id IS NULL
+   OR author_id NOT IN (SELECT id FROM users WHERE role IN ('editor', 'owner'));
@@ -0,0 +1,4 @@
+-- Tag pages and feeds show the tag's name and description, so their
+-- validators need to know when those last changed. Tags nobody has edited
+-- leave it empty.
+ALTER TABLE tags ADD COLUMN updated_at DATETIME;
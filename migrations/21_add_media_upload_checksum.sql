@@ -0,0 +1,6 @@
+-- JPEGs and PNGs lose their metadata when they're stored, so checksum no
+-- longer matches what was uploaded. upload_checksum is the SHA-256 of the
+-- file as uploaded, for spotting the same file uploaded again. Files that
+-- were stored as they came already have it.
+ALTER TABLE media ADD COLUMN upload_checksum TEXT NOT NULL DEFAULT '';
+UPDATE media SET upload_checksum = checksum WHERE mime_type NOT IN ('image/jpeg', 'image/png');
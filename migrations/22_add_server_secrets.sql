@@ -0,0 +1,6 @@
+-- Random keys the server signs things with, made the first time each is
+-- needed so they survive restarts.
+CREATE TABLE IF NOT EXISTS server_secrets (
+    name TEXT PRIMARY KEY,
+    value BLOB NOT NULL
+);
@@ -0,0 +1,8 @@
+-- Two uploads of the same file at once could both get past the duplicate
+-- check, so the database has the final say. Copies that got in before keep
+-- their files but stop counting as the original.
+UPDATE media SET upload_checksum = ''
+WHERE upload_checksum != ''
+  AND id NOT IN (SELECT MIN(id) FROM media WHERE upload_checksum != '' GROUP BY upload_checksum);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_media_upload_checksum ON media(upload_checksum) WHERE upload_checksum != '';
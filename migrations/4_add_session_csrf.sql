@@ -0,0 +1,4 @@
+ALTER TABLE sessions ADD COLUMN csrf_token TEXT NOT NULL DEFAULT '';
+
+-- Give sessions created before this migration a token of their own
+UPDATE sessions SET csrf_token = lower(hex(randomblob(32))) WHERE csrf_token = '';
@@ -0,0 +1,20 @@
+-- Audit log of every login attempt
+CREATE TABLE IF NOT EXISTS login_attempts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    user_agent TEXT,
+    success BOOLEAN NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_attempts_created_at ON login_attempts(created_at);
+
+-- Failure counters keyed by "ip:<address>" or "user:<username>"
+CREATE TABLE IF NOT EXISTS login_throttles (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at DATETIME,
+    locked_until DATETIME
+);
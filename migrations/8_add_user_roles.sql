@@ -0,0 +1,25 @@
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'author';
+ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT 0;
+
+-- Anyone who could log in before roles existed ran the whole site
+UPDATE users SET role = 'owner';
+
+ALTER TABLE posts ADD COLUMN author_id INTEGER REFERENCES users(id) ON DELETE SET NULL;
+UPDATE posts SET author_id = (SELECT MIN(id) FROM users);
+
+CREATE INDEX IF NOT EXISTS idx_posts_author_id ON posts(author_id);
+
+-- Single-use links for invites ('invite') and password resets ('reset')
+CREATE TABLE IF NOT EXISTS user_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_hash TEXT UNIQUE NOT NULL,
+    purpose TEXT NOT NULL,
+    user_id INTEGER,
+    role TEXT,
+    created_by INTEGER,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(created_by) REFERENCES users(id) ON DELETE SET NULL
+);
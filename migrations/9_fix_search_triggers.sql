@@ -0,0 +1,36 @@
+-- posts_fts and pages_fts are external-content tables, so FTS5 can't look up
+-- the old row by itself: rows have to be removed with the 'delete' command
+-- and the old values. The original triggers corrupted the index on every edit.
+DROP TRIGGER IF EXISTS posts_ad;
+DROP TRIGGER IF EXISTS posts_au;
+
+CREATE TRIGGER posts_ad AFTER DELETE ON posts BEGIN
+    INSERT INTO posts_fts(posts_fts, rowid, title, content)
+    VALUES ('delete', old.id, old.title, old.content);
+END;
+
+CREATE TRIGGER posts_au AFTER UPDATE ON posts BEGIN
+    INSERT INTO posts_fts(posts_fts, rowid, title, content)
+    VALUES ('delete', old.id, old.title, old.content);
+    INSERT INTO posts_fts(rowid, title, content)
+    VALUES (new.id, new.title, new.content);
+END;
+
+DROP TRIGGER IF EXISTS pages_ad;
+DROP TRIGGER IF EXISTS pages_au;
+
+CREATE TRIGGER pages_ad AFTER DELETE ON pages BEGIN
+    INSERT INTO pages_fts(pages_fts, rowid, title, content)
+    VALUES ('delete', old.id, old.title, old.content);
+END;
+
+CREATE TRIGGER pages_au AFTER UPDATE ON pages BEGIN
+    INSERT INTO pages_fts(pages_fts, rowid, title, content)
+    VALUES ('delete', old.id, old.title, old.content);
+    INSERT INTO pages_fts(rowid, title, content)
+    VALUES (new.id, new.title, new.content);
+END;
+
+-- Repair whatever the old triggers already damaged
+INSERT INTO posts_fts(posts_fts) VALUES ('rebuild');
+INSERT INTO pages_fts(pages_fts) VALUES ('rebuild');
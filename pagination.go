@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const postsPerPage = 20
+
+const searchResultsPerPage = 20
+
+// Pagination is what the "pagination" template needs to link between the
+// pages of a list.
+type Pagination struct {
+	Page       int
+	TotalPages int
+	PrevURL    string
+	NextURL    string
+}
+
+// newPagination works out the page count for total items and links to the
+// neighbouring pages with pageURL.
+func newPagination(page, total, perPage int, pageURL func(int) string) *Pagination {
+	p := &Pagination{Page: page, TotalPages: max(1, (total+perPage-1)/perPage)}
+	if page > 1 {
+		p.PrevURL = pageURL(page - 1)
+	}
+	if page < p.TotalPages {
+		p.NextURL = pageURL(page + 1)
+	}
+	return p
+}
+
+// listPageURL is where page n of the list at base lives. The first page is
+// the list itself.
+func listPageURL(base string, n int) string {
+	if n == 1 {
+		return base
+	}
+	return base + "/page/" + strconv.Itoa(n)
+}
+
+// listPage reads the page number from a .../page/{page} URL. /page/1 is
+// redirected to the list's own URL and anything that isn't a page number is
+// a 404; in both cases it reports false and the response is already written.
+func (app *App) listPage(w http.ResponseWriter, r *http.Request, base string) (int, bool) {
+	value := r.PathValue("page")
+	if value == "" {
+		return 1, true
+	}
+
+	page, err := strconv.Atoi(value)
+	switch {
+	case err != nil || page < 1:
+		app.notFound(w, r)
+		return 0, false
+	case page == 1:
+		http.Redirect(w, r, base, http.StatusMovedPermanently)
+		return 0, false
+	}
+	return page, true
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Redirect struct {
+	ID        int
+	Source    string
+	Target    string
+	Automatic bool
+	CreatedAt time.Time
+}
+
+// contentPath returns the public path of a post or page and whether it's
+// currently published.
+func contentPath(tx *sql.Tx, contentType string, id int) (string, bool, error) {
+	var slug, postType string
+	var published bool
+
+	var err error
+	if contentType == "post" {
+		err = tx.QueryRow("SELECT slug, post_type, published FROM posts WHERE id = ?", id).Scan(&slug, &postType, &published)
+	} else {
+		err = tx.QueryRow("SELECT slug, published FROM pages WHERE id = ?", id).Scan(&slug, &published)
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	if contentType == "post" {
+		return "/" + postType + "s/" + slug, published, nil
+	}
+	return "/" + slug, published, nil
+}
+
+// publishedPath is the path of a post or page if it's live, "" otherwise.
+func publishedPath(tx *sql.Tx, contentType string, id int) (string, error) {
+	path, published, err := contentPath(tx, contentType, id)
+	if err != nil || !published {
+		return "", err
+	}
+	return path, nil
+}
+
+// redirectMoved adds a redirect from oldPath when a save moved a post or
+// page. oldPath is empty when the content wasn't public before the save, in
+// which case nobody can have linked to it.
+func redirectMoved(tx *sql.Tx, contentType string, id int, oldPath string) error {
+	if oldPath == "" {
+		return nil
+	}
+
+	newPath, _, err := contentPath(tx, contentType, id)
+	if err != nil {
+		return err
+	}
+	if newPath == oldPath {
+		return nil
+	}
+
+	log.Printf("Redirecting %s to %s", oldPath, newPath)
+	return addRedirect(tx, oldPath, newPath, true)
+}
+
+// addRedirect points source at target. Existing redirects to source are
+// rewritten to go straight to target so visitors never follow a chain, and a
+// redirect away from target is dropped since target is live again.
+func addRedirect(tx *sql.Tx, source, target string, automatic bool) error {
+	if _, err := tx.Exec("DELETE FROM redirects WHERE source = ?", target); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE redirects SET target = ? WHERE target = ?", target, source); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO redirects (source, target, automatic)
+		VALUES (?, ?, ?)
+		ON CONFLICT(source) DO UPDATE SET target = excluded.target, automatic = excluded.automatic, created_at = CURRENT_TIMESTAMP
+	`, source, target, automatic)
+	return err
+}
+
+// findRedirect returns where path should go, or "" if it hasn't moved. Exact
+// matches win over wildcards, and longer wildcard prefixes over shorter ones.
+func (app *App) findRedirect(path string) (string, error) {
+	var source, target string
+	err := app.db.QueryRow(`
+		SELECT source, target
+		FROM redirects
+		WHERE source = ?
+		   OR (source LIKE '%*' AND substr(?, 1, length(source) - 1) = substr(source, 1, length(source) - 1))
+		ORDER BY source = ? DESC, length(source) DESC
+		LIMIT 1
+	`, path, path, path).Scan(&source, &target)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if prefix, ok := strings.CutSuffix(source, "*"); ok && source != path {
+		target = strings.Replace(target, "*", strings.TrimPrefix(path, prefix), 1)
+	}
+	if target == path {
+		return "", nil
+	}
+	return target, nil
+}
+
+// notFound answers a request for a path with no content, sending the visitor
+// on with a 301 if the content has moved.
+func (app *App) notFound(w http.ResponseWriter, r *http.Request) {
+	target, err := app.findRedirect(r.URL.Path)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+	if target == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.URL.RawQuery != "" && !strings.Contains(target, "?") {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
+
+func (app *App) handleAdminRedirects(w http.ResponseWriter, r *http.Request) {
+	app.renderRedirects(w, r, nil)
+}
+
+func (app *App) renderRedirects(w http.ResponseWriter, r *http.Request, extra map[string]any) {
+	rows, err := app.db.Query(`
+		SELECT id, source, target, automatic, created_at
+		FROM redirects
+		ORDER BY created_at DESC, id DESC
+	`)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var redirects []Redirect
+	for rows.Next() {
+		var rd Redirect
+		if err := rows.Scan(&rd.ID, &rd.Source, &rd.Target, &rd.Automatic, &rd.CreatedAt); err != nil {
+			continue
+		}
+		redirects = append(redirects, rd)
+	}
+
+	data := map[string]any{
+		"Redirects": redirects,
+		"CSRFToken": app.csrfToken(w, r),
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	err = app.templates["admin_redirects.html"].ExecuteTemplate(w, "admin_base", data)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+}
+
+func (app *App) handleNewRedirect(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	source := strings.TrimSpace(r.FormValue("source"))
+	target := strings.TrimSpace(r.FormValue("target"))
+	wildcard := strings.HasSuffix(source, "*")
+
+	var problem string
+	switch {
+	case !strings.HasPrefix(source, "/"):
+		problem = "The old path must start with /"
+	case strings.Contains(strings.TrimSuffix(source, "*"), "*"):
+		problem = "A * can only go at the end of the old path"
+	case !strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://"):
+		problem = "The new location must be a path starting with / or a full URL"
+	case strings.Contains(target, "*") && !wildcard:
+		problem = "A * in the new location needs a * at the end of the old path"
+	case source == target:
+		problem = "The old path and new location are the same"
+	}
+	if problem != "" {
+		app.renderRedirects(w, r, map[string]any{"Error": problem, "Source": source, "Target": target})
+		return
+	}
+
+	tx, err := app.db.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		err = addRedirect(tx, source, target, false)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/redirects", http.StatusSeeOther)
+}
+
+func (app *App) handleDeleteRedirect(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	if _, err := app.db.Exec("DELETE FROM redirects WHERE id = ?", id); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/redirects", http.StatusSeeOther)
+}
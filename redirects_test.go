@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// newRedirectsApp is an App with an in-memory database holding just the
+// redirects table.
+func newRedirectsApp(t *testing.T) *App {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: would get its own database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	schema, err := migrationFiles.ReadFile("migrations/12_add_redirects.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	return &App{db: db}
+}
+
+func TestFindRedirect(t *testing.T) {
+	app := newRedirectsApp(t)
+	for _, r := range [][2]string{
+		{"/old", "/new"},
+		{"/blog/*", "/essays/*"},
+		{"/blog/drafts/*", "/"},
+		{"/docs/*", "https://docs.example.com/*"},
+		{"/loop/*", "/loop/*"},
+		{"/a/b", "/c"},
+	} {
+		if _, err := app.db.Exec("INSERT INTO redirects (source, target) VALUES (?, ?)", r[0], r[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/old", "/new"},
+		{"/old/", ""},
+		{"/older", ""},
+		{"/blog/hello", "/essays/hello"},
+		{"/blog/2024/hello", "/essays/2024/hello"},
+		{"/blog/", "/essays/"},
+		{"/blog", ""},
+		{"/blog/drafts/wip", "/"},
+		{"/docs/setup", "https://docs.example.com/setup"},
+		{"/loop/x", ""},
+		{"/a/b", "/c"},
+		{"/a/bc", ""},
+		{"/elsewhere", ""},
+	}
+	for _, test := range tests {
+		got, err := app.findRedirect(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("findRedirect(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestAddRedirect(t *testing.T) {
+	app := newRedirectsApp(t)
+	add := func(source, target string) {
+		t.Helper()
+		tx, err := app.db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		if err := addRedirect(tx, source, target, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a moves to b then c: links to a skip b
+	add("/a", "/b")
+	add("/b", "/c")
+	// and back to a, which is live again
+	add("/c", "/a")
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/a", ""},
+		{"/b", "/a"},
+		{"/c", "/a"},
+	}
+	for _, test := range tests {
+		got, err := app.findRedirect(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("findRedirect(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
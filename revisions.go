@@ -0,0 +1,671 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Larger diffs than this (lines changed in a × lines changed in b) are shown
+// as a straight replacement rather than building the LCS table.
+const maxDiffCells = 4_000_000
+
+type Revision struct {
+	ID          int
+	ContentType string
+	ContentID   int
+	Title       string
+	Slug        string
+	Content     string
+	PostType    string
+	Tags        string
+	Published   bool
+	Author      string
+	CreatedAt   time.Time
+}
+
+type DiffLine struct {
+	Op   string // "=", "+" or "-"
+	Text string
+}
+
+type FieldChange struct {
+	Name string
+	Old  string
+	New  string
+}
+
+// saveRevision snapshots the current state of a post or page in tx, so the
+// snapshot is kept exactly when the save is. Saves that didn't change
+// anything since the last revision are skipped.
+func saveRevision(tx *sql.Tx, contentType string, id, userID int) error {
+	rev := Revision{ContentType: contentType, ContentID: id}
+
+	switch contentType {
+	case "post":
+		err := tx.QueryRow(`
+			SELECT title, slug, content, post_type, published
+			FROM posts
+			WHERE id = ?
+		`, id).Scan(&rev.Title, &rev.Slug, &rev.Content, &rev.PostType, &rev.Published)
+		if err != nil {
+			return err
+		}
+		rev.Tags, err = postTagList(tx, id)
+		if err != nil {
+			return err
+		}
+	case "page":
+		err := tx.QueryRow(`
+			SELECT title, slug, content, published
+			FROM pages
+			WHERE id = ?
+		`, id).Scan(&rev.Title, &rev.Slug, &rev.Content, &rev.Published)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown content type " + contentType)
+	}
+
+	last, err := latestRevision(tx, contentType, id)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && last.Title == rev.Title && last.Slug == rev.Slug && last.Content == rev.Content &&
+		last.PostType == rev.PostType && last.Tags == rev.Tags && last.Published == rev.Published {
+		return nil
+	}
+
+	var uid any
+	if userID != 0 {
+		uid = userID
+	}
+
+	var postType any
+	if rev.PostType != "" {
+		postType = rev.PostType
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO revisions (content_type, content_id, title, slug, content, post_type, tags, published, user_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, contentType, id, rev.Title, rev.Slug, rev.Content, postType, rev.Tags, rev.Published, uid)
+	return err
+}
+
+// postTagList is a post's tags as a revision records them: names in order,
+// separated by commas.
+func postTagList(tx *sql.Tx, postID int) (string, error) {
+	rows, err := tx.Query(`
+		SELECT t.name
+		FROM tags t
+		JOIN post_tags pt ON t.id = pt.tag_id
+		WHERE pt.post_id = ?
+		ORDER BY t.name asc
+	`, postID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return "", err
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ", "), rows.Err()
+}
+
+// contentExists reports whether a post or page is still there, rather than
+// only in its revision history.
+func (app *App) contentExists(contentType string, id int) (bool, error) {
+	var exists bool
+	err := app.db.QueryRow("SELECT EXISTS(SELECT 1 FROM "+contentType+"s WHERE id = ?)", id).Scan(&exists)
+	return exists, err
+}
+
+// deletedRevisions matches the revisions of posts and pages that have been
+// deleted. They're kept until they're purged.
+const deletedRevisions = `
+	(content_type = 'post' AND content_id NOT IN (SELECT id FROM posts))
+	OR (content_type = 'page' AND content_id NOT IN (SELECT id FROM pages))
+`
+
+const revisionColumns = `
+	r.id, r.content_type, r.content_id, COALESCE(r.title, ''), r.slug, r.content,
+	COALESCE(r.post_type, ''), r.tags, r.published, COALESCE(u.username, ''), r.created_at
+`
+
+func scanRevision(row interface{ Scan(...any) error }) (Revision, error) {
+	var rev Revision
+	err := row.Scan(&rev.ID, &rev.ContentType, &rev.ContentID, &rev.Title, &rev.Slug, &rev.Content,
+		&rev.PostType, &rev.Tags, &rev.Published, &rev.Author, &rev.CreatedAt)
+	return rev, err
+}
+
+func latestRevision(tx *sql.Tx, contentType string, id int) (Revision, error) {
+	return scanRevision(tx.QueryRow(`
+		SELECT `+revisionColumns+`
+		FROM revisions r
+		LEFT JOIN users u ON u.id = r.user_id
+		WHERE r.content_type = ? AND r.content_id = ?
+		ORDER BY r.id DESC
+		LIMIT 1
+	`, contentType, id))
+}
+
+func (app *App) getRevision(contentType string, id, revisionID int) (Revision, error) {
+	return scanRevision(app.db.QueryRow(`
+		SELECT `+revisionColumns+`
+		FROM revisions r
+		LEFT JOIN users u ON u.id = r.user_id
+		WHERE r.content_type = ? AND r.content_id = ? AND r.id = ?
+	`, contentType, id, revisionID))
+}
+
+func (app *App) listRevisions(contentType string, id int) ([]Revision, error) {
+	rows, err := app.db.Query(`
+		SELECT `+revisionColumns+`
+		FROM revisions r
+		LEFT JOIN users u ON u.id = r.user_id
+		WHERE r.content_type = ? AND r.content_id = ?
+		ORDER BY r.id DESC
+	`, contentType, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []Revision
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// canEditContent applies the same rules as the edit screens: pages are gated
+// by role on the route, posts by canEditPost.
+func (app *App) canEditContent(w http.ResponseWriter, r *http.Request, contentType string, id int) bool {
+	if contentType != "post" {
+		return true
+	}
+
+	allowed, err := app.canEditPost(app.currentSession(r), id)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (app *App) handleRevisions(contentType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		if !app.canEditContent(w, r, contentType, id) {
+			return
+		}
+		app.renderRevisions(w, r, contentType, id, nil)
+	}
+}
+
+func (app *App) renderRevisions(w http.ResponseWriter, r *http.Request, contentType string, id int, extra map[string]any) {
+	revisions, err := app.listRevisions(contentType, id)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if len(revisions) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	exists, err := app.contentExists(contentType, id)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]any{
+		"ContentType": contentType,
+		"ContentID":   id,
+		"Title":       revisions[0].Title,
+		"Revisions":   revisions,
+		"Deleted":     !exists,
+		"CSRFToken":   app.csrfToken(w, r),
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	err = app.templates["admin_revisions.html"].ExecuteTemplate(w, "admin_base", data)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleRevisionDiff compares two revisions, defaulting to the latest one and
+// the revision before it.
+func (app *App) handleRevisionDiff(contentType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		if !app.canEditContent(w, r, contentType, id) {
+			return
+		}
+
+		revisions, err := app.listRevisions(contentType, id)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if len(revisions) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		fromID, _ := strconv.Atoi(r.URL.Query().Get("from"))
+		toID, _ := strconv.Atoi(r.URL.Query().Get("to"))
+		if toID == 0 {
+			toID = revisions[0].ID
+		}
+
+		var from, to *Revision
+		for i := range revisions {
+			if revisions[i].ID == toID {
+				to = &revisions[i]
+				if fromID == 0 && i+1 < len(revisions) {
+					fromID = revisions[i+1].ID
+				}
+			}
+		}
+		for i := range revisions {
+			if revisions[i].ID == fromID {
+				from = &revisions[i]
+			}
+		}
+		if to == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if from == nil {
+			// The first revision is compared against nothing
+			from = &Revision{ContentType: contentType, ContentID: id}
+		}
+
+		data := map[string]any{
+			"ContentType": contentType,
+			"ContentID":   id,
+			"Title":       revisions[0].Title,
+			"From":        from,
+			"To":          to,
+			"Changes":     revisionChanges(*from, *to),
+			"Lines":       diffLines(from.Content, to.Content),
+		}
+
+		err = app.templates["admin_revision_diff.html"].ExecuteTemplate(w, "admin_base", data)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleRestoreRevision copies an old revision back over the post or page.
+// The restore is itself saved as a new revision, so it can be undone.
+func (app *App) handleRestoreRevision(contentType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.validateCSRF(r) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		id, _ := strconv.Atoi(r.PathValue("id"))
+		if !app.canEditContent(w, r, contentType, id) {
+			return
+		}
+
+		revisionID, _ := strconv.Atoi(r.FormValue("revision"))
+		rev, err := app.getRevision(contentType, id, revisionID)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		table := contentType + "s"
+		var taken bool
+		err = app.db.QueryRow("SELECT EXISTS(SELECT 1 FROM "+table+" WHERE slug = ? AND id != ?)", rev.Slug, id).Scan(&taken)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			app.renderRevisions(w, r, contentType, id, map[string]any{
+				"Error": "Can't restore: the slug " + rev.Slug + " is now used by another " + contentType,
+			})
+			return
+		}
+
+		exists, err := app.contentExists(contentType, id)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		// Deleted content comes back under its old ID, as first written: a
+		// post's author is whoever saved its first revision
+		var authorID sql.NullInt64
+		var createdAt time.Time
+		if !exists {
+			err := app.db.QueryRow(`
+				SELECT user_id, created_at FROM revisions
+				WHERE content_type = ? AND content_id = ?
+				ORDER BY id LIMIT 1
+			`, contentType, id).Scan(&authorID, &createdAt)
+			if err != nil {
+				app.httpError(w, err, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		rawHTML := true
+		if contentType == "post" {
+			if exists {
+				rawHTML, err = app.postRawHTMLAllowed(id)
+			} else {
+				rawHTML, err = app.rawHTMLAllowed(authorID)
+			}
+			if err != nil {
+				app.httpError(w, err, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		tx, err := app.db.Begin()
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var oldPath string
+		if exists {
+			if oldPath, err = publishedPath(tx, contentType, id); err != nil {
+				app.httpError(w, err, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if contentType == "post" {
+			// Revisions don't keep the summary, so the current one stays
+			var summary string
+			if exists {
+				err = tx.QueryRow("SELECT summary FROM posts WHERE id = ?", id).Scan(&summary)
+				if err == nil {
+					_, err = tx.Exec(`
+						UPDATE posts
+						SET title = ?, slug = ?, content = ?, content_html = ?, summary_html = ?, post_type = ?, published = ?, updated_at = CURRENT_TIMESTAMP
+						WHERE id = ?
+					`, rev.Title, rev.Slug, rev.Content, string(app.markdownToHTML(rev.Content, rawHTML)), app.summaryHTML(summary, rev.Content, rawHTML), rev.PostType, rev.Published, id)
+				}
+			} else {
+				_, err = tx.Exec(`
+					INSERT INTO posts (id, title, slug, content, content_html, summary_html, post_type, published, author_id, created_at)
+					VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				`, id, rev.Title, rev.Slug, rev.Content, string(app.markdownToHTML(rev.Content, rawHTML)), app.summaryHTML("", rev.Content, rawHTML), rev.PostType, rev.Published, authorID, sqlTime(createdAt))
+			}
+			if err == nil {
+				err = updatePostTags(tx, id, rev.Tags)
+			}
+			if err == nil {
+				err = updateMediaUsage(tx, "post", id, rev.Content+"\n"+summary)
+			}
+		} else {
+			if exists {
+				_, err = tx.Exec(`
+					UPDATE pages
+					SET title = ?, slug = ?, content = ?, content_html = ?, published = ?, updated_at = CURRENT_TIMESTAMP
+					WHERE id = ?
+				`, rev.Title, rev.Slug, rev.Content, string(app.markdownToHTML(rev.Content, rawHTML)), rev.Published, id)
+			} else {
+				_, err = tx.Exec(`
+					INSERT INTO pages (id, title, slug, content, content_html, published, created_at)
+					VALUES (?, ?, ?, ?, ?, ?, ?)
+				`, id, rev.Title, rev.Slug, rev.Content, string(app.markdownToHTML(rev.Content, rawHTML)), rev.Published, sqlTime(createdAt))
+			}
+			if err == nil {
+				err = updateMediaUsage(tx, "page", id, rev.Content)
+			}
+		}
+		if err == nil {
+			err = saveRevision(tx, contentType, id, app.currentSession(r).UserID)
+		}
+		if err == nil {
+			err = redirectMoved(tx, contentType, id, oldPath)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		app.renderRevisions(w, r, contentType, id, map[string]any{
+			"Message": "Restored the revision from " + rev.CreatedAt.Format("Jan 2, 2006 15:04"),
+		})
+	}
+}
+
+// DeletedContent is a post or page that's gone, apart from its revisions.
+type DeletedContent struct {
+	ContentType string
+	ContentID   int
+	Title       string
+	Slug        string
+	Revisions   int
+	LastSaved   time.Time
+}
+
+func (app *App) handleDeletedContent(w http.ResponseWriter, r *http.Request) {
+	app.renderDeletedContent(w, r, nil)
+}
+
+func (app *App) renderDeletedContent(w http.ResponseWriter, r *http.Request, extra map[string]any) {
+	rows, err := app.db.Query(`
+		SELECT r.content_type, r.content_id, COALESCE(r.title, ''), r.slug,
+		       (SELECT COUNT(*) FROM revisions c WHERE c.content_type = r.content_type AND c.content_id = r.content_id),
+		       r.created_at
+		FROM revisions r
+		WHERE r.id IN (SELECT MAX(id) FROM revisions WHERE ` + deletedRevisions + ` GROUP BY content_type, content_id)
+		ORDER BY r.created_at DESC
+	`)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var deleted []DeletedContent
+	for rows.Next() {
+		var d DeletedContent
+		if err := rows.Scan(&d.ContentType, &d.ContentID, &d.Title, &d.Slug, &d.Revisions, &d.LastSaved); err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		deleted = append(deleted, d)
+	}
+	if err := rows.Err(); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	session := app.currentSession(r)
+	data := map[string]any{
+		"Deleted":   deleted,
+		"CanPurge":  hasRole(session.Role, roleOwner),
+		"CSRFToken": app.csrfToken(w, r),
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	err = app.templates["admin_deleted.html"].ExecuteTemplate(w, "admin_base", data)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+}
+
+// handlePurgeDeleted drops the revisions of one deleted post or page, or of
+// all of them when no ID is given. Content that still exists is never
+// touched.
+func (app *App) handlePurgeDeleted(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	query := "DELETE FROM revisions WHERE (" + deletedRevisions + ")"
+	var args []any
+	if id, _ := strconv.Atoi(r.FormValue("id")); id != 0 {
+		query += " AND content_type = ? AND content_id = ?"
+		args = append(args, r.FormValue("content_type"), id)
+	}
+
+	result, err := app.db.Exec(query, args...)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	purged, _ := result.RowsAffected()
+
+	app.renderDeletedContent(w, r, map[string]any{
+		"Message": "Purged " + strconv.FormatInt(purged, 10) + " revisions.",
+	})
+}
+
+func revisionChanges(from, to Revision) []FieldChange {
+	status := func(published bool) string {
+		if published {
+			return "Published"
+		}
+		return "Draft"
+	}
+
+	var changes []FieldChange
+	add := func(name, old, new string) {
+		if old != new {
+			changes = append(changes, FieldChange{Name: name, Old: old, New: new})
+		}
+	}
+	add("Title", from.Title, to.Title)
+	add("Slug", from.Slug, to.Slug)
+	add("Type", from.PostType, to.PostType)
+	add("Tags", from.Tags, to.Tags)
+	if from.ID != 0 {
+		add("Status", status(from.Published), status(to.Published))
+	}
+	return changes
+}
+
+// diffLines returns a line-by-line diff of a and b based on their longest
+// common subsequence.
+func diffLines(a, b string) []DiffLine {
+	x := splitLines(a)
+	y := splitLines(b)
+
+	// Only the region between the common prefix and suffix needs the LCS table
+	prefix := 0
+	for prefix < len(x) && prefix < len(y) && x[prefix] == y[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(x)-prefix && suffix < len(y)-prefix && x[len(x)-1-suffix] == y[len(y)-1-suffix] {
+		suffix++
+	}
+
+	var lines []DiffLine
+	for _, line := range x[:prefix] {
+		lines = append(lines, DiffLine{Op: "=", Text: line})
+	}
+
+	mx := x[prefix : len(x)-suffix]
+	my := y[prefix : len(y)-suffix]
+	n, m := len(mx), len(my)
+
+	if n*m > maxDiffCells {
+		for _, line := range mx {
+			lines = append(lines, DiffLine{Op: "-", Text: line})
+		}
+		for _, line := range my {
+			lines = append(lines, DiffLine{Op: "+", Text: line})
+		}
+	} else {
+		lcs := make([][]int, n+1)
+		for i := range lcs {
+			lcs[i] = make([]int, m+1)
+		}
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				if mx[i] == my[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < n && j < m {
+			switch {
+			case mx[i] == my[j]:
+				lines = append(lines, DiffLine{Op: "=", Text: mx[i]})
+				i++
+				j++
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lines = append(lines, DiffLine{Op: "-", Text: mx[i]})
+				i++
+			default:
+				lines = append(lines, DiffLine{Op: "+", Text: my[j]})
+				j++
+			}
+		}
+		for ; i < n; i++ {
+			lines = append(lines, DiffLine{Op: "-", Text: mx[i]})
+		}
+		for ; j < m; j++ {
+			lines = append(lines, DiffLine{Op: "+", Text: my[j]})
+		}
+	}
+
+	for _, line := range x[len(x)-suffix:] {
+		lines = append(lines, DiffLine{Op: "=", Text: line})
+	}
+	return lines
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []string
+	}{
+		{"both empty", "", "", nil},
+		{"unchanged", "a\nb\n", "a\nb", []string{"=a", "=b"}},
+		{"added", "", "a\nb", []string{"+a", "+b"}},
+		{"removed", "a\nb", "", []string{"-a", "-b"}},
+		{"changed line", "a\nb\nc", "a\nB\nc", []string{"=a", "-b", "+B", "=c"}},
+		{"inserted", "a\nc", "a\nb\nc", []string{"=a", "+b", "=c"}},
+		{"deleted", "a\nb\nc", "a\nc", []string{"=a", "-b", "=c"}},
+		{"moved", "a\nb\nc", "b\nc\na", []string{"-a", "=b", "=c", "+a"}},
+		{"windows line endings", "a\r\nb\r\n", "a\nb\n", []string{"=a", "=b"}},
+		{"longest common run kept", "x\na\nb\ny", "a\nb\nz", []string{"-x", "=a", "=b", "-y", "+z"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, line := range diffLines(test.a, test.b) {
+			got = append(got, line.Op+line.Text)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: diffLines = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDiffLinesTooLarge(t *testing.T) {
+	// Past maxDiffCells the middle is shown as removed then added
+	var a, b []string
+	for i := 0; i*i <= maxDiffCells; i++ {
+		a = append(a, "a"+strings.Repeat("x", i))
+		b = append(b, "b"+strings.Repeat("x", i))
+	}
+	lines := diffLines("same\n"+strings.Join(a, "\n"), "same\n"+strings.Join(b, "\n"))
+
+	if lines[0] != (DiffLine{Op: "=", Text: "same"}) {
+		t.Errorf("first line = %v, want the common prefix", lines[0])
+	}
+	if got := len(lines); got != 1+len(a)+len(b) {
+		t.Errorf("got %d lines, want %d", got, 1+len(a)+len(b))
+	}
+	if lines[1].Op != "-" || lines[len(lines)-1].Op != "+" {
+		t.Errorf("middle isn't removed then added: %v ... %v", lines[1], lines[len(lines)-1])
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"encoding/xml"
+	"html/template"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 )
 
@@ -22,28 +26,58 @@ type Channel struct {
 }
 
 type Item struct {
-	Title       string `xml:"title"`
-	Link        string `xml:"link"`
-	Description string `xml:"description"`
-	PubDate     string `xml:"pubDate"`
-	GUID        string `xml:"guid"`
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description"`
+	PubDate     string   `xml:"pubDate"`
+	GUID        string   `xml:"guid"`
+	Categories  []string `xml:"category"`
 }
 
-func (app *App) generateRSSFeed(postType, baseURL, title, description string) (*RSS, error) {
-	var query string
+// feedEntry is one post as every feed format sees it. HTML is the whole
+// post, or when Partial is set its summary and a link to the rest.
+type feedEntry struct {
+	Title     string
+	URL       string
+	HTML      string
+	Partial   bool
+	Tags      []string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// feedLimit is how many of the latest posts a feed carries, from FEED_ITEMS.
+func feedLimit() int {
+	if n, err := strconv.Atoi(os.Getenv("FEED_ITEMS")); err == nil && n > 0 {
+		return n
+	}
+	return 20
+}
+
+// feedFullContent reports whether feeds carry whole posts rather than their
+// summaries, from FEED_FULL_CONTENT.
+func feedFullContent() bool {
+	full, _ := strconv.ParseBool(os.Getenv("FEED_FULL_CONTENT"))
+	return full
+}
+
+// feedEntries runs the query behind all the feeds: the latest published
+// posts, newest first, optionally of a single type or with a single tag.
+func (app *App) feedEntries(postType, tag, baseURL string) ([]feedEntry, error) {
+	query := `SELECT id, title, slug, content_html, summary_html, post_type, created_at, updated_at
+	          FROM posts WHERE published = 1`
 	var args []any
 
-	if postType == "" {
-		// All posts
-		query = `SELECT id, title, slug, content, post_type, created_at 
-		         FROM posts WHERE published = 1 ORDER BY created_at DESC`
-	} else {
-		// Specific post type
-		query = `SELECT id, title, slug, content, post_type, created_at 
-		         FROM posts WHERE post_type = ? AND published = 1 
-		         ORDER BY created_at DESC`
+	if postType != "" {
+		query += " AND post_type = ?"
 		args = append(args, postType)
 	}
+	if tag != "" {
+		query += ` AND id IN (SELECT pt.post_id FROM post_tags pt JOIN tags t ON t.id = pt.tag_id WHERE t.slug = ?)`
+		args = append(args, tag)
+	}
+	query += " ORDER BY created_at DESC LIMIT ?"
+	args = append(args, feedLimit())
 
 	rows, err := app.db.Query(query, args...)
 	if err != nil {
@@ -51,32 +85,81 @@ func (app *App) generateRSSFeed(postType, baseURL, title, description string) (*
 	}
 	defer rows.Close()
 
-	var items []Item
-	var lastBuildDate time.Time
+	full := feedFullContent()
 
+	var entries []feedEntry
 	for rows.Next() {
 		var id int
-		var postTitle, slug, content, pType string
-		var createdAt time.Time
+		var title, slug, contentHTML, summaryHTML, pType string
+		var createdAt, updatedAt time.Time
 
-		if err := rows.Scan(&id, &postTitle, &slug, &content, &pType, &createdAt); err != nil {
+		if err := rows.Scan(&id, &title, &slug, &contentHTML, &summaryHTML, &pType, &createdAt, &updatedAt); err != nil {
 			continue
 		}
 
-		if createdAt.After(lastBuildDate) {
-			lastBuildDate = createdAt
+		entry := feedEntry{
+			Title:     title,
+			URL:       baseURL + "/" + pType + "s/" + slug,
+			HTML:      contentHTML,
+			Tags:      tagNames(app.getPostTags(id)),
+			CreatedAt: createdAt,
+			UpdatedAt: updatedAt,
 		}
+		if !full && summaryHTML != "" {
+			entry.HTML = summaryHTML + `<p><a href="` + template.HTMLEscapeString(entry.URL) + `">Read more&hellip;</a></p>`
+			entry.Partial = true
+		}
+		entries = append(entries, entry)
+	}
 
-		// Convert markdown to HTML for description
-		htmlContent := app.markdownToHTML(content)
-		desc := string(htmlContent)
+	return entries, rows.Err()
+}
+
+// feedInfo returns the title and description for the feed of one post type
+// or tag, or of everything when both are empty.
+func feedInfo(postType, tag string) (string, string) {
+	switch {
+	case tag != "":
+		return "Alec Stewart - Posts tagged " + tag, "All my recent posts tagged " + tag
+	case postType != "":
+		return "Alec Stewart - " + titleCase(postType) + "s Feed", "All my recent " + postType + "s"
+	}
+	return "Alec Stewart - Everything Feed", "Essays, notes, links, photos... all my recent content"
+}
+
+// feedPath is where the feed for postType or tag lives, without the
+// extension.
+func feedPath(postType, tag string) string {
+	switch {
+	case tag != "":
+		return "/tags/" + tag + "/feed"
+	case postType != "":
+		return "/" + postType + "s/feed"
+	}
+	return "/feed"
+}
+
+func (app *App) generateRSSFeed(postType, tag, baseURL, title, description string) (*RSS, error) {
+	entries, err := app.feedEntries(postType, tag, baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []Item
+	var lastBuildDate time.Time
+
+	for _, e := range entries {
+		if e.CreatedAt.After(lastBuildDate) {
+			lastBuildDate = e.CreatedAt
+		}
 
 		items = append(items, Item{
-			Title:       postTitle,
-			Link:        baseURL + "/" + pType + "s/" + slug,
-			Description: desc,
-			PubDate:     createdAt.Format(time.RFC1123Z),
-			GUID:        baseURL + "/" + pType + "s/" + slug,
+			Title:       e.Title,
+			Link:        e.URL,
+			Description: e.HTML,
+			PubDate:     e.CreatedAt.Format(time.RFC1123Z),
+			GUID:        e.URL,
+			Categories:  e.Tags,
 		})
 	}
 
@@ -95,46 +178,70 @@ func (app *App) generateRSSFeed(postType, baseURL, title, description string) (*
 	return feed, nil
 }
 
-func (app *App) handleRSSFeed(w http.ResponseWriter, r *http.Request) {
-	feed, err := app.generateRSSFeed("", baseURL, "Alec Stewart - Everything Feed",
-		"Essays, notes, links, photos... all my recent content")
-	if err != nil {
-		app.httpError(w, err, http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
-
-	output, err := xml.MarshalIndent(feed, "", "  ")
-	if err != nil {
-		app.httpError(w, err, http.StatusInternalServerError)
-		return
-	}
-
-	w.Write([]byte(xml.Header))
-	w.Write(output)
-}
-
-func (app *App) handlePostTypeRSS(postType string) http.HandlerFunc {
+// handleFeed serves the feed for postType (everything when empty), or for the
+// tag in the URL, as RSS, Atom or JSON Feed.
+func (app *App) handleFeed(postType, format string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		title := "Alec Stewart - " + titleCase(postType) + "s Feed"
-		description := "All my recent " + postType + "s"
+		var tag Tag
+		if r.PathValue("slug") != "" {
+			var ok bool
+			if tag, ok = app.tagFromURL(w, r); !ok {
+				return
+			}
+		}
 
-		feed, err := app.generateRSSFeed(postType, baseURL, title, description)
+		var types []string
+		if postType != "" {
+			types = append(types, postType)
+		}
+		modified, count, err := app.publishedPostsVersion(types...)
+		// A tag's feed is titled with its name and description
+		if tag.UpdatedAt.After(modified) {
+			modified = tag.UpdatedAt
+		}
 		if err != nil {
 			app.httpError(w, err, http.StatusInternalServerError)
 			return
 		}
+		if app.notModified(w, r, modified, count) {
+			return
+		}
 
-		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		title, description := feedInfo(postType, tag.Name)
+
+		var feed any
+		var contentType string
+		switch format {
+		case "atom":
+			feed, err = app.generateAtomFeed(postType, tag.Slug, baseURL, title, description)
+			contentType = "application/atom+xml; charset=utf-8"
+		case "json":
+			feed, err = app.generateJSONFeed(postType, tag.Slug, baseURL, title, description)
+			contentType = "application/feed+json; charset=utf-8"
+		default:
+			feed, err = app.generateRSSFeed(postType, tag.Slug, baseURL, title, description)
+			contentType = "application/rss+xml; charset=utf-8"
+		}
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
 
-		output, err := xml.MarshalIndent(feed, "", "  ")
+		var output []byte
+		if format == "json" {
+			output, err = json.MarshalIndent(feed, "", "  ")
+		} else {
+			output, err = xml.MarshalIndent(feed, "", "  ")
+		}
 		if err != nil {
 			app.httpError(w, err, http.StatusInternalServerError)
 			return
 		}
 
-		w.Write([]byte(xml.Header))
+		w.Header().Set("Content-Type", contentType)
+		if format != "json" {
+			w.Write([]byte(xml.Header))
+		}
 		w.Write(output)
 	}
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+const (
+	schedulerInterval = 30 * time.Second
+
+	// Layout of <input type="datetime-local">, read and shown in the
+	// server's local time zone (TZ)
+	publishAtLayout = "2006-01-02T15:04"
+)
+
+// parsePublishAt reads the "publish at" form field. An empty field means the
+// post isn't scheduled.
+func parsePublishAt(value string) (sql.NullTime, error) {
+	if value == "" {
+		return sql.NullTime{}, nil
+	}
+	t, err := time.ParseInLocation(publishAtLayout, value, time.Local)
+	if err != nil {
+		return sql.NullTime{}, err
+	}
+	return sql.NullTime{Time: t, Valid: true}, nil
+}
+
+func formatPublishAt(t sql.NullTime) string {
+	if !t.Valid {
+		return ""
+	}
+	return t.Time.Local().Format(publishAtLayout)
+}
+
+// publishAtValue converts a scheduled time for storage, NULL when unset.
+func publishAtValue(t sql.NullTime) any {
+	if !t.Valid {
+		return nil
+	}
+	return sqlTime(t.Time)
+}
+
+// runScheduler publishes posts and pages once their publish_at time has
+// passed. It runs straight away to catch anything due while the server was
+// down, then every schedulerInterval.
+func (app *App) runScheduler() {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := app.publishScheduled("post"); err != nil {
+			log.Printf("ERROR: publishing scheduled posts: %v", err)
+		}
+		if err := app.publishScheduled("page"); err != nil {
+			log.Printf("ERROR: publishing scheduled pages: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// publishScheduled flips due drafts live. created_at becomes the scheduled
+// time so the post sorts, and shows up in feeds, as if it was written then.
+func (app *App) publishScheduled(contentType string) error {
+	table := contentType + "s"
+
+	rows, err := app.db.Query(`
+		SELECT id, slug
+		FROM `+table+`
+		WHERE published = 0 AND publish_at IS NOT NULL AND publish_at <= ?
+		ORDER BY publish_at
+	`, sqlTime(time.Now()))
+	if err != nil {
+		return err
+	}
+
+	type due struct {
+		id   int
+		slug string
+	}
+	var items []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.slug); err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range items {
+		tx, err := app.db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			UPDATE `+table+`
+			SET published = 1, created_at = publish_at, updated_at = CURRENT_TIMESTAMP, publish_at = NULL
+			WHERE id = ? AND published = 0
+		`, d.id)
+		if err == nil {
+			err = saveRevision(tx, contentType, d.id, 0)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		log.Printf("Published scheduled %s %s", contentType, d.slug)
+	}
+
+	return nil
+}
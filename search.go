@@ -3,8 +3,10 @@ package main
 import (
 	"html/template"
 	"net/http"
-	"sort"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type SearchResult struct {
@@ -36,93 +38,90 @@ func (app *App) handleSearch(w http.ResponseWriter, r *http.Request) {
 	// Prepare FTS query with prefix matching
 	ftsQuery := prepareFTSQuery(query)
 
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	// A query FTS5 can't parse just finds nothing
+	var total int
+	app.db.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM posts p JOIN posts_fts fts ON p.id = fts.rowid
+			 WHERE posts_fts MATCH ? AND p.published = 1) +
+			(SELECT COUNT(*) FROM pages p JOIN pages_fts fts ON p.id = fts.rowid
+			 WHERE pages_fts MATCH ? AND p.published = 1)
+	`, ftsQuery, ftsQuery).Scan(&total)
+
+	pagination := newPagination(page, total, searchResultsPerPage, func(n int) string {
+		v := url.Values{"q": {query}}
+		if n > 1 {
+			v.Set("page", strconv.Itoa(n))
+		}
+		return "/search?" + v.Encode()
+	})
+
 	var results []SearchResult
 
-	// Search posts using FTS5
-	// FTS5 uses BM25 ranking algorithm by default
-	postRows, err := app.db.Query(`
-		SELECT 
-			p.id, 
-			p.title, 
-			p.slug, 
-			p.content, 
-			p.post_type, 
+	// Posts and pages are ranked together so each page of results is in
+	// order. FTS5 uses BM25 ranking by default; lower is better.
+	rows, err := app.db.Query(`
+		SELECT
+			'post',
+			p.id,
+			p.title,
+			p.slug,
+			p.post_type,
 			p.created_at,
-			fts.rank,
-			snippet(posts_fts, 1, '<mark>', '</mark>', '...', 64) as snippet
+			fts.rank AS rank,
+			snippet(posts_fts, 1, '<mark>', '</mark>', '...', 64)
 		FROM posts p
 		JOIN posts_fts fts ON p.id = fts.rowid
 		WHERE posts_fts MATCH ? AND p.published = 1
-		ORDER BY fts.rank
-		LIMIT 50
-	`, ftsQuery)
-
-	if err == nil {
-		defer postRows.Close()
-		for postRows.Next() {
-			var p Post
-			var rank float64
-			var snippet template.HTML
-
-			if err := postRows.Scan(&p.ID, &p.Title, &p.Slug, &p.Content, &p.PostType, &p.CreatedAt, &rank, &snippet); err != nil {
-				continue
-			}
-
-			p.Tags = app.getPostTags(p.ID)
-
-			results = append(results, SearchResult{
-				Type:    "post",
-				Post:    &p,
-				Rank:    rank,
-				Snippet: snippet,
-			})
-		}
-	}
-
-	// Search pages using FTS5
-	pageRows, err := app.db.Query(`
-		SELECT 
-			p.id, 
-			p.title, 
-			p.slug, 
-			p.content, 
+		UNION ALL
+		SELECT
+			'page',
+			p.id,
+			p.title,
+			p.slug,
+			'',
 			p.created_at,
-			fts.rank,
-			snippet(pages_fts, 1, '<mark>', '</mark>', '...', 64) as snippet
+			fts.rank AS rank,
+			snippet(pages_fts, 1, '<mark>', '</mark>', '...', 64)
 		FROM pages p
 		JOIN pages_fts fts ON p.id = fts.rowid
 		WHERE pages_fts MATCH ? AND p.published = 1
-		ORDER BY fts.rank
-		LIMIT 50
-	`, ftsQuery)
+		ORDER BY rank
+		LIMIT ? OFFSET ?
+	`, ftsQuery, ftsQuery, searchResultsPerPage, (page-1)*searchResultsPerPage)
 
 	if err == nil {
-		defer pageRows.Close()
-		for pageRows.Next() {
-			var p Page
-			var rank float64
-			var snippet template.HTML
-
-			if err := pageRows.Scan(&p.ID, &p.Title, &p.Slug, &p.Content, &p.CreatedAt, &rank, &snippet); err != nil {
+		defer rows.Close()
+		for rows.Next() {
+			var result SearchResult
+			var id int
+			var title, slug, postType string
+			var createdAt time.Time
+
+			if err := rows.Scan(&result.Type, &id, &title, &slug, &postType, &createdAt, &result.Rank, &result.Snippet); err != nil {
 				continue
 			}
 
-			results = append(results, SearchResult{
-				Type:    "page",
-				Page:    &p,
-				Rank:    rank,
-				Snippet: snippet,
-			})
+			if result.Type == "post" {
+				result.Post = &Post{ID: id, Title: title, Slug: slug, PostType: postType, CreatedAt: createdAt}
+				result.Post.Tags = app.getPostTags(id)
+			} else {
+				result.Page = &Page{ID: id, Title: title, Slug: slug, CreatedAt: createdAt}
+			}
+			results = append(results, result)
 		}
 	}
 
-	// Sort all results by rank (lower rank = better match in FTS5)
-	sortResultsByRank(results)
-
 	data := map[string]any{
-		"Query":   query,
-		"Results": results,
-		"Total":   len(results),
+		"Query":      query,
+		"Results":    results,
+		"Total":      total,
+		"Pagination": pagination,
 	}
 
 	err = app.templates["search.html"].ExecuteTemplate(w, "base", data)
@@ -132,13 +131,6 @@ func (app *App) handleSearch(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func sortResultsByRank(results []SearchResult) {
-	// Lower rank is better (FTS5 rank is negative)
-	sort.Slice(results, func(i, j int) bool {
-		return results[i].Rank < results[j].Rank
-	})
-}
-
 // Prepare FTS query to support prefix matching
 func prepareFTSQuery(query string) string {
 	// Remove any existing wildcards to prevent injection
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func (app *App) handleAdminSecurity(w http.ResponseWriter, r *http.Request) {
+	app.renderSecurity(w, r, nil)
+}
+
+// renderSecurity shows the account security page, merging in any one-off
+// data such as a new TOTP secret or freshly generated recovery codes.
+func (app *App) renderSecurity(w http.ResponseWriter, r *http.Request, extra map[string]any) {
+	session := app.currentSession(r)
+
+	var totpEnabled bool
+	err := app.db.QueryRow("SELECT totp_enabled FROM users WHERE id = ?", session.UserID).Scan(&totpEnabled)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	passkeys, err := app.userPasskeys(session.UserID)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]any{
+		"Username":               session.Username,
+		"Passkeys":               passkeys,
+		"TOTPEnabled":            totpEnabled,
+		"RemainingRecoveryCodes": app.remainingRecoveryCodes(session.UserID),
+		"CSRFToken":              app.csrfToken(w, r),
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	err = app.templates["admin_security.html"].ExecuteTemplate(w, "admin_base", data)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+}
+
+// checkPassword re-confirms the signed in user's password before sensitive
+// account changes.
+func (app *App) checkPassword(userID int, password string) bool {
+	var hash string
+	if err := app.db.QueryRow("SELECT password FROM users WHERE id = ?", userID).Scan(&hash); err != nil {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
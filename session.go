@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	sessionCookieName = "auth_token"
+	sessionDuration   = 7 * 24 * time.Hour
+	// Sliding expiry is only written back once per interval so that every
+	// admin request doesn't turn into a database write.
+	sessionTouchInterval = time.Minute
+)
+
+type Session struct {
+	ID         int
+	UserID     int
+	Username   string
+	Role       string
+	IP         string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	CSRFToken  string
+}
+
+type contextKey string
+
+const sessionContextKey contextKey = "session"
+
+// hashToken returns the hex SHA-256 of a token. Only hashes are stored so a
+// copy of the database can't be used to hijack a session.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func setSessionCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   int(sessionDuration.Seconds()),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   sessionCookieName,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+// createSession stores a new session for the user and sets the auth cookie.
+func (app *App) createSession(w http.ResponseWriter, r *http.Request, userID int) error {
+	// Expired sessions are never read again, so clear them out while we're here
+	if _, err := app.db.Exec("DELETE FROM sessions WHERE expires_at <= CURRENT_TIMESTAMP"); err != nil {
+		return err
+	}
+
+	token := generateToken()
+	_, err := app.db.Exec(`
+		INSERT INTO sessions (token_hash, user_id, ip, user_agent, expires_at, csrf_token)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, hashToken(token), userID, clientIP(r), r.UserAgent(), sqlTime(time.Now().Add(sessionDuration)), generateToken())
+	if err != nil {
+		return err
+	}
+
+	setSessionCookie(w, token)
+	return nil
+}
+
+// lookupSession returns the unexpired session matching the request's auth
+// cookie, or nil if there isn't one.
+func (app *App) lookupSession(r *http.Request) (*Session, string, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, "", nil
+	}
+
+	var s Session
+	err = app.db.QueryRow(`
+		SELECT s.id, s.user_id, u.username, u.role, s.ip, s.user_agent, s.created_at, s.last_seen_at, s.expires_at, s.csrf_token
+		FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > CURRENT_TIMESTAMP AND u.disabled = 0
+	`, hashToken(cookie.Value)).Scan(&s.ID, &s.UserID, &s.Username, &s.Role, &s.IP, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.CSRFToken)
+	if err == sql.ErrNoRows {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &s, cookie.Value, nil
+}
+
+// touchSession slides the session's expiry forward and refreshes the cookie.
+func (app *App) touchSession(w http.ResponseWriter, s *Session, token string) error {
+	if time.Since(s.LastSeenAt) < sessionTouchInterval {
+		return nil
+	}
+
+	expiresAt := time.Now().Add(sessionDuration)
+	_, err := app.db.Exec(`
+		UPDATE sessions
+		SET last_seen_at = CURRENT_TIMESTAMP, expires_at = ?
+		WHERE id = ?
+	`, sqlTime(expiresAt), s.ID)
+	if err != nil {
+		return err
+	}
+
+	s.LastSeenAt = time.Now()
+	s.ExpiresAt = expiresAt
+	setSessionCookie(w, token)
+	return nil
+}
+
+// currentSession returns the session attached by requireAuth, falling back
+// to a lookup for public pages that aren't wrapped in it.
+func (app *App) currentSession(r *http.Request) *Session {
+	if s, ok := r.Context().Value(sessionContextKey).(*Session); ok {
+		return s
+	}
+	s, _, err := app.lookupSession(r)
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+func withSession(r *http.Request, s *Session) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionContextKey, s))
+}
+
+func (app *App) deleteSession(r *http.Request) error {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	_, err = app.db.Exec("DELETE FROM sessions WHERE token_hash = ?", hashToken(cookie.Value))
+	return err
+}
@@ -14,20 +14,30 @@ func (app *App) handleHome(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	modified, count, err := app.publishedPostsVersion("essay", "note")
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if app.notModified(w, r, modified, count) {
+		return
+	}
+
 	rows, err := app.db.Query(`
 		WITH ranked_posts AS (
 			SELECT
 				id,
 				title,
 				slug,
-				content,
+				content_html,
+				summary_html,
 				post_type,
 				created_at,
 				ROW_NUMBER() OVER (PARTITION BY post_type ORDER BY created_at DESC) as rn
 			FROM posts
-			WHERE post_type IN ('essay', 'note')
+			WHERE post_type IN ('essay', 'note') AND published = 1
 		)
-		SELECT id, title, slug, content, post_type, created_at 
+		SELECT id, title, slug, COALESCE(NULLIF(summary_html, ''), content_html), summary_html != '', post_type, created_at
 		FROM ranked_posts
 		WHERE rn <= 5
 		ORDER BY post_type, rn
@@ -42,10 +52,9 @@ func (app *App) handleHome(w http.ResponseWriter, r *http.Request) {
 	var notes []Post
 	for rows.Next() {
 		var p Post
-		if err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.Content, &p.PostType, &p.CreatedAt); err != nil {
+		if err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.SummaryHTML, &p.HasMore, &p.PostType, &p.CreatedAt); err != nil {
 			continue
 		}
-		p.HTMLContent = app.markdownToHTML(p.Content)
 		p.Tags = app.getPostTags(p.ID)
 
 		switch p.PostType {
@@ -74,21 +83,22 @@ func (app *App) handlePage(w http.ResponseWriter, r *http.Request) {
 
 	var page Page
 	err := app.db.QueryRow(`
-		SELECT id, title, slug, content, created_at 
-		FROM pages 
+		SELECT id, title, slug, content_html, created_at, updated_at
+		FROM pages
 		WHERE slug = ? AND published = 1
-	`, slug).Scan(&page.ID, &page.Title, &page.Slug, &page.Content, &page.CreatedAt)
+	`, slug).Scan(&page.ID, &page.Title, &page.Slug, &page.HTMLContent, &page.CreatedAt, &page.UpdatedAt)
 
 	if err == sql.ErrNoRows {
-		http.NotFound(w, r)
+		app.notFound(w, r)
 		return
 	}
 	if err != nil {
 		app.httpError(w, err, http.StatusInternalServerError)
 		return
 	}
-
-	page.HTMLContent = app.markdownToHTML(page.Content)
+	if app.notModified(w, r, page.UpdatedAt, 1) {
+		return
+	}
 
 	data := map[string]any{
 		"Page":            page,
@@ -109,21 +119,23 @@ func (app *App) handlePosts(postType string) http.HandlerFunc {
 
 		var post Post
 		err := app.db.QueryRow(`
-			SELECT id, title, slug, content, post_type, created_at, updated_at
+			SELECT id, title, slug, content_html, post_type, created_at, updated_at
 			FROM posts
 			WHERE slug = ? AND post_type = ? AND published = 1
-		`, slug, postType).Scan(&post.ID, &post.Title, &post.Slug, &post.Content, &post.PostType, &post.CreatedAt, &post.UpdatedAt)
+		`, slug, postType).Scan(&post.ID, &post.Title, &post.Slug, &post.HTMLContent, &post.PostType, &post.CreatedAt, &post.UpdatedAt)
 
 		if err == sql.ErrNoRows {
-			http.NotFound(w, r)
+			app.notFound(w, r)
 			return
 		}
 		if err != nil {
 			app.httpError(w, err, http.StatusInternalServerError)
 			return
 		}
+		if app.notModified(w, r, post.UpdatedAt, 1) {
+			return
+		}
 
-		post.HTMLContent = app.markdownToHTML(post.Content)
 		post.Tags = app.getPostTags(post.ID)
 
 		data := map[string]any{
@@ -141,12 +153,34 @@ func (app *App) handlePosts(postType string) http.HandlerFunc {
 
 func (app *App) handlePostsList(postType string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		base := "/" + postType + "s"
+		page, ok := app.listPage(w, r, base)
+		if !ok {
+			return
+		}
+
+		modified, count, err := app.publishedPostsVersion(postType)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		pagination := newPagination(page, count, postsPerPage, func(n int) string { return listPageURL(base, n) })
+		if page > pagination.TotalPages {
+			app.notFound(w, r)
+			return
+		}
+		if app.notModified(w, r, modified, count) {
+			return
+		}
+
 		rows, err := app.db.Query(`
-			SELECT id, title, slug, content, post_type, created_at, updated_at
+			SELECT id, title, slug, COALESCE(NULLIF(summary_html, ''), content_html), summary_html != '', post_type, created_at, updated_at
 			FROM posts
 			WHERE post_type = ? AND published = 1
 			ORDER BY created_at DESC
-		`, postType)
+			LIMIT ? OFFSET ?
+		`, postType, postsPerPage, (page-1)*postsPerPage)
 		if err != nil {
 			app.httpError(w, err, http.StatusInternalServerError)
 			return
@@ -156,10 +190,9 @@ func (app *App) handlePostsList(postType string) http.HandlerFunc {
 		var posts []Post
 		for rows.Next() {
 			var p Post
-			if err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.Content, &p.PostType, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			if err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.SummaryHTML, &p.HasMore, &p.PostType, &p.CreatedAt, &p.UpdatedAt); err != nil {
 				continue
 			}
-			p.HTMLContent = app.markdownToHTML(p.Content)
 			p.Tags = app.getPostTags(p.ID)
 			posts = append(posts, p)
 		}
@@ -167,6 +200,9 @@ func (app *App) handlePostsList(postType string) http.HandlerFunc {
 		data := map[string]any{
 			"Posts":           posts,
 			"PostType":        titleCase(postType),
+			"FeedPath":        feedPath(postType, ""),
+			"FeedTitle":       titleCase(postType) + "s",
+			"Pagination":      pagination,
 			"IsAuthenticated": app.isAuthenticated(r),
 		}
 
@@ -179,11 +215,29 @@ func (app *App) handlePostsList(postType string) http.HandlerFunc {
 }
 
 func (app *App) handleTags(w http.ResponseWriter, r *http.Request) {
+	modified, count, err := app.publishedPostsVersion()
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	// Renames and merges change the list without touching any post
+	tagsModified, tagCount, err := app.contentVersion("SELECT MAX(updated_at), COUNT(*) FROM tags")
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if tagsModified.After(modified) {
+		modified = tagsModified
+	}
+	if app.notModified(w, r, modified, count, tagCount) {
+		return
+	}
+
 	rows, err := app.db.Query(`
-		SELECT t.name, COUNT(pt.post_id) as count
+		SELECT t.name, t.slug, COUNT(pt.post_id) as count
 		FROM tags t
 		LEFT JOIN post_tags pt ON t.id = pt.tag_id
-		GROUP BY t.id, t.name
+		GROUP BY t.id
 		ORDER BY t.name
 	`)
 	if err != nil {
@@ -195,7 +249,7 @@ func (app *App) handleTags(w http.ResponseWriter, r *http.Request) {
 	var tags []Tag
 	for rows.Next() {
 		var tag Tag
-		if err := rows.Scan(&tag.Name, &tag.Count); err != nil {
+		if err := rows.Scan(&tag.Name, &tag.Slug, &tag.Count); err != nil {
 			continue
 		}
 		if tag.Count > 0 {
@@ -216,16 +270,58 @@ func (app *App) handleTags(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *App) handleTagPosts(w http.ResponseWriter, r *http.Request) {
-	tagName := strings.TrimPrefix(r.URL.Path, "/tags/")
+	tag, ok := app.tagFromURL(w, r)
+	if !ok {
+		return
+	}
+	base := "/tags/" + tag.Slug
+	page, ok := app.listPage(w, r, base)
+	if !ok {
+		return
+	}
+
+	// Any post could have gained or lost the tag, so all of them count, as
+	// does the tag's own description
+	modified, count, err := app.publishedPostsVersion()
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if tag.UpdatedAt.After(modified) {
+		modified = tag.UpdatedAt
+	}
+
+	var total int
+	err = app.db.QueryRow(`
+		SELECT COUNT(*)
+		FROM posts p
+		JOIN post_tags pt ON p.id = pt.post_id
+		JOIN tags t ON pt.tag_id = t.id
+		WHERE t.id = ? AND p.published = 1
+	`, tag.ID).Scan(&total)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	pagination := newPagination(page, total, postsPerPage, func(n int) string { return listPageURL(base, n) })
+	if page > pagination.TotalPages {
+		app.notFound(w, r)
+		return
+	}
+	if app.notModified(w, r, modified, count) {
+		return
+	}
 
 	rows, err := app.db.Query(`
-		SELECT p.id, p.title, p.slug, p.content, p.post_type, p.created_at
+		SELECT p.id, p.title, p.slug, COALESCE(NULLIF(p.summary_html, ''), p.content_html), p.summary_html != '', p.post_type, p.created_at
 		FROM posts p
 		JOIN post_tags pt ON p.id = pt.post_id
 		JOIN tags t ON pt.tag_id = t.id
-		WHERE t.name = ? AND p.published = 1
+		WHERE t.id = ? AND p.published = 1
 		ORDER BY p.created_at DESC
-	`, tagName)
+		LIMIT ? OFFSET ?
+	`, tag.ID, postsPerPage, (page-1)*postsPerPage)
 	if err != nil {
 		app.httpError(w, err, http.StatusInternalServerError)
 		return
@@ -235,17 +331,20 @@ func (app *App) handleTagPosts(w http.ResponseWriter, r *http.Request) {
 	var posts []Post
 	for rows.Next() {
 		var p Post
-		if err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.Content, &p.PostType, &p.CreatedAt); err != nil {
+		if err := rows.Scan(&p.ID, &p.Title, &p.Slug, &p.SummaryHTML, &p.HasMore, &p.PostType, &p.CreatedAt); err != nil {
 			continue
 		}
-		p.HTMLContent = app.markdownToHTML(p.Content)
 		p.Tags = app.getPostTags(p.ID)
 		posts = append(posts, p)
 	}
 
 	data := map[string]any{
 		"Posts":           posts,
-		"TagName":         tagName,
+		"TagName":         tag.Name,
+		"Description":     app.markdownToHTML(tag.Description, true),
+		"FeedPath":        feedPath("", tag.Slug),
+		"FeedTitle":       "Posts tagged " + tag.Name,
+		"Pagination":      pagination,
 		"IsAuthenticated": app.isAuthenticated(r),
 	}
 
@@ -259,13 +358,13 @@ func (app *App) handleTagPosts(w http.ResponseWriter, r *http.Request) {
 func (app *App) handleNow(w http.ResponseWriter, r *http.Request) {
 	var now Post
 	err := app.db.QueryRow(`
-		SELECT p.id, p.title, p.slug, p.content, p.created_at, p.updated_at
+		SELECT p.id, p.title, p.slug, p.content_html, p.created_at, p.updated_at
 		FROM posts p
 		JOIN post_tags pt ON p.id = pt.post_id
 		JOIN tags t ON pt.tag_id = t.id
-		WHERE t.name = ? AND p.published = 1
+		WHERE t.slug = ? AND p.published = 1
 		ORDER BY p.created_at DESC LIMIT 1
-	`, "now").Scan(&now.ID, &now.Title, &now.Slug, &now.Content, &now.CreatedAt, &now.UpdatedAt)
+	`, "now").Scan(&now.ID, &now.Title, &now.Slug, &now.HTMLContent, &now.CreatedAt, &now.UpdatedAt)
 
 	if err == sql.ErrNoRows {
 		http.NotFound(w, r)
@@ -275,8 +374,9 @@ func (app *App) handleNow(w http.ResponseWriter, r *http.Request) {
 		app.httpError(w, err, http.StatusInternalServerError)
 		return
 	}
-
-	now.HTMLContent = app.markdownToHTML(now.Content)
+	if app.notModified(w, r, now.UpdatedAt, 1) {
+		return
+	}
 
 	canonicalURL := fmt.Sprintf("%s/notes/%s", baseURL, now.Slug)
 
@@ -301,6 +401,21 @@ func (app *App) handleSitemap(w http.ResponseWriter, r *http.Request) {
 	}
 	baseURL := scheme + "://" + r.Host
 
+	modified, count, err := app.contentVersion(`
+		SELECT MAX(updated_at), COUNT(*) FROM (
+			SELECT updated_at FROM posts WHERE published = 1
+			UNION ALL
+			SELECT updated_at FROM pages WHERE published = 1
+		)
+	`)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if app.notModified(w, r, modified, count) {
+		return
+	}
+
 	sitemap, err := app.generateSitemap(baseURL)
 	if err != nil {
 		app.httpError(w, err, http.StatusInternalServerError)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/xml"
+	"net/url"
 	"time"
 )
 
@@ -104,20 +105,20 @@ func (app *App) generateSitemap(baseURL string) (*URLSet, error) {
 	}
 
 	// Add tag pages
-	tagRows, err := app.db.Query(`SELECT DISTINCT name FROM tags ORDER BY name`)
+	tagRows, err := app.db.Query(`SELECT slug FROM tags ORDER BY slug`)
 	if err != nil {
 		return nil, err
 	}
 	defer tagRows.Close()
 
 	for tagRows.Next() {
-		var tagName string
-		if err := tagRows.Scan(&tagName); err != nil {
+		var tagSlug string
+		if err := tagRows.Scan(&tagSlug); err != nil {
 			continue
 		}
 
 		urls = append(urls, URL{
-			Loc:        baseURL + "/tags/" + tagName,
+			Loc:        baseURL + "/tags/" + url.PathEscape(tagSlug),
 			ChangeFreq: "weekly",
 			Priority:   0.5,
 		})
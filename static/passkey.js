@@ -0,0 +1,104 @@
+// Passkey registration and sign in. Buttons opt in with data-passkey-login or
+// data-passkey-register and carry the CSRF token in data-csrf.
+(function () {
+    function toBase64URL(buffer) {
+        var bytes = new Uint8Array(buffer);
+        var str = "";
+        for (var i = 0; i < bytes.length; i++) {
+            str += String.fromCharCode(bytes[i]);
+        }
+        return btoa(str).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+    }
+
+    function fromBase64URL(value) {
+        var str = atob(value.replace(/-/g, "+").replace(/_/g, "/"));
+        var bytes = new Uint8Array(str.length);
+        for (var i = 0; i < str.length; i++) {
+            bytes[i] = str.charCodeAt(i);
+        }
+        return bytes.buffer;
+    }
+
+    function post(url, csrf, body) {
+        return fetch(url, {
+            method: "POST",
+            credentials: "same-origin",
+            headers: {"Content-Type": "application/json", "X-CSRF-Token": csrf},
+            body: JSON.stringify(body || {})
+        }).then(function (resp) {
+            return resp.json().then(function (data) {
+                if (!resp.ok) {
+                    throw new Error(data.error || "Request failed");
+                }
+                return data;
+            });
+        });
+    }
+
+    function showError(button, message) {
+        var target = document.getElementById(button.dataset.error);
+        if (target) {
+            target.textContent = message;
+        }
+    }
+
+    function login(button) {
+        var csrf = button.dataset.csrf;
+        post("/login/passkey/begin", csrf).then(function (options) {
+            options.challenge = fromBase64URL(options.challenge);
+            return navigator.credentials.get({publicKey: options});
+        }).then(function (credential) {
+            return post("/login/passkey/finish", csrf, {
+                id: credential.id,
+                clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+                authenticatorData: toBase64URL(credential.response.authenticatorData),
+                signature: toBase64URL(credential.response.signature)
+            });
+        }).then(function (data) {
+            window.location = data.redirect;
+        }).catch(function (err) {
+            showError(button, err.message);
+        });
+    }
+
+    function register(button) {
+        var csrf = button.dataset.csrf;
+        var nameInput = document.getElementById(button.dataset.name);
+        post("/admin/security/passkeys/begin", csrf).then(function (options) {
+            options.challenge = fromBase64URL(options.challenge);
+            options.user.id = fromBase64URL(options.user.id);
+            options.excludeCredentials.forEach(function (c) {
+                c.id = fromBase64URL(c.id);
+            });
+            return navigator.credentials.create({publicKey: options});
+        }).then(function (credential) {
+            return post("/admin/security/passkeys/finish", csrf, {
+                name: nameInput ? nameInput.value : "",
+                clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+                attestationObject: toBase64URL(credential.response.attestationObject)
+            });
+        }).then(function () {
+            window.location.reload();
+        }).catch(function (err) {
+            showError(button, err.message);
+        });
+    }
+
+    document.addEventListener("DOMContentLoaded", function () {
+        var buttons = document.querySelectorAll("[data-passkey-login], [data-passkey-register]");
+        buttons.forEach(function (button) {
+            if (!window.PublicKeyCredential) {
+                button.hidden = true;
+                return;
+            }
+            button.addEventListener("click", function (event) {
+                event.preventDefault();
+                if (button.hasAttribute("data-passkey-login")) {
+                    login(button);
+                } else {
+                    register(button);
+                }
+            });
+        });
+    });
+})();
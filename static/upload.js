@@ -0,0 +1,186 @@
+// Media uploads with progress. A form marked data-upload-form sends its files
+// one at a time and lists the results. A textarea marked data-upload takes
+// files dropped or pasted into it, or picked in its data-upload-tools block,
+// and puts their Markdown where the cursor was.
+(function () {
+    var queue = Promise.resolve();
+
+    // upload sends one file and resolves with its entry from the JSON
+    // response. Uploads wait their turn so progress reads file by file.
+    function upload(file, csrf, fields, onProgress) {
+        var next = queue.then(function () {
+            return new Promise(function (resolve, reject) {
+                var body = new FormData();
+                body.append("image", file);
+                Object.keys(fields || {}).forEach(function (name) {
+                    body.append(name, fields[name]);
+                });
+
+                var xhr = new XMLHttpRequest();
+                xhr.open("POST", "/admin/media/new");
+                xhr.setRequestHeader("Accept", "application/json");
+                xhr.setRequestHeader("X-CSRF-Token", csrf);
+                xhr.upload.addEventListener("progress", function (event) {
+                    if (event.lengthComputable && onProgress) {
+                        onProgress(Math.round(event.loaded / event.total * 100));
+                    }
+                });
+                xhr.addEventListener("load", function () {
+                    var data;
+                    try {
+                        data = JSON.parse(xhr.responseText);
+                    } catch (err) {
+                        reject(new Error("Upload failed (" + xhr.status + ")"));
+                        return;
+                    }
+                    var result = data.files && data.files[0];
+                    if (!result) {
+                        reject(new Error(data.error || "Upload failed"));
+                    } else if (result.error) {
+                        reject(new Error(result.error));
+                    } else {
+                        resolve(result);
+                    }
+                });
+                xhr.addEventListener("error", function () {
+                    reject(new Error("Upload failed. Check your connection."));
+                });
+                xhr.send(body);
+            });
+        });
+        queue = next.catch(function () {});
+        return next;
+    }
+
+    function filesFrom(transfer) {
+        return transfer ? Array.prototype.slice.call(transfer.files || []) : [];
+    }
+
+    function setupForm(form) {
+        var input = form.querySelector("input[type=file]");
+        var results = document.getElementById(form.dataset.results);
+
+        function send(files) {
+            var fields = {
+                alt_text: form.elements.alt_text.value,
+                caption: form.elements.caption.value
+            };
+            files.forEach(function (file) {
+                var item = document.createElement("li");
+                item.textContent = file.name + ": waiting";
+                results.appendChild(item);
+
+                upload(file, form.dataset.csrf, fields, function (percent) {
+                    item.textContent = file.name + ": " + percent + "%";
+                }).then(function (result) {
+                    item.textContent = "";
+                    var link = document.createElement("a");
+                    link.href = "/admin/media/edit/" + result.id;
+                    link.textContent = file.name;
+                    var markdown = document.createElement("input");
+                    markdown.type = "text";
+                    markdown.readOnly = true;
+                    markdown.value = result.markdown;
+                    markdown.addEventListener("focus", function () {
+                        markdown.select();
+                    });
+                    item.appendChild(link);
+                    item.appendChild(document.createTextNode(result.duplicate ? " (already in the library) " : " "));
+                    item.appendChild(markdown);
+                }).catch(function (err) {
+                    item.textContent = err.message;
+                    item.className = "red";
+                });
+            });
+        }
+
+        form.addEventListener("submit", function (event) {
+            event.preventDefault();
+            send(filesFrom(input));
+            form.reset();
+        });
+        form.addEventListener("dragover", function (event) {
+            event.preventDefault();
+        });
+        form.addEventListener("drop", function (event) {
+            var files = filesFrom(event.dataTransfer);
+            if (files.length) {
+                event.preventDefault();
+                send(files);
+            }
+        });
+    }
+
+    function setupEditor(textarea) {
+        var tools = document.querySelector("[data-upload-tools='" + textarea.id + "']");
+        var status = tools && tools.querySelector(".upload-status");
+        var count = 0;
+
+        function report(message, isError) {
+            if (status) {
+                status.textContent = message;
+                status.className = isError ? "red" : "";
+            }
+        }
+
+        // replace swaps the placeholder for text, wherever edits since have
+        // moved it.
+        function replace(placeholder, text) {
+            var at = textarea.value.indexOf(placeholder);
+            if (at !== -1) {
+                textarea.setRangeText(text, at, at + placeholder.length, "preserve");
+            }
+        }
+
+        function send(files) {
+            files.forEach(function (file) {
+                count++;
+                var placeholder = "![Uploading " + file.name + "…](#upload-" + count + ")";
+                textarea.setRangeText(placeholder, textarea.selectionStart, textarea.selectionEnd, "end");
+
+                upload(file, textarea.dataset.csrf, {}, function (percent) {
+                    report("Uploading " + file.name + ": " + percent + "%");
+                }).then(function (result) {
+                    replace(placeholder, result.markdown);
+                    report(file.name + (result.duplicate ? " was already in the library." : " uploaded."));
+                }).catch(function (err) {
+                    replace(placeholder, "");
+                    report(err.message, true);
+                });
+            });
+        }
+
+        textarea.addEventListener("dragover", function (event) {
+            event.preventDefault();
+        });
+        textarea.addEventListener("drop", function (event) {
+            var files = filesFrom(event.dataTransfer);
+            if (files.length) {
+                event.preventDefault();
+                textarea.focus();
+                send(files);
+            }
+        });
+        textarea.addEventListener("paste", function (event) {
+            var files = filesFrom(event.clipboardData);
+            if (files.length) {
+                event.preventDefault();
+                send(files);
+            }
+        });
+
+        if (tools) {
+            var input = tools.querySelector("input[type=file]");
+            input.addEventListener("change", function () {
+                send(filesFrom(input));
+                input.value = "";
+            });
+            tools.hidden = false;
+        }
+    }
+
+    document.addEventListener("DOMContentLoaded", function () {
+        document.querySelectorAll("[data-upload-form]").forEach(setupForm);
+        document.querySelectorAll("textarea[data-upload]").forEach(setupEditor);
+    });
+})();
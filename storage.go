@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MediaStore is where uploaded media lives. Names are slash separated paths
+// relative to the root of the store, like "2025/photo_1736000000.jpg".
+type MediaStore interface {
+	Put(name, contentType string, r io.Reader) error
+	List() ([]MediaFile, error)
+	Delete(name string) error
+	URL(name string) string
+}
+
+type MediaFile struct {
+	Path     string
+	Size     int64
+	Modified time.Time
+}
+
+// newMediaStore picks the media backend from MEDIA_STORE, "bunny" or "local".
+// When it's unset Bunny is used if a storage zone is configured, and the
+// local disk otherwise.
+func newMediaStore() (MediaStore, error) {
+	kind := os.Getenv("MEDIA_STORE")
+	if kind == "" {
+		kind = "local"
+		if os.Getenv("STORAGE_ZONE") != "" {
+			kind = "bunny"
+		}
+	}
+
+	switch kind {
+	case "bunny":
+		bc := NewBunnyClient()
+		if bc.config.StorageZone == "" || bc.config.AccessKey == "" || bc.config.PullZoneURL == "" {
+			return nil, errors.New("the bunny media store needs STORAGE_ZONE, ACCESS_KEY and PULL_ZONE_URL")
+		}
+		return bc, nil
+	case "local":
+		dir := os.Getenv("MEDIA_DIR")
+		if dir == "" {
+			dir = "media"
+		}
+		return NewLocalStore(dir), nil
+	}
+	return nil, fmt.Errorf("unknown MEDIA_STORE %q, expected bunny or local", kind)
+}
+
+// LocalStore keeps media in a directory on disk, served by the app itself
+// under /media/.
+type LocalStore struct {
+	dir string
+}
+
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{dir: dir}
+}
+
+func (s *LocalStore) path(name string) (string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return "", fmt.Errorf("invalid media path %q", name)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+// Put writes to a temporary file first so a failed upload never leaves a
+// partial file behind under the real name.
+func (s *LocalStore) Put(name, contentType string, r io.Reader) error {
+	full, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(full), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), full)
+}
+
+func (s *LocalStore) List() ([]MediaFile, error) {
+	var files []MediaFile
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == s.dir {
+			return fs.SkipAll
+		}
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, MediaFile{
+			Path:     filepath.ToSlash(rel),
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// Delete removes a file and then any directories it leaves empty.
+func (s *LocalStore) Delete(name string) error {
+	full, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(full); err != nil {
+		return err
+	}
+
+	root := filepath.Clean(s.dir)
+	for dir := filepath.Dir(full); dir != root && dir != "."; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *LocalStore) URL(name string) string {
+	return "/media/" + (&url.URL{Path: name}).EscapedPath()
+}
+
+// ServeHTTP serves files under /media/. Directories aren't listed.
+func (s *LocalStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	full, err := s.path(strings.TrimPrefix(r.URL.Path, "/media/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(full)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
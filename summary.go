@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+const moreMarker = "<!--more-->"
+
+// summarySource picks the Markdown a post is summarised by: the summary
+// written for it, else everything before <!--more-->, else its first
+// paragraph. It returns "" when that would be the whole post anyway.
+func (app *App) summarySource(summary, content string) string {
+	if summary = strings.TrimSpace(summary); summary != "" {
+		return summary
+	}
+
+	if before, after, ok := strings.Cut(content, moreMarker); ok {
+		if strings.TrimSpace(after) == "" {
+			return ""
+		}
+		return strings.TrimSpace(before)
+	}
+
+	source := []byte(content)
+	doc := app.markdown.Parser().Parse(text.NewReader(source))
+	for node := doc.FirstChild(); node != nil; node = node.NextSibling() {
+		if node.Kind() != ast.KindParagraph || node.Lines().Len() == 0 {
+			continue
+		}
+		lines := node.Lines()
+		start, end := lines.At(0).Start, lines.At(lines.Len()-1).Stop
+		if strings.TrimSpace(content[:start]) == "" && strings.TrimSpace(content[end:]) == "" {
+			return ""
+		}
+		return content[start:end]
+	}
+	return ""
+}
+
+// summaryHTML renders what lists and feeds show in place of the full post,
+// or "" when they should show all of it. rawHTML is as for the post itself.
+func (app *App) summaryHTML(summary, content string, rawHTML bool) string {
+	source := app.summarySource(summary, content)
+	if source == "" {
+		return ""
+	}
+	return string(app.markdownToHTML(source, rawHTML))
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// tagSymbols spells out the symbols that tell tags like C, C++ and C# apart,
+// so they don't all end up as "c".
+var tagSymbols = map[rune]string{
+	'+': "plus",
+	'#': "sharp",
+	'&': "and",
+	'@': "at",
+}
+
+// tagSlug turns a tag name into the lowercase, hyphenated form used in its
+// URL. Other punctuation separates words, except a dot starting a word, as in
+// .NET, which is spelled out too. Names can still share a slug, like "Go" and
+// "Go!", so new tags get theirs from newTagSlug.
+func tagSlug(name string) string {
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+
+	var words []string
+	var word strings.Builder
+	endWord := func() {
+		if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+
+	runes := []rune(strings.ToLower(name))
+	for i, r := range runes {
+		switch {
+		case isWord(r):
+			word.WriteRune(r)
+		case tagSymbols[r] != "":
+			endWord()
+			words = append(words, tagSymbols[r])
+		case r == '.' && (i == 0 || !isWord(runes[i-1])) && i+1 < len(runes) && isWord(runes[i+1]):
+			endWord()
+			words = append(words, "dot")
+		default:
+			endWord()
+		}
+	}
+	endWord()
+	return strings.Join(words, "-")
+}
+
+// findTag returns the tag called name, ignoring case, other than the tag
+// exceptID. Its ID is 0 when there's none.
+func findTag(tx *sql.Tx, name string, exceptID int) (Tag, error) {
+	base := tagSlug(name)
+	rows, err := tx.Query(`
+		SELECT id, name, COALESCE(slug, '') FROM tags
+		WHERE (name = ? COLLATE NOCASE OR slug = ? OR slug GLOB ?) AND id != ?
+		ORDER BY id
+	`, name, base, base+"-[0-9]*", exceptID)
+	if err != nil {
+		return Tag{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Slug); err != nil {
+			return Tag{}, err
+		}
+		if strings.EqualFold(tag.Name, name) {
+			return tag, nil
+		}
+	}
+	return Tag{}, rows.Err()
+}
+
+// newTagSlug returns the slug for a tag called name: the name's slug,
+// numbered when a tag other than exceptID already has it.
+func newTagSlug(tx *sql.Tx, name string, exceptID int) (string, error) {
+	base := tagSlug(name)
+	rows, err := tx.Query("SELECT slug FROM tags WHERE (slug = ? OR slug GLOB ?) AND id != ?", base, base+"-[0-9]*", exceptID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	taken := make(map[string]bool)
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return "", err
+		}
+		taken[slug] = true
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	slug := base
+	for n := 2; taken[slug]; n++ {
+		slug = base + "-" + strconv.Itoa(n)
+	}
+	return slug, nil
+}
+
+// tagNameProblem explains what's wrong with a tag name, or returns "". Commas
+// separate tags in the editor.
+func tagNameProblem(name string) string {
+	switch {
+	case name == "":
+		return "Tags need a name"
+	case strings.Contains(name, ","):
+		return "Tag names can't contain commas"
+	case tagSlug(name) == "":
+		return "Tag names need at least one letter or digit"
+	}
+	return ""
+}
+
+// sameTagNames reports whether two lists name the same tags, ignoring case
+// and order.
+func sameTagNames(a, b []string) bool {
+	byName := func(x, y string) int {
+		return strings.Compare(strings.ToLower(x), strings.ToLower(y))
+	}
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.SortFunc(a, byName)
+	slices.SortFunc(b, byName)
+	return slices.EqualFunc(a, b, strings.EqualFold)
+}
+
+// backfillTagSlugs gives tags from before slugs existed one. Tags whose
+// names only differ in case are left for an editor to merge, since they might
+// not be the same tag after all.
+func (app *App) backfillTagSlugs() error {
+	rows, err := app.db.Query("SELECT id, name FROM tags WHERE slug IS NULL ORDER BY id")
+	if err != nil {
+		return err
+	}
+	var tags []Tag
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.ID, &tag.Name); err != nil {
+			rows.Close()
+			return err
+		}
+		tags = append(tags, tag)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, tag := range tags {
+		other, err := findTag(tx, tag.Name, tag.ID)
+		if err != nil {
+			return err
+		}
+		if other.ID != 0 && other.ID < tag.ID {
+			log.Printf("Tags %q and %q only differ in case. Merge them on the tags page if they're the same tag.", other.Name, tag.Name)
+		}
+
+		slug := "tag-" + strconv.Itoa(tag.ID)
+		if tagSlug(tag.Name) != "" {
+			if slug, err = newTagSlug(tx, tag.Name, tag.ID); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("UPDATE tags SET slug = ? WHERE id = ?", slug, tag.ID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// mergeTag moves the posts of one tag onto another, keeps its description if
+// the other has none, and deletes it.
+func mergeTag(tx *sql.Tx, fromID, intoID int) error {
+	if err := touchTagPosts(tx, fromID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT OR IGNORE INTO post_tags (post_id, tag_id)
+		SELECT post_id, ? FROM post_tags WHERE tag_id = ?
+	`, intoID, fromID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE tags SET description = (SELECT description FROM tags WHERE id = ?),
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND description = ''
+	`, fromID, intoID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM tags WHERE id = ?", fromID)
+	return err
+}
+
+// tagFromURL looks up the tag named by {slug} in the URL. Links that use a
+// different spelling of the slug, like the tag's name from before slugs, get
+// a 301 to the canonical URL first, so redirects left by renames and merges
+// apply to them too. It reports false once the response is written.
+func (app *App) tagFromURL(w http.ResponseWriter, r *http.Request) (Tag, bool) {
+	value := r.PathValue("slug")
+
+	var tag Tag
+	if slug := tagSlug(value); slug != "" && slug != value {
+		// Old links used the tag's name. The tag that has that name now may
+		// have a numbered slug, so go by what's stored before guessing.
+		err := app.db.QueryRow(`
+			SELECT slug FROM tags
+			WHERE name = ? COLLATE NOCASE
+			ORDER BY name = ? DESC, id
+			LIMIT 1
+		`, value, value).Scan(&slug)
+		if err != nil && err != sql.ErrNoRows {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return tag, false
+		}
+		rest := strings.TrimPrefix(r.URL.Path, "/tags/"+value)
+		http.Redirect(w, r, (&url.URL{Path: "/tags/" + slug + rest}).EscapedPath(), http.StatusMovedPermanently)
+		return tag, false
+	}
+
+	var updatedAt sql.NullTime
+	err := app.db.QueryRow("SELECT id, name, slug, description, updated_at FROM tags WHERE slug = ?", value).
+		Scan(&tag.ID, &tag.Name, &tag.Slug, &tag.Description, &updatedAt)
+	if err == sql.ErrNoRows {
+		app.notFound(w, r)
+		return tag, false
+	}
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return tag, false
+	}
+	tag.UpdatedAt = updatedAt.Time
+	return tag, true
+}
+
+// touchTagPosts bumps updated_at on every post with the tag, since the tags
+// they show are about to change.
+func touchTagPosts(tx *sql.Tx, tagID int) error {
+	_, err := tx.Exec(`
+		UPDATE posts SET updated_at = CURRENT_TIMESTAMP
+		WHERE id IN (SELECT post_id FROM post_tags WHERE tag_id = ?)
+	`, tagID)
+	return err
+}
+
+// redirectTag sends links to a renamed or merged tag, and its later pages and
+// feeds, to the tag that replaced it.
+func redirectTag(tx *sql.Tx, oldSlug, newSlug string) error {
+	if oldSlug == newSlug {
+		return nil
+	}
+	if err := addRedirect(tx, "/tags/"+oldSlug, "/tags/"+newSlug, true); err != nil {
+		return err
+	}
+	return addRedirect(tx, "/tags/"+oldSlug+"/*", "/tags/"+newSlug+"/*", true)
+}
+
+func (app *App) handleAdminTags(w http.ResponseWriter, r *http.Request) {
+	app.renderTags(w, r, nil)
+}
+
+func (app *App) renderTags(w http.ResponseWriter, r *http.Request, extra map[string]any) {
+	rows, err := app.db.Query(`
+		SELECT t.id, t.name, t.slug, t.description, COUNT(pt.post_id)
+		FROM tags t
+		LEFT JOIN post_tags pt ON t.id = pt.tag_id
+		GROUP BY t.id
+		ORDER BY t.name COLLATE NOCASE, t.name
+	`)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var tags []Tag
+	orphans := 0
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Slug, &tag.Description, &tag.Count); err != nil {
+			continue
+		}
+		if tag.Count == 0 {
+			orphans++
+		}
+		tags = append(tags, tag)
+	}
+
+	data := map[string]any{
+		"Tags":      tags,
+		"Orphans":   orphans,
+		"CSRFToken": app.csrfToken(w, r),
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	err = app.templates["admin_tags.html"].ExecuteTemplate(w, "admin_base", data)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+}
+
+func (app *App) handleEditTag(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.PathValue("id"))
+
+	var tag Tag
+	err := app.db.QueryRow("SELECT id, name, slug, description FROM tags WHERE id = ?", id).Scan(&tag.ID, &tag.Name, &tag.Slug, &tag.Description)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	render := func(extra map[string]any) {
+		data := map[string]any{
+			"Tag":       tag,
+			"CSRFToken": app.csrfToken(w, r),
+		}
+		for k, v := range extra {
+			data[k] = v
+		}
+		err := app.templates["admin_tag_form.html"].ExecuteTemplate(w, "admin_base", data)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+		}
+	}
+
+	if r.Method == "GET" {
+		render(nil)
+		return
+	}
+
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	oldName, oldSlug := tag.Name, tag.Slug
+	tag.Name = strings.TrimSpace(r.FormValue("name"))
+	tag.Description = strings.TrimSpace(r.FormValue("description"))
+
+	if problem := tagNameProblem(tag.Name); problem != "" {
+		render(map[string]any{"Error": problem})
+		return
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	other, err := findTag(tx, tag.Name, id)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if other.ID != 0 {
+		render(map[string]any{"Error": "That's the same tag as " + other.Name + ". Merge the two instead."})
+		return
+	}
+
+	// Changing just the case keeps the URL
+	if !strings.EqualFold(tag.Name, oldName) {
+		if tag.Slug, err = newTagSlug(tx, tag.Name, id); err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE tags SET name = ?, slug = ?, description = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", tag.Name, tag.Slug, tag.Description, id); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if tag.Name != oldName {
+		if err := touchTagPosts(tx, id); err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := redirectTag(tx, oldSlug, tag.Slug); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/tags", http.StatusSeeOther)
+}
+
+// handleMergeTags moves every post from the selected tags onto the tag named
+// in the form, creating it from the first selected tag if it doesn't exist,
+// then deletes the rest.
+func (app *App) handleMergeTags(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	var ids []int
+	for _, value := range r.Form["tag"] {
+		if id, err := strconv.Atoi(value); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	into := strings.TrimSpace(r.FormValue("into"))
+
+	problem := tagNameProblem(into)
+	if len(ids) == 0 {
+		problem = "Select the tags to merge"
+	}
+	if problem != "" {
+		app.renderTags(w, r, map[string]any{"Error": problem, "Into": into})
+		return
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Names of the tags merged away, for the message
+	var moved []string
+
+	target, err := findTag(tx, into, 0)
+	targetID, targetSlug := target.ID, target.Slug
+	if err == nil && targetID == 0 {
+		// The first selected tag becomes the merged one
+		var oldName, oldSlug string
+		err = tx.QueryRow("SELECT name, slug FROM tags WHERE id = ?", ids[0]).Scan(&oldName, &oldSlug)
+		if err == nil {
+			moved = append(moved, oldName)
+			targetSlug, err = newTagSlug(tx, into, ids[0])
+		}
+		if err == nil {
+			_, err = tx.Exec("UPDATE tags SET name = ?, slug = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", into, targetSlug, ids[0])
+		}
+		if err == nil {
+			err = touchTagPosts(tx, ids[0])
+		}
+		if err == nil {
+			err = redirectTag(tx, oldSlug, targetSlug)
+		}
+		targetID = ids[0]
+	}
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	for _, id := range ids {
+		if id == targetID {
+			continue
+		}
+
+		var name, slug string
+		err := tx.QueryRow("SELECT name, slug FROM tags WHERE id = ?", id).Scan(&name, &slug)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		err = mergeTag(tx, id, targetID)
+		if err == nil {
+			err = redirectTag(tx, slug, targetSlug)
+		}
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		moved = append(moved, name)
+	}
+
+	if err := tx.Commit(); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.renderTags(w, r, map[string]any{
+		"Message": "Merged " + strings.Join(moved, ", ") + " into " + into + ".",
+	})
+}
+
+func (app *App) handleDeleteOrphanTags(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	result, err := app.db.Exec("DELETE FROM tags WHERE id NOT IN (SELECT tag_id FROM post_tags)")
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	deleted, _ := result.RowsAffected()
+
+	app.renderTags(w, r, map[string]any{
+		"Message": fmt.Sprintf("Deleted %d unused tag(s).", deleted),
+	})
+}
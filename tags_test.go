@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestTagSlug(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"Go", "go"},
+		{"  Web Development ", "web-development"},
+		{"C", "c"},
+		{"C++", "c-plus-plus"},
+		{"C#", "c-sharp"},
+		{"F#", "f-sharp"},
+		{".NET", "dot-net"},
+		{"ASP.NET", "asp-net"},
+		{"Node.js", "node-js"},
+		{"Wait...", "wait"},
+		{"R&D", "r-and-d"},
+		{"Go!", "go"},
+		{"Über", "über"},
+		{"2.0", "2-0"},
+		{"!?", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := tagSlug(test.name); got != test.want {
+			t.Errorf("tagSlug(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSameTagNames(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want bool
+	}{
+		{nil, nil, true},
+		{[]string{"Go", "Web"}, []string{"web", "go"}, true},
+		{[]string{"C"}, []string{"C++"}, false},
+		{[]string{"Go"}, []string{"Go", "Web"}, false},
+	}
+	for _, test := range tests {
+		if got := sameTagNames(test.a, test.b); got != test.want {
+			t.Errorf("sameTagNames(%q, %q) = %t, want %t", test.a, test.b, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Failures allowed before any lockout kicks in
+	loginFreeAttempts = 5
+	// Lockout after the first failure past the free ones, doubled each time
+	loginBaseLockout = 30 * time.Second
+	loginMaxLockout  = time.Hour
+	// Failure counters reset after this long without a failure
+	loginFailureWindow = 24 * time.Hour
+)
+
+type LoginAttempt struct {
+	Username  string
+	IP        string
+	UserAgent string
+	Success   bool
+	Reason    string
+	CreatedAt time.Time
+}
+
+func loginThrottleKeys(username, ip string) []string {
+	return []string{
+		"ip:" + ip,
+		"user:" + strings.ToLower(strings.TrimSpace(username)),
+	}
+}
+
+// loginLockout returns how long the username or IP is still locked out for,
+// or zero if neither is.
+func (app *App) loginLockout(username, ip string) (time.Duration, error) {
+	var remaining time.Duration
+
+	for _, key := range loginThrottleKeys(username, ip) {
+		var lockedUntil sql.NullTime
+		err := app.db.QueryRow("SELECT locked_until FROM login_throttles WHERE key = ?", key).Scan(&lockedUntil)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if lockedUntil.Valid && time.Until(lockedUntil.Time) > remaining {
+			remaining = time.Until(lockedUntil.Time)
+		}
+	}
+
+	return remaining, nil
+}
+
+// loginBackoff returns the lockout to apply after the given number of
+// consecutive failures.
+func loginBackoff(failures int) time.Duration {
+	if failures < loginFreeAttempts {
+		return 0
+	}
+
+	lockout := loginBaseLockout
+	for i := loginFreeAttempts; i < failures; i++ {
+		lockout *= 2
+		if lockout >= loginMaxLockout {
+			return loginMaxLockout
+		}
+	}
+	return lockout
+}
+
+func (app *App) recordLoginFailure(r *http.Request, username, reason string) error {
+	now := time.Now()
+
+	for _, key := range loginThrottleKeys(username, clientIP(r)) {
+		// Counted in one statement so that failures arriving together can't
+		// overwrite each other's count
+		var failures int
+		err := app.db.QueryRow(`
+			INSERT INTO login_throttles (key, failures, last_failure_at)
+			VALUES (?, 1, ?)
+			ON CONFLICT(key) DO UPDATE SET
+				failures = CASE WHEN last_failure_at > ? THEN failures + 1 ELSE 1 END,
+				last_failure_at = excluded.last_failure_at
+			RETURNING failures
+		`, key, sqlTime(now), sqlTime(now.Add(-loginFailureWindow))).Scan(&failures)
+		if err != nil {
+			return err
+		}
+
+		lockout := loginBackoff(failures)
+		if lockout == 0 {
+			continue
+		}
+		lockedUntil := sqlTime(now.Add(lockout))
+		_, err = app.db.Exec(`
+			UPDATE login_throttles SET locked_until = ?
+			WHERE key = ? AND (locked_until IS NULL OR locked_until < ?)
+		`, lockedUntil, key, lockedUntil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return app.logLoginAttempt(r, username, false, reason)
+}
+
+func (app *App) recordLoginSuccess(r *http.Request, username, reason string) error {
+	for _, key := range loginThrottleKeys(username, clientIP(r)) {
+		if _, err := app.db.Exec("DELETE FROM login_throttles WHERE key = ?", key); err != nil {
+			return err
+		}
+	}
+
+	return app.logLoginAttempt(r, username, true, reason)
+}
+
+func (app *App) logLoginAttempt(r *http.Request, username string, success bool, reason string) error {
+	_, err := app.db.Exec(`
+		INSERT INTO login_attempts (username, ip, user_agent, success, reason)
+		VALUES (?, ?, ?, ?, ?)
+	`, username, clientIP(r), r.UserAgent(), success, reason)
+	return err
+}
+
+func (app *App) recentLoginAttempts(limit int) ([]LoginAttempt, error) {
+	rows, err := app.db.Query(`
+		SELECT username, ip, user_agent, success, reason, created_at
+		FROM login_attempts
+		ORDER BY id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []LoginAttempt
+	for rows.Next() {
+		var a LoginAttempt
+		var userAgent sql.NullString
+		if err := rows.Scan(&a.Username, &a.IP, &userAgent, &a.Success, &a.Reason, &a.CreatedAt); err != nil {
+			continue
+		}
+		a.UserAgent = userAgent.String
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// formatLockout rounds a lockout up to something readable on the login form.
+func formatLockout(d time.Duration) string {
+	if d <= time.Minute {
+		return "a minute"
+	}
+	return fmt.Sprintf("%d minutes", int(math.Ceil(d.Minutes())))
+}
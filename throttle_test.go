@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecordLoginFailure(t *testing.T) {
+	app := newTestApp(t)
+	r := httptest.NewRequest("POST", "/login", nil)
+	ip := clientIP(r)
+
+	failures := func(key string) int {
+		t.Helper()
+		var n int
+		if err := app.db.QueryRow("SELECT failures FROM login_throttles WHERE key = ?", key).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// Failures arriving together are all counted
+	const attempts = 20
+	var wg sync.WaitGroup
+	for range attempts {
+		wg.Go(func() {
+			if err := app.recordLoginFailure(r, "alec", "bad password"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+	if n := failures("user:alec"); n != attempts {
+		t.Fatalf("%d failures counted, want %d", n, attempts)
+	}
+
+	lockout, err := app.loginLockout("alec", "192.0.2.99")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockout < loginMaxLockout-time.Minute || lockout > loginMaxLockout {
+		t.Errorf("lockout after %d failures is %v, want %v", attempts, lockout, loginMaxLockout)
+	}
+	if lockout, _ := app.loginLockout("someone else", ip); lockout <= 0 {
+		t.Errorf("the IP isn't locked out")
+	}
+
+	// A failure long after the last one starts the count again
+	old := sqlTime(time.Now().Add(-loginFailureWindow - time.Minute))
+	if _, err := app.db.Exec("UPDATE login_throttles SET last_failure_at = ?, locked_until = NULL", old); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.recordLoginFailure(r, "alec", "bad password"); err != nil {
+		t.Fatal(err)
+	}
+	if n := failures("user:alec"); n != 1 {
+		t.Errorf("%d failures counted after the window, want 1", n)
+	}
+	if lockout, _ := app.loginLockout("alec", ip); lockout != 0 {
+		t.Errorf("locked out for %v after a fresh failure", lockout)
+	}
+}
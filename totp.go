@@ -0,0 +1,446 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// Accept codes from one step either side to allow for clock drift
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	pendingLoginCookieName = "login_pending"
+	pendingLoginDuration   = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() string {
+	b := make([]byte, 20)
+	io.ReadFull(rand.Reader, b)
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpCode computes the RFC 6238 code for a time step (RFC 4226 HOTP with
+// HMAC-SHA1).
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// verifyTOTP checks code against the secret and returns the time step it
+// matched. Steps at or before lastStep are rejected so codes can't be reused.
+func verifyTOTP(secret, code string, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(key) == 0 {
+		return 0, false
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	now := time.Now().Unix() / totpPeriod
+
+	for i := -totpSkew; i <= totpSkew; i++ {
+		step := now + int64(i)
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// totpURI returns the otpauth:// URI authenticator apps use to enroll. The
+// scheme isn't one html/template trusts, so wrap it in template.URL to use it
+// as a link.
+func totpURI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	// Authenticator apps expect %20 rather than + for spaces
+	return "otpauth://totp/" + label + "?" + strings.ReplaceAll(params.Encode(), "+", "%20")
+}
+
+func totpIssuer() string {
+	if u, err := url.Parse(baseURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "Alec Stewart"
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// generateRecoveryCodes replaces the user's recovery codes with a fresh set
+// and returns them. Only hashes are stored, so this is the one chance to
+// show them.
+func (app *App) generateRecoveryCodes(userID int) ([]string, error) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 6)
+		io.ReadFull(rand.Reader, b)
+		raw := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+
+		_, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashToken(normalizeRecoveryCode(raw)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit()
+}
+
+// useRecoveryCode marks a matching unused recovery code as used.
+func (app *App) useRecoveryCode(userID int, code string) (bool, error) {
+	result, err := app.db.Exec(`
+		UPDATE recovery_codes
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (app *App) remainingRecoveryCodes(userID int) int {
+	var count int
+	app.db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&count)
+	return count
+}
+
+// startPendingLogin records that the user got their password right and sends
+// them on to the second step.
+func (app *App) startPendingLogin(w http.ResponseWriter, r *http.Request, userID int) {
+	if _, err := app.db.Exec("DELETE FROM pending_logins WHERE expires_at <= CURRENT_TIMESTAMP"); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	token := generateToken()
+	_, err := app.db.Exec(`
+		INSERT INTO pending_logins (token_hash, user_id, expires_at)
+		VALUES (?, ?, ?)
+	`, hashToken(token), userID, sqlTime(time.Now().Add(pendingLoginDuration)))
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingLoginCookieName,
+		Value:    token,
+		Path:     "/login",
+		HttpOnly: true,
+		MaxAge:   int(pendingLoginDuration.Seconds()),
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	http.Redirect(w, r, "/login/totp", http.StatusSeeOther)
+}
+
+func (app *App) lookupPendingLogin(r *http.Request) (*User, error) {
+	cookie, err := r.Cookie(pendingLoginCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+
+	var user User
+	err = app.db.QueryRow(`
+		SELECT u.id, u.username, COALESCE(u.totp_secret, ''), u.totp_last_step
+		FROM pending_logins pl
+		JOIN users u ON u.id = pl.user_id
+		WHERE pl.token_hash = ? AND pl.expires_at > CURRENT_TIMESTAMP AND u.disabled = 0
+	`, hashToken(cookie.Value)).Scan(&user.ID, &user.Username, &user.TOTPSecret, &user.TOTPLastStep)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (app *App) finishPendingLogin(w http.ResponseWriter, r *http.Request) error {
+	cookie, err := r.Cookie(pendingLoginCookieName)
+	if err != nil {
+		return nil
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   pendingLoginCookieName,
+		Value:  "",
+		Path:   "/login",
+		MaxAge: -1,
+	})
+
+	_, err = app.db.Exec("DELETE FROM pending_logins WHERE token_hash = ?", hashToken(cookie.Value))
+	return err
+}
+
+func (app *App) handleLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	user, err := app.lookupPendingLogin(r)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == "GET" {
+		app.renderLoginTOTP(w, r, http.StatusOK, "")
+		return
+	}
+
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	lockout, err := app.loginLockout(user.Username, clientIP(r))
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if lockout > 0 {
+		if err := app.logLoginAttempt(r, user.Username, false, "locked out"); err != nil {
+			log.Printf("ERROR: Failed to log login attempt: %v", err)
+		}
+		app.renderLoginTOTP(w, r, http.StatusTooManyRequests, "Too many failed attempts. Try again in "+formatLockout(lockout)+".")
+		return
+	}
+
+	code := strings.TrimSpace(r.FormValue("code"))
+	method := "totp"
+
+	step, ok := verifyTOTP(user.TOTPSecret, code, user.TOTPLastStep)
+	if ok {
+		if _, err := app.db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ?", step, user.ID); err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+	} else {
+		method = "recovery code"
+		ok, err = app.useRecoveryCode(user.ID, code)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if !ok {
+		if err := app.recordLoginFailure(r, user.Username, "bad two-factor code"); err != nil {
+			log.Printf("ERROR: Failed to record login failure: %v", err)
+		}
+		app.renderLoginTOTP(w, r, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+
+	if err := app.finishPendingLogin(w, r); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if err := app.recordLoginSuccess(r, user.Username, "password + "+method); err != nil {
+		log.Printf("ERROR: Failed to record login: %v", err)
+	}
+
+	if err := app.createSession(w, r, user.ID); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+func (app *App) renderLoginTOTP(w http.ResponseWriter, r *http.Request, status int, errMsg string) {
+	data := map[string]any{
+		"Error":     errMsg,
+		"CSRFToken": app.csrfToken(w, r),
+	}
+
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+
+	err := app.templates["login_totp.html"].ExecuteTemplate(w, "base", data)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+}
+
+func (app *App) handleTOTPSetup(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	session := app.currentSession(r)
+
+	// The secret is stored straight away but isn't enforced until a code
+	// from it has been confirmed
+	secret := generateTOTPSecret()
+	_, err := app.db.Exec("UPDATE users SET totp_secret = ? WHERE id = ? AND totp_enabled = 0", secret, session.UserID)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.renderSecurity(w, r, map[string]any{
+		"TOTPSecret": secret,
+		"TOTPURI":    template.URL(totpURI(totpIssuer(), session.Username, secret)),
+	})
+}
+
+func (app *App) handleTOTPEnable(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	session := app.currentSession(r)
+
+	var secret sql.NullString
+	var enabled bool
+	err := app.db.QueryRow("SELECT totp_secret, totp_enabled FROM users WHERE id = ?", session.UserID).Scan(&secret, &enabled)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if enabled || !secret.Valid {
+		http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+		return
+	}
+
+	step, ok := verifyTOTP(secret.String, r.FormValue("code"), 0)
+	if !ok {
+		app.renderSecurity(w, r, map[string]any{
+			"Error":      "That code didn't match. Check your device's clock and try again.",
+			"TOTPSecret": secret.String,
+			"TOTPURI":    template.URL(totpURI(totpIssuer(), session.Username, secret.String)),
+		})
+		return
+	}
+
+	_, err = app.db.Exec("UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?", step, session.UserID)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := app.generateRecoveryCodes(session.UserID)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Two-factor authentication enabled for %s", session.Username)
+
+	app.renderSecurity(w, r, map[string]any{
+		"Message":       "Two-factor authentication is on.",
+		"RecoveryCodes": codes,
+	})
+}
+
+func (app *App) handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	session := app.currentSession(r)
+
+	if !app.checkPassword(session.UserID, r.FormValue("password")) {
+		app.renderSecurity(w, r, map[string]any{"Error": "Incorrect password"})
+		return
+	}
+
+	_, err := app.db.Exec("UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = 0 WHERE id = ?", session.UserID)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if _, err := app.db.Exec("DELETE FROM recovery_codes WHERE user_id = ?", session.UserID); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Two-factor authentication disabled for %s", session.Username)
+
+	app.renderSecurity(w, r, map[string]any{"Message": "Two-factor authentication is off."})
+}
+
+func (app *App) handleRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	session := app.currentSession(r)
+
+	if !app.checkPassword(session.UserID, r.FormValue("password")) {
+		app.renderSecurity(w, r, map[string]any{"Error": "Incorrect password"})
+		return
+	}
+
+	codes, err := app.generateRecoveryCodes(session.UserID)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.renderSecurity(w, r, map[string]any{
+		"Message":       "New recovery codes generated. The old ones no longer work.",
+		"RecoveryCodes": codes,
+	})
+}
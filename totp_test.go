@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, cut down to six digits
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		if got := totpCode(secret, test.unix/totpPeriod); got != test.want {
+			t.Errorf("totpCode at %d = %s, want %s", test.unix, got, test.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := generateTOTPSecret()
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep clear of the end of a step, so it's the same one in verifyTOTP
+	if time.Now().Unix()%totpPeriod >= totpPeriod-2 {
+		time.Sleep(2 * time.Second)
+	}
+	now := time.Now().Unix() / totpPeriod
+	code := totpCode(key, now)
+	spaced := code[:3] + " " + code[3:]
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		ok       bool
+	}{
+		{"current code", secret, code, 0, true},
+		{"spaces in the code", secret, spaced, 0, true},
+		{"lowercase secret", strings.ToLower(secret), code, 0, true},
+		{"previous step", secret, totpCode(key, now-1), 0, true},
+		{"next step", secret, totpCode(key, now+1), 0, true},
+		{"too old", secret, totpCode(key, now-totpSkew-2), 0, false},
+		{"already used", secret, code, now + totpSkew, false},
+		{"too short", secret, code[1:], 0, false},
+		{"empty code", secret, "", 0, false},
+		{"invalid secret", "not base32!", code, 0, false},
+		{"empty secret", "", code, 0, false},
+	}
+	for _, test := range tests {
+		step, ok := verifyTOTP(test.secret, test.code, test.lastStep)
+		if ok != test.ok {
+			t.Errorf("%s: verifyTOTP ok = %t, want %t", test.name, ok, test.ok)
+		}
+		if ok && step <= test.lastStep {
+			t.Errorf("%s: verifyTOTP step = %d, not after %d", test.name, step, test.lastStep)
+		}
+	}
+}
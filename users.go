@@ -0,0 +1,555 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	roleOwner  = "owner"
+	roleEditor = "editor"
+	roleAuthor = "author"
+
+	inviteDuration        = 7 * 24 * time.Hour
+	passwordResetDuration = 24 * time.Hour
+	minPasswordLength     = 8
+)
+
+// Owners manage users, editors manage all content, authors only their own posts
+var roleRanks = map[string]int{
+	roleAuthor: 1,
+	roleEditor: 2,
+	roleOwner:  3,
+}
+
+var userRoles = []string{roleOwner, roleEditor, roleAuthor}
+
+func hasRole(have, want string) bool {
+	return roleRanks[want] > 0 && roleRanks[have] >= roleRanks[want]
+}
+
+func validRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+func validatePassword(password, confirm string) error {
+	if len(password) < minPasswordLength {
+		return errors.New("Password must be at least " + strconv.Itoa(minPasswordLength) + " characters")
+	}
+	if password != confirm {
+		return errors.New("Passwords don't match")
+	}
+	return nil
+}
+
+// canEditPost reports whether the signed in user may change a post. Editors
+// and owners can change anything; authors only what they wrote.
+func (app *App) canEditPost(s *Session, postID int) (bool, error) {
+	if hasRole(s.Role, roleEditor) {
+		return true, nil
+	}
+
+	var authorID sql.NullInt64
+	err := app.db.QueryRow("SELECT author_id FROM posts WHERE id = ?", postID).Scan(&authorID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return authorID.Valid && int(authorID.Int64) == s.UserID, nil
+}
+
+// canEditMedia is canEditPost for the media library: authors can change the
+// alt text and caption of what they uploaded.
+func (app *App) canEditMedia(s *Session, mediaID int) (bool, error) {
+	if hasRole(s.Role, roleEditor) {
+		return true, nil
+	}
+
+	var userID sql.NullInt64
+	err := app.db.QueryRow("SELECT user_id FROM media WHERE id = ?", mediaID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return userID.Valid && int(userID.Int64) == s.UserID, nil
+}
+
+// rawHTMLAllowed reports whether Markdown by a post's author may carry raw
+// HTML onto the page. Only editors and owners are trusted with it: owners
+// read authors' posts in the admin, where a script would run with their
+// rights. Posts with no author are treated like an author's.
+func (app *App) rawHTMLAllowed(authorID sql.NullInt64) (bool, error) {
+	if !authorID.Valid {
+		return false, nil
+	}
+	var role string
+	err := app.db.QueryRow("SELECT role FROM users WHERE id = ?", authorID.Int64).Scan(&role)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return hasRole(role, roleEditor), err
+}
+
+// postRawHTMLAllowed is rawHTMLAllowed for the author of an existing post.
+func (app *App) postRawHTMLAllowed(postID int) (bool, error) {
+	var authorID sql.NullInt64
+	if err := app.db.QueryRow("SELECT author_id FROM posts WHERE id = ?", postID).Scan(&authorID); err != nil {
+		return false, err
+	}
+	return app.rawHTMLAllowed(authorID)
+}
+
+// activeOwnersExcept counts enabled owners other than the given user, so the
+// site can't be left without anyone able to manage it.
+func (app *App) activeOwnersExcept(userID int) (int, error) {
+	var count int
+	err := app.db.QueryRow("SELECT COUNT(*) FROM users WHERE role = ? AND disabled = 0 AND id != ?", roleOwner, userID).Scan(&count)
+	return count, err
+}
+
+func (app *App) createUserToken(purpose string, userID int, role string, createdBy int, duration time.Duration) (string, error) {
+	token := generateToken()
+
+	var uid any
+	if userID != 0 {
+		uid = userID
+	}
+
+	_, err := app.db.Exec(`
+		INSERT INTO user_tokens (token_hash, purpose, user_id, role, created_by, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, hashToken(token), purpose, uid, role, createdBy, sqlTime(time.Now().Add(duration)))
+	return token, err
+}
+
+type userToken struct {
+	ID     int
+	UserID int
+	Role   string
+}
+
+func (app *App) lookupUserToken(token, purpose string) (*userToken, error) {
+	var t userToken
+	var userID sql.NullInt64
+	var role sql.NullString
+	err := app.db.QueryRow(`
+		SELECT id, user_id, role
+		FROM user_tokens
+		WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+	`, hashToken(token), purpose).Scan(&t.ID, &userID, &role)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.UserID = int(userID.Int64)
+	t.Role = role.String
+	return &t, nil
+}
+
+func (app *App) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	app.renderUsers(w, r, nil)
+}
+
+func (app *App) renderUsers(w http.ResponseWriter, r *http.Request, extra map[string]any) {
+	rows, err := app.db.Query(`
+		SELECT id, username, role, disabled, created_at
+		FROM users
+		ORDER BY created_at
+	`)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username, &u.Role, &u.Disabled, &u.CreatedAt); err != nil {
+			continue
+		}
+		users = append(users, u)
+	}
+
+	var pendingInvites int
+	app.db.QueryRow(`
+		SELECT COUNT(*) FROM user_tokens
+		WHERE purpose = 'invite' AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+	`).Scan(&pendingInvites)
+
+	data := map[string]any{
+		"Users":          users,
+		"Roles":          userRoles,
+		"PendingInvites": pendingInvites,
+		"CurrentUserID":  app.currentSession(r).UserID,
+		"CSRFToken":      app.csrfToken(w, r),
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	err = app.templates["admin_users.html"].ExecuteTemplate(w, "admin_base", data)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+}
+
+func siteURL(r *http.Request) string {
+	if baseURL != "" {
+		return strings.TrimSuffix(baseURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func (app *App) handleInviteUser(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	role := r.FormValue("role")
+	if !validRole(role) {
+		app.renderUsers(w, r, map[string]any{"Error": "Unknown role"})
+		return
+	}
+
+	session := app.currentSession(r)
+	token, err := app.createUserToken("invite", 0, role, session.UserID, inviteDuration)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("%s created an invite for a new %s", session.Username, role)
+
+	app.renderUsers(w, r, map[string]any{
+		"Message": "Invite link for a new " + role + ". It works once and expires in 7 days.",
+		"Link":    siteURL(r) + "/invite/" + token,
+	})
+}
+
+func (app *App) handleUserRole(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	role := r.FormValue("role")
+	if !validRole(role) {
+		app.renderUsers(w, r, map[string]any{"Error": "Unknown role"})
+		return
+	}
+
+	if role != roleOwner {
+		owners, err := app.activeOwnersExcept(id)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if owners == 0 {
+			app.renderUsers(w, r, map[string]any{"Error": "The site needs at least one owner"})
+			return
+		}
+	}
+
+	if _, err := app.db.Exec("UPDATE users SET role = ? WHERE id = ?", role, id); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Whether their posts keep raw HTML goes with the role
+	if _, err := app.renderTableHTML("posts", "p.author_id = ?", id); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+func (app *App) handleDisableUser(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	id, _ := strconv.Atoi(r.FormValue("id"))
+
+	owners, err := app.activeOwnersExcept(id)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if owners == 0 {
+		app.renderUsers(w, r, map[string]any{"Error": "The site needs at least one owner"})
+		return
+	}
+
+	if _, err := app.db.Exec("UPDATE users SET disabled = 1 WHERE id = ?", id); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	// Sign them out everywhere
+	if _, err := app.db.Exec("DELETE FROM sessions WHERE user_id = ?", id); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+func (app *App) handleEnableUser(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	id, _ := strconv.Atoi(r.FormValue("id"))
+
+	if _, err := app.db.Exec("UPDATE users SET disabled = 0 WHERE id = ?", id); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+func (app *App) handleResetUserPassword(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	id, _ := strconv.Atoi(r.FormValue("id"))
+
+	var username string
+	err := app.db.QueryRow("SELECT username FROM users WHERE id = ?", id).Scan(&username)
+	if err != nil {
+		app.httpError(w, err, http.StatusNotFound)
+		return
+	}
+
+	session := app.currentSession(r)
+	token, err := app.createUserToken("reset", id, "", session.UserID, passwordResetDuration)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("%s created a password reset link for %s", session.Username, username)
+
+	app.renderUsers(w, r, map[string]any{
+		"Message": "Password reset link for " + username + ". It works once and expires in 24 hours.",
+		"Link":    siteURL(r) + "/reset/" + token,
+	})
+}
+
+func (app *App) handleAcceptInvite(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+
+	invite, err := app.lookupUserToken(token, "invite")
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if invite == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := map[string]any{
+		"Role":      invite.Role,
+		"CSRFToken": app.csrfToken(w, r),
+	}
+
+	if r.Method == "GET" {
+		err := app.templates["invite.html"].ExecuteTemplate(w, "base", data)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	username := strings.TrimSpace(r.FormValue("username"))
+	password := r.FormValue("password")
+	data["Username"] = username
+
+	formErr := validatePassword(password, r.FormValue("confirm_password"))
+	if username == "" {
+		formErr = errors.New("Username is required")
+	}
+
+	var userID int64
+	if formErr == nil {
+		userID, formErr = app.redeemInvite(invite, username, password)
+	}
+
+	if formErr != nil {
+		data["Error"] = formErr.Error()
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		err := app.templates["invite.html"].ExecuteTemplate(w, "base", data)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.Printf("User %s joined as %s", username, invite.Role)
+
+	if err := app.createSession(w, r, int(userID)); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// redeemInvite creates the invited user and uses up the invite together, so
+// a link can't be used twice.
+func (app *App) redeemInvite(invite *userToken, username, password string) (int64, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	tx.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", username).Scan(&exists)
+	if exists > 0 {
+		return 0, errors.New("That username is taken")
+	}
+
+	result, err := tx.Exec("INSERT INTO users (username, password, role) VALUES (?, ?, ?)", username, string(hashedPassword), invite.Role)
+	if err != nil {
+		return 0, err
+	}
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	result, err = tx.Exec("UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP, user_id = ? WHERE id = ? AND used_at IS NULL", userID, invite.ID)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, errors.New("This invite has already been used")
+	}
+
+	return userID, tx.Commit()
+}
+
+func (app *App) handlePasswordReset(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+
+	reset, err := app.lookupUserToken(token, "reset")
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if reset == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var username string
+	if err := app.db.QueryRow("SELECT username FROM users WHERE id = ?", reset.UserID).Scan(&username); err != nil {
+		app.httpError(w, err, http.StatusNotFound)
+		return
+	}
+
+	data := map[string]any{
+		"Username":  username,
+		"CSRFToken": app.csrfToken(w, r),
+	}
+
+	if r.Method == "GET" {
+		err := app.templates["reset_password.html"].ExecuteTemplate(w, "base", data)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	password := r.FormValue("password")
+	if err := validatePassword(password, r.FormValue("confirm_password")); err != nil {
+		data["Error"] = err.Error()
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		err := app.templates["reset_password.html"].ExecuteTemplate(w, "base", data)
+		if err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	statements := []struct {
+		query string
+		args  []any
+	}{
+		{"UPDATE users SET password = ? WHERE id = ?", []any{string(hashedPassword), reset.UserID}},
+		{"UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP WHERE id = ?", []any{reset.ID}},
+		// Anyone still signed in with the old password gets signed out
+		{"DELETE FROM sessions WHERE user_id = ?", []any{reset.UserID}},
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			app.httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Password reset for %s", username)
+
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
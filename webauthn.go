@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	webauthnChallengeDuration = 5 * time.Minute
+	// Ties a login challenge to the browser that asked for it
+	passkeyLoginCookieName = "passkey_login"
+)
+
+// Authenticator data flags
+const (
+	authFlagUserPresent  = 0x01
+	authFlagUserVerified = 0x04
+	authFlagAttestedData = 0x40
+)
+
+// COSE algorithm identifiers we accept
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+var b64url = base64.RawURLEncoding
+
+type Passkey struct {
+	ID         int
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt sql.NullTime
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+type collectedClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// webauthnRP returns the relying party ID and origin. They come from BASE_URL
+// when it's set so that passkeys keep working behind a proxy.
+func webauthnRP(r *http.Request) (string, string) {
+	if u, err := url.Parse(baseURL); err == nil && u.Host != "" {
+		return u.Hostname(), u.Scheme + "://" + u.Host
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host, scheme + "://" + r.Host
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+
+	ad := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if ad.Flags&authFlagAttestedData == 0 {
+		return ad, nil
+	}
+
+	// 16 byte AAGUID, then a 2 byte credential ID length
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("attested credential data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return nil, errors.New("credential ID truncated")
+	}
+	ad.CredentialID = rest[:idLen]
+	rest = rest[idLen:]
+
+	_, n, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("credential public key: %w", err)
+	}
+	ad.PublicKey = rest[:n]
+
+	return ad, nil
+}
+
+// verifyClientData checks the client data JSON against the ceremony type and
+// origin and returns the challenge it was signed over.
+func verifyClientData(raw []byte, ceremonyType, origin string) (string, error) {
+	var cd collectedClientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return "", fmt.Errorf("client data: %w", err)
+	}
+	if cd.Type != ceremonyType {
+		return "", fmt.Errorf("unexpected client data type %q", cd.Type)
+	}
+	if cd.Origin != origin {
+		return "", fmt.Errorf("unexpected origin %q", cd.Origin)
+	}
+	return cd.Challenge, nil
+}
+
+func verifyAuthenticatorData(ad *authenticatorData, rpID string) error {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(ad.RPIDHash, rpIDHash[:]) {
+		return errors.New("relying party ID mismatch")
+	}
+	if ad.Flags&authFlagUserPresent == 0 {
+		return errors.New("user not present")
+	}
+	if ad.Flags&authFlagUserVerified == 0 {
+		return errors.New("user not verified")
+	}
+	return nil
+}
+
+// verifySignCount checks the authenticator's signature counter against the
+// stored one. Synced passkeys always report zero; anything else must go up or
+// the authenticator may have been cloned.
+func verifySignCount(count, stored uint32) error {
+	if (count != 0 || stored != 0) && count <= stored {
+		return errors.New("signature counter did not increase")
+	}
+	return nil
+}
+
+// verifyCOSESignature checks sig over data with a COSE_Key encoded public key.
+func verifyCOSESignature(coseKey, data, sig []byte) error {
+	v, _, err := decodeCBOR(coseKey)
+	if err != nil {
+		return err
+	}
+	key, ok := v.(map[any]any)
+	if !ok {
+		return errors.New("public key is not a COSE map")
+	}
+
+	alg, _ := key[int64(3)].(int64)
+	switch alg {
+	case coseAlgES256:
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return errors.New("invalid P-256 key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		hash := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(pub, hash[:], sig) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+
+	case coseAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return errors.New("invalid RSA key")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		hash := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig)
+
+	case coseAlgEdDSA:
+		x, _ := key[int64(-2)].([]byte)
+		if len(x) != ed25519.PublicKeySize {
+			return errors.New("invalid Ed25519 key")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(x), data, sig) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported COSE algorithm %d", alg)
+}
+
+func (app *App) createWebAuthnChallenge(ceremony string, userID int) (string, error) {
+	if _, err := app.db.Exec("DELETE FROM webauthn_challenges WHERE expires_at <= CURRENT_TIMESTAMP"); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	challenge := b64url.EncodeToString(b)
+
+	var uid any
+	if userID != 0 {
+		uid = userID
+	}
+
+	_, err := app.db.Exec(`
+		INSERT INTO webauthn_challenges (challenge, ceremony, user_id, expires_at)
+		VALUES (?, ?, ?, ?)
+	`, challenge, ceremony, uid, sqlTime(time.Now().Add(webauthnChallengeDuration)))
+	return challenge, err
+}
+
+// consumeWebAuthnChallenge deletes the challenge so it can only be used once
+// and reports whether it was outstanding for this ceremony and user.
+func (app *App) consumeWebAuthnChallenge(challenge, ceremony string, userID int) (bool, error) {
+	var uid sql.NullInt64
+	err := app.db.QueryRow(`
+		SELECT user_id FROM webauthn_challenges
+		WHERE challenge = ? AND ceremony = ? AND expires_at > CURRENT_TIMESTAMP
+	`, challenge, ceremony).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := app.db.Exec("DELETE FROM webauthn_challenges WHERE challenge = ?", challenge); err != nil {
+		return false, err
+	}
+
+	return int(uid.Int64) == userID, nil
+}
+
+func (app *App) userPasskeys(userID int) ([]Passkey, error) {
+	rows, err := app.db.Query(`
+		SELECT id, name, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = ?
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var passkeys []Passkey
+	for rows.Next() {
+		var p Passkey
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &p.LastUsedAt); err != nil {
+			continue
+		}
+		passkeys = append(passkeys, p)
+	}
+	return passkeys, rows.Err()
+}
+
+func (app *App) handlePasskeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	session := app.currentSession(r)
+	rpID, _ := webauthnRP(r)
+
+	challenge, err := app.createWebAuthnChallenge("register", session.UserID)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := app.db.Query("SELECT credential_id FROM webauthn_credentials WHERE user_id = ?", session.UserID)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	exclude := []map[string]any{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			continue
+		}
+		exclude = append(exclude, map[string]any{"type": "public-key", "id": id})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"challenge": challenge,
+		"rp":        map[string]any{"id": rpID, "name": totpIssuer()},
+		"user": map[string]any{
+			"id":          b64url.EncodeToString([]byte(strconv.Itoa(session.UserID))),
+			"name":        session.Username,
+			"displayName": session.Username,
+		},
+		"pubKeyCredParams": []map[string]any{
+			{"type": "public-key", "alg": coseAlgES256},
+			{"type": "public-key", "alg": coseAlgEdDSA},
+			{"type": "public-key", "alg": coseAlgRS256},
+		},
+		"excludeCredentials": exclude,
+		"authenticatorSelection": map[string]any{
+			"residentKey":      "required",
+			"userVerification": "required",
+		},
+		"attestation": "none",
+		"timeout":     webauthnChallengeDuration.Milliseconds(),
+	})
+}
+
+func (app *App) handlePasskeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	session := app.currentSession(r)
+	rpID, origin := webauthnRP(r)
+
+	var req struct {
+		Name              string `json:"name"`
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "Invalid request"})
+		return
+	}
+
+	credential, err := app.verifyRegistration(req.ClientDataJSON, req.AttestationObject, rpID, origin, session.UserID)
+	if err != nil {
+		log.Printf("Passkey registration failed for %s: %v", session.Username, err)
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "Passkey could not be verified"})
+		return
+	}
+
+	name := req.Name
+	if name == "" {
+		name = "Passkey"
+	}
+
+	_, err = app.db.Exec(`
+		INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, name)
+		VALUES (?, ?, ?, ?, ?)
+	`, session.UserID, b64url.EncodeToString(credential.CredentialID), credential.PublicKey, credential.SignCount, name)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Passkey %q registered for %s", name, session.Username)
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (app *App) verifyRegistration(clientDataB64, attestationB64, rpID, origin string, userID int) (*authenticatorData, error) {
+	clientData, err := b64url.DecodeString(clientDataB64)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := verifyClientData(clientData, "webauthn.create", origin)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := app.consumeWebAuthnChallenge(challenge, "register", userID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("unknown or expired challenge")
+	}
+
+	attestation, err := b64url.DecodeString(attestationB64)
+	if err != nil {
+		return nil, err
+	}
+	v, _, err := decodeCBOR(attestation)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := v.(map[any]any)
+	if !ok {
+		return nil, errors.New("attestation object is not a map")
+	}
+	// We ask for no attestation, so the statement itself isn't checked
+	authData, _ := obj["authData"].([]byte)
+
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyAuthenticatorData(ad, rpID); err != nil {
+		return nil, err
+	}
+	if len(ad.CredentialID) == 0 || len(ad.PublicKey) == 0 {
+		return nil, errors.New("no attested credential")
+	}
+
+	return ad, nil
+}
+
+func (app *App) handleDeletePasskey(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	session := app.currentSession(r)
+	id, _ := strconv.Atoi(r.FormValue("id"))
+
+	_, err := app.db.Exec("DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?", id, session.UserID)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+}
+
+func (app *App) handlePasskeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	rpID, _ := webauthnRP(r)
+
+	challenge, err := app.createWebAuthnChallenge("login", 0)
+	if err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     passkeyLoginCookieName,
+		Value:    challenge,
+		Path:     "/login/passkey",
+		HttpOnly: true,
+		MaxAge:   int(webauthnChallengeDuration.Seconds()),
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	// No allowCredentials: passkeys are discoverable, so the authenticator
+	// tells us who is signing in
+	writeJSON(w, http.StatusOK, map[string]any{
+		"challenge":        challenge,
+		"rpId":             rpID,
+		"userVerification": "required",
+		"timeout":          webauthnChallengeDuration.Milliseconds(),
+	})
+}
+
+func (app *App) handlePasskeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	if !app.validateCSRF(r) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		ID                string `json:"id"`
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "Invalid request"})
+		return
+	}
+
+	// The challenge is single use either way, so drop the cookie now
+	var expected string
+	if cookie, err := r.Cookie(passkeyLoginCookieName); err == nil {
+		expected = cookie.Value
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   passkeyLoginCookieName,
+		Value:  "",
+		Path:   "/login/passkey",
+		MaxAge: -1,
+	})
+
+	var credID, userID, signCount int
+	var username string
+	var publicKey []byte
+	err := app.db.QueryRow(`
+		SELECT c.id, c.user_id, u.username, c.public_key, c.sign_count
+		FROM webauthn_credentials c
+		JOIN users u ON u.id = c.user_id
+		WHERE c.credential_id = ? AND u.disabled = 0
+	`, req.ID).Scan(&credID, &userID, &username, &publicKey, &signCount)
+	if err != nil && err != sql.ErrNoRows {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	lockout, lockErr := app.loginLockout(username, clientIP(r))
+	if lockErr != nil {
+		app.httpError(w, lockErr, http.StatusInternalServerError)
+		return
+	}
+	if lockout > 0 {
+		if err := app.logLoginAttempt(r, username, false, "locked out"); err != nil {
+			log.Printf("ERROR: Failed to log login attempt: %v", err)
+		}
+		writeJSON(w, http.StatusTooManyRequests, map[string]any{"error": "Too many failed attempts. Try again in " + formatLockout(lockout) + "."})
+		return
+	}
+
+	if err == sql.ErrNoRows {
+		err = errors.New("unknown credential")
+	} else {
+		var newCount uint32
+		newCount, err = app.verifyAssertion(req.ClientDataJSON, req.AuthenticatorData, req.Signature, expected, publicKey, uint32(signCount), r)
+		if err == nil {
+			_, err = app.db.Exec(`
+				UPDATE webauthn_credentials
+				SET sign_count = ?, last_used_at = CURRENT_TIMESTAMP
+				WHERE id = ?
+			`, newCount, credID)
+		}
+	}
+
+	if err != nil {
+		log.Printf("Passkey login failed: %v", err)
+		if err := app.recordLoginFailure(r, username, "bad passkey"); err != nil {
+			log.Printf("ERROR: Failed to record login failure: %v", err)
+		}
+		writeJSON(w, http.StatusUnauthorized, map[string]any{"error": "Passkey could not be verified"})
+		return
+	}
+
+	if err := app.recordLoginSuccess(r, username, "passkey"); err != nil {
+		log.Printf("ERROR: Failed to record login: %v", err)
+	}
+
+	if err := app.createSession(w, r, userID); err != nil {
+		app.httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"redirect": "/admin"})
+}
+
+// verifyAssertion checks a login assertion and returns the authenticator's
+// new signature counter. The assertion must be signed over expected, the
+// challenge handed to this browser when the ceremony began.
+func (app *App) verifyAssertion(clientDataB64, authDataB64, sigB64, expected string, publicKey []byte, storedCount uint32, r *http.Request) (uint32, error) {
+	rpID, origin := webauthnRP(r)
+
+	clientData, err := b64url.DecodeString(clientDataB64)
+	if err != nil {
+		return 0, err
+	}
+	authData, err := b64url.DecodeString(authDataB64)
+	if err != nil {
+		return 0, err
+	}
+	sig, err := b64url.DecodeString(sigB64)
+	if err != nil {
+		return 0, err
+	}
+
+	challenge, err := verifyClientData(clientData, "webauthn.get", origin)
+	if err != nil {
+		return 0, err
+	}
+	if expected == "" || challenge != expected {
+		return 0, errors.New("challenge was not issued to this browser")
+	}
+	ok, err := app.consumeWebAuthnChallenge(challenge, "login", 0)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errors.New("unknown or expired challenge")
+	}
+
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return 0, err
+	}
+	if err := verifyAuthenticatorData(ad, rpID); err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientData)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	if err := verifyCOSESignature(publicKey, signed, sig); err != nil {
+		return 0, err
+	}
+
+	if err := verifySignCount(ad.SignCount, storedCount); err != nil {
+		return 0, err
+	}
+
+	return ad.SignCount, nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// cborEncode is just enough of an encoder to build the test inputs.
+func cborEncode(v any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		case n <= 0xffff:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		case n <= 0xffffffff:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+		}
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []any:
+		b := head(4, uint64(len(v)))
+		for _, item := range v {
+			b = append(b, cborEncode(item)...)
+		}
+		return b
+	case map[any]any:
+		b := head(5, uint64(len(v)))
+		for k, item := range v {
+			b = append(b, cborEncode(k)...)
+			b = append(b, cborEncode(item)...)
+		}
+		return b
+	}
+	panic("cborEncode: unsupported type")
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	nested := func(depth int) []byte {
+		return append(bytes.Repeat([]byte{0x81}, depth), 0x00)
+	}
+	var deepest any = int64(0)
+	for range 16 {
+		deepest = []any{deepest}
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  any
+		n     int
+		err   string
+	}{
+		{"small int", []byte{0x17}, int64(23), 1, ""},
+		{"uint8", []byte{0x18, 0xff}, int64(255), 2, ""},
+		{"uint64", []byte{0x1b, 0, 0, 0, 1, 0, 0, 0, 0}, int64(1 << 32), 9, ""},
+		{"negative", []byte{0x38, 0x63}, int64(-100), 2, ""},
+		{"COSE RS256", []byte{0x39, 0x01, 0x00}, int64(-257), 3, ""},
+		{"bytes", []byte{0x43, 1, 2, 3}, []byte{1, 2, 3}, 4, ""},
+		{"text", []byte{0x62, 'h', 'i'}, "hi", 3, ""},
+		{"array", []byte{0x82, 0x01, 0x20}, []any{int64(1), int64(-1)}, 3, ""},
+		{"map", []byte{0xa2, 0x01, 0x02, 0x61, 'k', 0xf5}, map[any]any{int64(1): int64(2), "k": true}, 6, ""},
+		{"tag", []byte{0xc1, 0x1a, 0, 0, 0, 1}, int64(1), 6, ""},
+		{"null", []byte{0xf6}, nil, 1, ""},
+		{"float32", []byte{0xfa, 0x3f, 0xc0, 0, 0}, 1.5, 5, ""},
+		{"trailing data", []byte{0x01, 0x02}, int64(1), 1, ""},
+		{"nested within limit", nested(16), deepest, 17, ""},
+
+		{"empty", nil, nil, 0, "unexpected end"},
+		{"truncated argument", []byte{0x19, 0x01}, nil, 1, "unexpected end"},
+		{"truncated bytes", []byte{0x45, 1, 2}, nil, 1, "unexpected end"},
+		{"truncated array", []byte{0x83, 0x01, 0x02}, nil, 3, "unexpected end"},
+		{"truncated map", []byte{0xa1, 0x01}, nil, 2, "unexpected end"},
+		{"huge bytes", []byte{0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, nil, 9, "unexpected end"},
+		{"huge text", []byte{0x7a, 0x7f, 0xff, 0xff, 0xff}, nil, 5, "unexpected end"},
+		{"huge array", []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, nil, 9, "unexpected end"},
+		{"huge map", []byte{0xbb, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, nil, 9, "unexpected end"},
+		{"integer overflow", []byte{0x1b, 0x80, 0, 0, 0, 0, 0, 0, 0}, nil, 9, "overflow"},
+		{"nested too deeply", nested(1000), nil, 17, "nested too deeply"},
+		{"indefinite length", []byte{0x9f, 0x01, 0xff}, nil, 1, "unsupported additional info"},
+		{"byte string key", []byte{0xa1, 0x41, 0x00, 0x01}, nil, 3, "unsupported map key"},
+		{"undefined simple value", []byte{0xf0}, nil, 1, "unsupported simple value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, n, err := decodeCBOR(tt.input)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+			if n != tt.n {
+				t.Errorf("n = %d, want %d", n, tt.n)
+			}
+		})
+	}
+}
+
+func FuzzDecodeCBOR(f *testing.F) {
+	f.Add([]byte{0xa2, 0x01, 0x02, 0x61, 'k', 0xf5})
+	f.Add([]byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Add(bytes.Repeat([]byte{0x81}, 64))
+	f.Add(cborEncode(map[any]any{"fmt": "none", "attStmt": map[any]any{}, "authData": []byte{1, 2, 3}}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, n, err := decodeCBOR(data)
+		if n < 0 || n > len(data) {
+			t.Fatalf("n = %d for %d bytes of input", n, len(data))
+		}
+		if err == nil && n == 0 {
+			t.Fatal("decoded an item from no input")
+		}
+	})
+}
+
+// testKey is a credential key pair for each algorithm we accept.
+type testKey struct {
+	alg  int
+	cose []byte
+	sign func(data []byte) []byte
+}
+
+func newTestKeys(t *testing.T) []testKey {
+	t.Helper()
+
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPub, err := ec.PublicKey.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edPub, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []testKey{
+		{
+			alg: coseAlgES256,
+			cose: cborEncode(map[any]any{
+				1: 2, 3: coseAlgES256, -1: 1,
+				-2: ecPub[1:33], -3: ecPub[33:],
+			}),
+			sign: func(data []byte) []byte {
+				hash := sha256.Sum256(data)
+				sig, err := ecdsa.SignASN1(rand.Reader, ec, hash[:])
+				if err != nil {
+					t.Fatal(err)
+				}
+				return sig
+			},
+		},
+		{
+			alg:  coseAlgEdDSA,
+			cose: cborEncode(map[any]any{1: 1, 3: coseAlgEdDSA, -1: 6, -2: []byte(edPub)}),
+			sign: func(data []byte) []byte { return ed25519.Sign(ed, data) },
+		},
+		{
+			alg: coseAlgRS256,
+			cose: cborEncode(map[any]any{
+				1: 3, 3: coseAlgRS256,
+				-1: rs.N.Bytes(), -2: big.NewInt(int64(rs.E)).Bytes(),
+			}),
+			sign: func(data []byte) []byte {
+				hash := sha256.Sum256(data)
+				sig, err := rsa.SignPKCS1v15(rand.Reader, rs, crypto.SHA256, hash[:])
+				if err != nil {
+					t.Fatal(err)
+				}
+				return sig
+			},
+		},
+	}
+}
+
+func TestVerifyCOSESignature(t *testing.T) {
+	data := []byte("authenticator data and client data hash")
+	keys := newTestKeys(t)
+
+	for _, k := range keys {
+		sig := k.sign(data)
+		if err := verifyCOSESignature(k.cose, data, sig); err != nil {
+			t.Errorf("alg %d: valid signature rejected: %v", k.alg, err)
+		}
+		if err := verifyCOSESignature(k.cose, []byte("something else"), sig); err == nil {
+			t.Errorf("alg %d: signature over other data accepted", k.alg)
+		}
+		tampered := append([]byte{}, sig...)
+		tampered[len(tampered)-1] ^= 1
+		if err := verifyCOSESignature(k.cose, data, tampered); err == nil {
+			t.Errorf("alg %d: tampered signature accepted", k.alg)
+		}
+	}
+
+	sig := keys[1].sign(data)
+	for name, key := range map[string][]byte{
+		"not a map":       cborEncode([]any{1, 2}),
+		"unknown alg":     cborEncode(map[any]any{3: -36, -2: []byte("x")}),
+		"short ES256 key": cborEncode(map[any]any{3: coseAlgES256, -2: []byte{1}, -3: []byte{2}}),
+		"short EdDSA key": cborEncode(map[any]any{3: coseAlgEdDSA, -2: []byte{1, 2, 3}}),
+		"RSA without n":   cborEncode(map[any]any{3: coseAlgRS256, -2: []byte{1, 0, 1}}),
+		"truncated":       keys[1].cose[:10],
+	} {
+		if err := verifyCOSESignature(key, data, sig); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+// testAuthData builds authenticator data for rpID, with attested credential
+// data when credID is set.
+func testAuthData(rpID string, flags byte, count uint32, credID, coseKey []byte) []byte {
+	hash := sha256.Sum256([]byte(rpID))
+	b := append(hash[:], flags)
+	b = binary.BigEndian.AppendUint32(b, count)
+	if credID != nil {
+		b = append(b, make([]byte, 16)...)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(credID)))
+		b = append(b, credID...)
+		b = append(b, coseKey...)
+	}
+	return b
+}
+
+func TestParseAuthenticatorData(t *testing.T) {
+	key := newTestKeys(t)[1].cose
+	full := testAuthData("example.com", authFlagUserPresent|authFlagAttestedData, 7, []byte("cred"), key)
+
+	ad, err := parseAuthenticatorData(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ad.SignCount != 7 || string(ad.CredentialID) != "cred" || !bytes.Equal(ad.PublicKey, key) {
+		t.Errorf("got count %d, credential %q, key %x", ad.SignCount, ad.CredentialID, ad.PublicKey)
+	}
+
+	// Extensions may follow the key, and mustn't end up in it
+	ad, err = parseAuthenticatorData(append(full, cborEncode(map[any]any{"credProtect": 1})...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ad.PublicKey, key) {
+		t.Errorf("public key includes trailing data")
+	}
+
+	for name, data := range map[string][]byte{
+		"too short":              full[:36],
+		"attested data short":    full[:37+17],
+		"credential ID too long": full[:37+18+3],
+		"key truncated":          full[:len(full)-1],
+	} {
+		if _, err := parseAuthenticatorData(data); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestVerifySignCount(t *testing.T) {
+	tests := []struct {
+		count, stored uint32
+		ok            bool
+	}{
+		{0, 0, true},
+		{1, 0, true},
+		{6, 5, true},
+		{5, 5, false},
+		{4, 5, false},
+		{0, 5, false},
+	}
+	for _, tt := range tests {
+		err := verifySignCount(tt.count, tt.stored)
+		if (err == nil) != tt.ok {
+			t.Errorf("verifySignCount(%d, %d) = %v, want ok %v", tt.count, tt.stored, err, tt.ok)
+		}
+	}
+}
+
+// setTestBaseURL points the relying party at example.com for the test.
+func setTestBaseURL(t *testing.T) {
+	old := baseURL
+	baseURL = "https://example.com"
+	t.Cleanup(func() { baseURL = old })
+}
+
+func testClientData(ceremonyType, challenge string) string {
+	b, _ := json.Marshal(collectedClientData{Type: ceremonyType, Challenge: challenge, Origin: "https://example.com"})
+	return b64url.EncodeToString(b)
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	setTestBaseURL(t)
+	app := newTestApp(t)
+	key := newTestKeys(t)[0].cose
+	flags := byte(authFlagUserPresent | authFlagUserVerified | authFlagAttestedData)
+
+	tests := []struct {
+		name        string
+		attestation any
+		userID      int
+		ok          bool
+	}{
+		{"valid", map[any]any{"fmt": "none", "attStmt": map[any]any{}, "authData": testAuthData("example.com", flags, 0, []byte("cred"), key)}, 1, true},
+		{"other user's challenge", map[any]any{"fmt": "none", "authData": testAuthData("example.com", flags, 0, []byte("cred"), key)}, 2, false},
+		{"array", []any{"none", testAuthData("example.com", flags, 0, []byte("cred"), key)}, 1, false},
+		{"byte string", testAuthData("example.com", flags, 0, []byte("cred"), key), 1, false},
+		{"no authData", map[any]any{"fmt": "none"}, 1, false},
+		{"authData not bytes", map[any]any{"fmt": "none", "authData": "text"}, 1, false},
+		{"other relying party", map[any]any{"fmt": "none", "authData": testAuthData("evil.example", flags, 0, []byte("cred"), key)}, 1, false},
+		{"no credential", map[any]any{"fmt": "none", "authData": testAuthData("example.com", authFlagUserPresent|authFlagUserVerified, 0, nil, nil)}, 1, false},
+		{"user not verified", map[any]any{"fmt": "none", "authData": testAuthData("example.com", authFlagUserPresent|authFlagAttestedData, 0, []byte("cred"), key)}, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			challenge, err := app.createWebAuthnChallenge("register", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = app.verifyRegistration(
+				testClientData("webauthn.create", challenge),
+				b64url.EncodeToString(cborEncode(tt.attestation)),
+				"example.com", "https://example.com", tt.userID,
+			)
+			if (err == nil) != tt.ok {
+				t.Errorf("err = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	setTestBaseURL(t)
+	app := newTestApp(t)
+	r := httptest.NewRequest("POST", "/login/passkey/finish", nil)
+	flags := byte(authFlagUserPresent | authFlagUserVerified)
+
+	for _, k := range newTestKeys(t) {
+		assert := func(challenge, expected string, count, stored uint32) (uint32, error) {
+			clientData := testClientData("webauthn.get", challenge)
+			raw, _ := b64url.DecodeString(clientData)
+			hash := sha256.Sum256(raw)
+			authData := testAuthData("example.com", flags, count, nil, nil)
+			sig := k.sign(append(append([]byte{}, authData...), hash[:]...))
+			return app.verifyAssertion(clientData, b64url.EncodeToString(authData), b64url.EncodeToString(sig), expected, k.cose, stored, r)
+		}
+		newChallenge := func() string {
+			c, err := app.createWebAuthnChallenge("login", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c
+		}
+
+		c := newChallenge()
+		count, err := assert(c, c, 8, 7)
+		if err != nil || count != 8 {
+			t.Errorf("alg %d: valid assertion got %d, %v", k.alg, count, err)
+		}
+		if _, err := assert(c, c, 9, 8); err == nil {
+			t.Errorf("alg %d: challenge accepted twice", k.alg)
+		}
+
+		c = newChallenge()
+		if _, err := assert(c, c, 7, 7); err == nil {
+			t.Errorf("alg %d: sign count regression accepted", k.alg)
+		}
+
+		// Another browser's outstanding challenge is no good
+		mine, theirs := newChallenge(), newChallenge()
+		if _, err := assert(theirs, mine, 8, 7); err == nil {
+			t.Errorf("alg %d: challenge from another browser accepted", k.alg)
+		}
+		if _, err := assert(theirs, "", 8, 7); err == nil {
+			t.Errorf("alg %d: challenge accepted without a cookie", k.alg)
+		}
+		if _, err := assert(mine, mine, 8, 7); err != nil {
+			t.Errorf("alg %d: own challenge rejected after a mismatch: %v", k.alg, err)
+		}
+	}
+}